@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// manifestVersion is increased whenever the archive layout changes in a way
+// older restore code cannot handle.
+const manifestVersion = 1
+
+const (
+	manifestName  = "manifest.json"
+	archivePrefix = "backup-"
+	archiveSuffix = ".tar.zst"
+	// archiveTimeFormat sorts lexically in time order.
+	archiveTimeFormat = "20060102-150405"
+)
+
+// manifest is the last entry of every archive. It lists the archived
+// services and the checksum of every file, so that a restore can verify the
+// archive before replacing any data.
+type manifest struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Hostname string            `json:"hostname"`
+	Services []serviceManifest `json:"services"`
+}
+
+type serviceManifest struct {
+	service
+	Files []fileManifest `json:"files"`
+}
+
+type fileManifest struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func archiveName(t time.Time) string {
+	return archivePrefix + t.UTC().Format(archiveTimeFormat) + archiveSuffix
+}
+
+// createArchive writes the selected services to a new archive in dir and
+// returns its path. The archive only gets its final name once it is
+// complete.
+func createArchive(dir string, selected []service) (string, error) {
+	now := time.Now()
+	final := filepath.Join(dir, archiveName(now))
+	f, err := os.CreateTemp(dir, ".partial-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Keep memory use low enough for a Pi Zero 2 W.
+	zw, err := zstd.NewWriter(f, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(4<<20))
+	if err != nil {
+		return "", err
+	}
+	tw := tar.NewWriter(zw)
+
+	hostname, _ := os.Hostname()
+	m := manifest{
+		Version:  manifestVersion,
+		Created:  now.UTC(),
+		Hostname: hostname,
+	}
+	for _, s := range selected {
+		if !s.exists() {
+			log.Printf("skipping %s: %s does not exist", s.Name, s.Dir)
+			continue
+		}
+		sm, err := archiveService(tw, s)
+		if err != nil {
+			return "", fmt.Errorf("archiving %s: %v", s.Name, err)
+		}
+		m.Services = append(m.Services, sm)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: now,
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return final, os.Rename(f.Name(), final)
+}
+
+// archiveService writes s.Dir below s.Name/ in tw, with s's container paused.
+func archiveService(tw *tar.Writer, s service) (serviceManifest, error) {
+	sm := serviceManifest{service: s}
+	resume := s.quiesce()
+	defer resume()
+
+	start := time.Now()
+	err := filepath.WalkDir(s.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(s.Name, filepath.ToSlash(rel))
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case fi.Mode().IsRegular(), fi.IsDir():
+		case fi.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+			if !localLink(filepath.ToSlash(rel), link) {
+				log.Printf("skipping %s: restore refuses symlinks to %s outside of %s", p, link, s.Dir)
+				return nil
+			}
+		default:
+			// Sockets, FIFOs and device nodes are recreated by their
+			// services.
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(f, fi.Size()))
+		if err != nil {
+			return err
+		}
+		if n != fi.Size() {
+			return fmt.Errorf("%s shrank while archiving it", p)
+		}
+		sm.Files = append(sm.Files, fileManifest{
+			Path:   name,
+			Size:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	})
+	log.Printf("archived %s (%d files) in %v", s.Name, len(sm.Files), time.Since(start).Round(time.Millisecond))
+	return sm, err
+}
+
+// localLink reports whether a symlink at rel, relative to a service
+// directory, to link stays within the service directory.
+func localLink(rel, link string) bool {
+	if path.IsAbs(link) {
+		return false
+	}
+	return filepath.IsLocal(filepath.FromSlash(path.Join(path.Dir(rel), link)))
+}
+
+// listArchives returns the archives in dir, oldest first.
+func listArchives(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), archivePrefix) && strings.HasSuffix(e.Name(), archiveSuffix) {
+			archives = append(archives, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// rotate removes all but the newest keep archives in dir.
+func rotate(dir string, keep int) error {
+	archives, err := listArchives(dir)
+	if err != nil {
+		return err
+	}
+	for len(archives) > keep {
+		log.Printf("removing old archive %s", archives[0])
+		if err := os.Remove(archives[0]); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// backup archives the data that the gokrazy-ha services keep below /perm.
+//
+// Run as a gokrazy service it writes backup-<time>.tar.zst to -dest every
+// -interval and keeps the newest -keep archives. With -device, the archives
+// go to a USB stick that is only mounted while an archive is written.
+// Containers are paused while their directory is archived.
+//
+// To restore, run it with -restore pointing to an archive, optionally limited
+// to some of the services:
+//
+//	backup -restore /perm/backup/backup-20231104-030000.tar.zst -services zigbee2mqtt
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+)
+
+func main() {
+	dest := flag.String("dest", "/perm/backup", "directory to write archives to; relative to the USB stick's root if -device is set")
+	device := flag.String("device", "", "block device of a USB stick to write archives to, e.g. /dev/sda1")
+	interval := flag.Duration("interval", 24*time.Hour, "time between backups, 0 to back up once and exit")
+	keep := flag.Int("keep", 7, "number of archives to keep")
+	list := flag.String("services", "", "comma-separated services to back up or restore, default all")
+	restore := flag.String("restore", "", "archive to restore instead of backing up; relative to the USB stick's root if -device is set")
+	flag.Parse()
+
+	selected, err := selectServices(*list)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *restore != "" {
+		archive := *restore
+		if *device != "" {
+			unmount, err := mountDevice(*device)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer unmount()
+			archive = filepath.Join(usbMountpoint, archive)
+		}
+		if err := restoreArchive(archive, selected); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Archive names and rotation rely on the time of day.
+	gokrazy.WaitForClock()
+
+	for {
+		if err := backup(*dest, *device, *keep, selected); err != nil {
+			log.Print(err)
+		}
+		if *interval == 0 {
+			// Do not let gokrazy restart us.
+			os.Exit(125)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func backup(dest, device string, keep int, selected []service) error {
+	if device != "" {
+		unmount, err := mountDevice(device)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+		dest = filepath.Join(usbMountpoint, dest)
+	}
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	start := time.Now()
+	archive, err := createArchive(dest, selected)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(archive)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%d MiB) in %v", archive, fi.Size()>>20, time.Since(start).Round(time.Second))
+	return rotate(dest, keep)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/containerComponent"
+	"github.com/klauspost/compress/zstd"
+)
+
+// restoreArchive replaces the data of the selected services with their copy
+// in archive. Everything is extracted and verified against the manifest
+// before any service directory is touched. The previous data is kept next to
+// it as <dir>.pre-restore-<time>.
+func restoreArchive(archive string, selected []service) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	wanted := make(map[string]service)
+	for _, s := range selected {
+		wanted[s.Name] = s
+	}
+	staging := make(map[string]string) // service name → staging dir
+	defer func() {
+		for _, dir := range staging {
+			os.RemoveAll(dir)
+		}
+	}()
+	sums := make(map[string]string) // archive path → sha256
+	var m *manifest
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", archive, err)
+		}
+		if hdr.Name == manifestName {
+			m = new(manifest)
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return fmt.Errorf("%s: %s: %v", archive, manifestName, err)
+			}
+			continue
+		}
+
+		name := path.Clean(strings.TrimSuffix(hdr.Name, "/"))
+		svcName, rel, _ := strings.Cut(name, "/")
+		s, ok := wanted[svcName]
+		if !ok {
+			continue
+		}
+		if rel == "" {
+			rel = "."
+		}
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("%s: refusing to extract %s outside of %s", archive, hdr.Name, s.Dir)
+		}
+		dir, ok := staging[svcName]
+		if !ok {
+			dir = s.Dir + ".restore"
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			staging[svcName] = dir
+		}
+		sum, err := extract(tr, hdr, dir, rel)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", archive, hdr.Name, err)
+		}
+		if sum != "" {
+			sums[name] = sum
+		}
+	}
+
+	if m == nil {
+		return fmt.Errorf("%s has no manifest, it is probably truncated", archive)
+	}
+	if m.Version > manifestVersion {
+		return fmt.Errorf("%s was written by a newer version (manifest version %d)", archive, m.Version)
+	}
+	log.Printf("restoring from %s, created %v on %s", archive, m.Created, m.Hostname)
+	for _, sm := range m.Services {
+		if _, ok := wanted[sm.Name]; !ok {
+			continue
+		}
+		for _, fm := range sm.Files {
+			if sums[fm.Path] != fm.SHA256 {
+				return fmt.Errorf("%s: checksum mismatch for %s", archive, fm.Path)
+			}
+		}
+	}
+
+	var errs []error
+	for _, s := range selected {
+		dir, ok := staging[s.Name]
+		if !ok {
+			log.Printf("%s contains no data for %s", archive, s.Name)
+			continue
+		}
+		if err := s.swap(dir); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %v", s.Name, err))
+			continue
+		}
+		delete(staging, s.Name)
+		log.Printf("restored %s", s.Dir)
+	}
+	return errors.Join(errs...)
+}
+
+// swap moves dir into place as s.Dir and restarts s's container, so that it
+// picks up the restored data.
+func (s service) swap(dir string) error {
+	resume := s.quiesce()
+	if _, err := os.Stat(s.Dir); err == nil {
+		old := s.Dir + ".pre-restore-" + time.Now().UTC().Format(archiveTimeFormat)
+		if err := os.Rename(s.Dir, old); err != nil {
+			resume()
+			return err
+		}
+		log.Printf("moved the previous data of %s to %s", s.Name, old)
+	}
+	err := os.Rename(dir, s.Dir)
+	resume()
+	if err != nil {
+		return err
+	}
+	if s.Container != "" {
+		return containerComponent.Stop(s.Container)
+	}
+	return nil
+}
+
+// extract writes one archive entry to rel below root and returns the SHA-256
+// of regular files. Symlinks have to stay below root, and no entry is written
+// through a symlink, so that an archive cannot write outside of root.
+func extract(tr *tar.Reader, hdr *tar.Header, root, rel string) (string, error) {
+	if err := noSymlinks(root, rel); err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return "", err
+		}
+		if err := os.Chmod(target, mode.Perm()); err != nil {
+			return "", err
+		}
+
+	case tar.TypeSymlink:
+		if !localLink(rel, hdr.Linkname) {
+			return "", fmt.Errorf("symlink to %s points outside of the service directory", hdr.Linkname)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return "", err
+		}
+		return "", os.Lchown(target, hdr.Uid, hdr.Gid)
+
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, h), tr); err != nil {
+			f.Close()
+			return "", err
+		}
+		if err := f.Close(); err != nil {
+			return "", err
+		}
+		if err := os.Chown(target, hdr.Uid, hdr.Gid); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+
+	default:
+		log.Printf("skipping %s of unsupported type %c", hdr.Name, hdr.Typeflag)
+		return "", nil
+	}
+	return "", os.Chown(target, hdr.Uid, hdr.Gid)
+}
+
+// noSymlinks returns an error if rel below root, or any of its parent
+// directories, is a symlink.
+func noSymlinks(root, rel string) error {
+	p := root
+	for _, elem := range strings.Split(rel, "/") {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %s", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var testTime = time.Date(2023, 11, 4, 3, 0, 0, 0, time.UTC)
+
+// testService returns a service whose data is in a temporary directory,
+// with a nested file and a symlink within it.
+func testService(t *testing.T) service {
+	t.Helper()
+	s := service{Name: "zigbee2mqtt", Dir: filepath.Join(t.TempDir(), "zigbee2mqtt")}
+	files := map[string]string{
+		"data/configuration.yaml": "permit_join: false\n",
+		"data/database.db":        "{}\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(s.Dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("data/configuration.yaml", filepath.Join(s.Dir, "configuration.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	// Restore would refuse this one, so it is not archived.
+	if err := os.Symlink("/etc/passwd", filepath.Join(s.Dir, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := testService(t)
+	dest := t.TempDir()
+	archive, err := createArchive(dest, []service{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(s.Dir, "data/configuration.yaml"), []byte("broken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreArchive(archive, []service{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(s.Dir, "configuration.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "permit_join: false\n"; got != want {
+		t.Errorf("restored configuration.yaml = %q, want %q", got, want)
+	}
+	if link, err := os.Readlink(filepath.Join(s.Dir, "configuration.yaml")); err != nil || link != "data/configuration.yaml" {
+		t.Errorf("restored symlink = %q, %v, want data/configuration.yaml", link, err)
+	}
+	if _, err := os.Lstat(filepath.Join(s.Dir, "passwd")); !os.IsNotExist(err) {
+		t.Errorf("symlink outside of the service directory was restored: %v", err)
+	}
+
+	// The previous data is kept next to the restored one.
+	old, err := filepath.Glob(s.Dir + ".pre-restore-*")
+	if err != nil || len(old) != 1 {
+		t.Fatalf("previous data = %q, %v, want one directory", old, err)
+	}
+	b, err = os.ReadFile(filepath.Join(old[0], "data/configuration.yaml"))
+	if err != nil || string(b) != "broken\n" {
+		t.Errorf("previous configuration.yaml = %q, %v, want %q", b, err, "broken\n")
+	}
+}
+
+func TestRestoreChecksum(t *testing.T) {
+	s := testService(t)
+	archive := filepath.Join(t.TempDir(), archiveName(testTime))
+	writeArchive(t, archive, []entry{
+		{hdr: &tar.Header{Name: "zigbee2mqtt/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: &tar.Header{Name: "zigbee2mqtt/database.db", Typeflag: tar.TypeReg, Mode: 0600}, content: "tampered"},
+		{hdr: &tar.Header{Name: manifestName, Typeflag: tar.TypeReg, Mode: 0644}, content: `{"version": 1, "services": [{"name": "zigbee2mqtt", "files": [{"path": "zigbee2mqtt/database.db", "sha256": "00"}]}]}`},
+	})
+	err := restoreArchive(archive, []service{s})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("restoreArchive = %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "data/database.db")); err != nil {
+		t.Errorf("data was replaced despite the mismatch: %v", err)
+	}
+}
+
+func TestRestoreMalicious(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []entry
+	}{
+		{
+			name: "absolute symlink",
+			entries: []entry{
+				{hdr: &tar.Header{Name: "zigbee2mqtt/a", Typeflag: tar.TypeSymlink, Linkname: "/"}},
+				{hdr: &tar.Header{Name: "zigbee2mqtt/a/etc/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"},
+			},
+		},
+		{
+			name: "relative symlink",
+			entries: []entry{
+				{hdr: &tar.Header{Name: "zigbee2mqtt/sub/a", Typeflag: tar.TypeSymlink, Linkname: "../../.."}},
+				{hdr: &tar.Header{Name: "zigbee2mqtt/sub/a/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"},
+			},
+		},
+		{
+			name: "write through symlink",
+			entries: []entry{
+				{hdr: &tar.Header{Name: "zigbee2mqtt/data/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{hdr: &tar.Header{Name: "zigbee2mqtt/a", Typeflag: tar.TypeSymlink, Linkname: "data"}},
+				{hdr: &tar.Header{Name: "zigbee2mqtt/a/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testService(t)
+			before := tree(t, filepath.Dir(s.Dir))
+			archive := filepath.Join(t.TempDir(), archiveName(testTime))
+			writeArchive(t, archive, tc.entries)
+			if err := restoreArchive(archive, []service{s}); err == nil || !strings.Contains(err.Error(), "symlink") {
+				t.Errorf("restoreArchive = %v, want an error about the symlink", err)
+			}
+			if after := tree(t, filepath.Dir(s.Dir)); !reflect.DeepEqual(after, before) {
+				t.Errorf("restoreArchive changed %q to %q", before, after)
+			}
+			if _, err := os.Stat("/etc/evil"); err == nil {
+				t.Errorf("restoreArchive wrote /etc/evil")
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"backup-20231101-030000.tar.zst",
+		"backup-20231102-030000.tar.zst",
+		"backup-20231103-030000.tar.zst",
+		"backup-20231104-030000.tar.zst",
+		// Neither archives nor complete ones.
+		".partial-123",
+		"notes.txt",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rotate(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		".partial-123",
+		"backup-20231103-030000.tar.zst",
+		"backup-20231104-030000.tar.zst",
+		"notes.txt",
+	}
+	if got := tree(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("after rotate: %q, want %q", got, want)
+	}
+}
+
+type entry struct {
+	hdr     *tar.Header
+	content string
+}
+
+func writeArchive(t *testing.T, path string, entries []entry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.content))
+		e.hdr.Uid, e.hdr.Gid = os.Getuid(), os.Getgid()
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tree returns the paths below dir.
+func tree(t *testing.T, dir string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir {
+			rel, _ := filepath.Rel(dir, p)
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
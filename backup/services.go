@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/alf632/gokrazy-ha/containerComponent"
+)
+
+// service is a directory below /perm and the container that writes to it.
+type service struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+	// Container is paused while Dir is archived and restarted after Dir
+	// was restored. Empty for services that do not run in a container.
+	Container string `json:"container,omitempty"`
+}
+
+// services are the data directories this repository's launchers use.
+var services = []service{
+	{Name: "homeassistant", Dir: "/perm/ha", Container: "homeassistant"},
+	// data holds the network key and device pairings.
+	{Name: "zigbee2mqtt", Dir: "/perm/zigbee2mqtt", Container: "zigbee2mqtt"},
+	{Name: "node-red", Dir: "/perm/node-red", Container: "node-red"},
+	{Name: "mqtt", Dir: "/perm/mqtt", Container: "mqtt"},
+	{Name: "esphome", Dir: "/perm/esphome", Container: "esphome"},
+	{Name: "vanpi", Dir: "/perm/vanpi", Container: "vanpi"},
+	{Name: "goMqttGpio", Dir: "/perm/goMqttGpio"},
+	{Name: "display-serial", Dir: "/perm/display-serial"},
+}
+
+// selectServices returns the services named in the comma-separated list, or
+// all services if list is empty.
+func selectServices(list string) ([]service, error) {
+	if list == "" {
+		return services, nil
+	}
+	var selected []service
+Names:
+	for _, name := range strings.Split(list, ",") {
+		for _, s := range services {
+			if s.Name == name {
+				selected = append(selected, s)
+				continue Names
+			}
+		}
+		return nil, fmt.Errorf("unknown service %q", name)
+	}
+	return selected, nil
+}
+
+// exists reports whether s has any data to back up.
+func (s service) exists() bool {
+	_, err := os.Stat(s.Dir)
+	return err == nil
+}
+
+// quiesce pauses s's container, if it runs, and returns a function that
+// resumes it. A container that cannot be paused is archived while running.
+func (s service) quiesce() (resume func()) {
+	if s.Container == "" {
+		return func() {}
+	}
+	thaw, err := containerComponent.Pause(s.Container)
+	if err != nil {
+		log.Printf("could not pause %s, archiving it while it runs: %v", s.Container, err)
+		return func() {}
+	}
+	return func() {
+		if err := thaw(); err != nil {
+			log.Printf("resuming %s: %v", s.Container, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// usbMountpoint is where -device is mounted while an archive is written.
+const usbMountpoint = "/tmp/backup-usb"
+
+// mountDevice mounts device at usbMountpoint, trying the file systems USB
+// sticks usually come with, and returns a function that unmounts it again.
+func mountDevice(device string) (unmount func(), err error) {
+	if err := os.MkdirAll(usbMountpoint, 0755); err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, fstype := range []string{"ext4", "vfat", "exfat"} {
+		err := unix.Mount(device, usbMountpoint, fstype, unix.MS_NOATIME|unix.MS_NODEV|unix.MS_NOSUID, "")
+		if err == nil {
+			return func() {
+				unix.Sync()
+				if err := unix.Unmount(usbMountpoint, 0); err != nil {
+					log.Printf("unmounting %s: %v", device, err)
+				}
+			}, nil
+		}
+		errs = append(errs, fstype+": "+err.Error())
+	}
+	return nil, fmt.Errorf("mounting %s: %s", device, strings.Join(errs, ", "))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// AD types of the advertising data, from the Bluetooth Assigned Numbers.
+const (
+	adShortName        = 0x08
+	adCompleteName     = 0x09
+	adServiceData16    = 0x16
+	adManufacturerData = 0xff
+)
+
+// advertisement is a decoded LE advertising report.
+type advertisement struct {
+	// addr is the advertiser address in the usual notation.
+	addr string
+	rssi int
+	name string
+	// serviceData maps 16 bit service UUIDs to their data.
+	serviceData map[uint16][]byte
+	// manufacturerData maps company IDs to their data.
+	manufacturerData map[uint16][]byte
+}
+
+// parseAdvertisingData splits data into its AD structures. Malformed trailing
+// structures are ignored, as some devices pad their advertisements.
+func parseAdvertisingData(adv *advertisement, data []byte) {
+	for len(data) > 1 {
+		n := int(data[0])
+		if n == 0 || n >= len(data) {
+			return
+		}
+		typ, payload := data[1], data[2:n+1]
+		data = data[n+1:]
+		switch typ {
+		case adShortName, adCompleteName:
+			adv.name = string(payload)
+		case adServiceData16:
+			if len(payload) < 2 {
+				continue
+			}
+			if adv.serviceData == nil {
+				adv.serviceData = make(map[uint16][]byte)
+			}
+			adv.serviceData[binary.LittleEndian.Uint16(payload)] = payload[2:]
+		case adManufacturerData:
+			if len(payload) < 2 {
+				continue
+			}
+			if adv.manufacturerData == nil {
+				adv.manufacturerData = make(map[uint16][]byte)
+			}
+			adv.manufacturerData[binary.LittleEndian.Uint16(payload)] = payload[2:]
+		}
+	}
+}
+
+// reading is one measurement of a device, e.g. its temperature.
+type reading struct {
+	// key identifies the reading within its device and becomes part of
+	// the entity ID, e.g. temperature.
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+	// binary readings are announced as binary_sensor with value "ON" or
+	// "OFF".
+	binary bool
+	// text readings, like a charger state, have no state class.
+	text bool
+	// total readings, like energy meters, only grow except for resets.
+	total bool
+	value string
+}
+
+// numeric returns a reading of v rounded to decimals places.
+func numeric(key, name, deviceClass, unit string, v float64, decimals int) reading {
+	return reading{
+		key:         key,
+		name:        name,
+		deviceClass: deviceClass,
+		unit:        unit,
+		value:       strconv.FormatFloat(v, 'f', decimals, 64),
+	}
+}
+
+func boolean(key, name, deviceClass string, on bool) reading {
+	value := "OFF"
+	if on {
+		value = "ON"
+	}
+	return reading{key: key, name: name, deviceClass: deviceClass, binary: true, value: value}
+}
+
+func text(key, name, value string) reading {
+	return reading{key: key, name: name, text: true, value: value}
+}
+
+// decoded is what a decoder made of an advertisement.
+type decoded struct {
+	// id identifies the device. It is the address, except for beacons
+	// whose address changes.
+	id string
+	// format names the decoder, e.g. bthome.
+	format   string
+	readings []reading
+}
+
+// decode runs the decoders on adv. keys holds the Victron encryption keys
+// by address.
+func decode(adv *advertisement, keys map[string][]byte) (*decoded, error) {
+	if data, ok := adv.serviceData[bthomeUUID]; ok {
+		readings, err := decodeBTHome(data)
+		if err != nil {
+			return nil, fmt.Errorf("bthome: %v", err)
+		}
+		return &decoded{id: adv.addr, format: "bthome", readings: readings}, nil
+	}
+	if data, ok := adv.serviceData[environmentalSensingUUID]; ok {
+		readings, err := decodeATC(data)
+		if err != nil {
+			return nil, fmt.Errorf("atc: %v", err)
+		}
+		return &decoded{id: adv.addr, format: "atc", readings: readings}, nil
+	}
+	if data, ok := adv.manufacturerData[victronCompanyID]; ok {
+		key, ok := keys[adv.addr]
+		if !ok {
+			return nil, nil
+		}
+		readings, err := decodeVictron(data, key)
+		if err != nil {
+			return nil, fmt.Errorf("victron: %v", err)
+		}
+		if readings == nil {
+			return nil, nil
+		}
+		return &decoded{id: adv.addr, format: "victron", readings: readings}, nil
+	}
+	if data, ok := adv.manufacturerData[appleCompanyID]; ok {
+		b, ok := decodeIBeacon(data)
+		if !ok {
+			return nil, nil
+		}
+		return &decoded{id: b.id(), format: "ibeacon", readings: b.readings(adv.rssi)}, nil
+	}
+	return nil, nil
+}
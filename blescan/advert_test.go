@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unhex decodes s, which may contain spaces between bytes.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// values returns readings as key=value for comparison.
+func values(readings []reading) []string {
+	var v []string
+	for _, r := range readings {
+		v = append(v, r.key+"="+r.value)
+	}
+	return v
+}
+
+func TestDecode(t *testing.T) {
+	keys := map[string][]byte{"C0:FF:EE:12:34:56": unhex(t, "aff4d0995b7d1e176c0c33ecb9e70dcd")}
+	for _, tc := range []struct {
+		name string
+		addr string
+		// data is the advertising data as received.
+		data       string
+		wantID     string
+		wantFormat string
+		want       []string
+	}{
+		{
+			name:       "bthome",
+			addr:       "A4:C1:38:00:00:01",
+			data:       "02 01 06 0c 16 d2 fc 40 00 01 02 c4 09 03 bf 13",
+			wantID:     "A4:C1:38:00:00:01",
+			wantFormat: "bthome",
+			want:       []string{"temperature=25.00", "humidity=50.55"},
+		},
+		{
+			name:       "atc",
+			addr:       "A4:C1:38:AA:BB:CC",
+			data:       "02 01 06 10 16 1a 18 a4 c1 38 aa bb cc 00 e6 2d 5a 0b 8a 01",
+			wantID:     "A4:C1:38:AA:BB:CC",
+			wantFormat: "atc",
+			want:       []string{"temperature=23.0", "humidity=45", "battery=90", "battery_voltage=2.954"},
+		},
+		{
+			name:       "victron",
+			addr:       "C0:FF:EE:12:34:56",
+			data:       "1a ff e1 02 10 02 89 a3 02 b0 40 af 92 5d 09 a4 d8 9a a0 12 8b de f4 8c 62 98 a9 08 09 53 68 75 6e 74",
+			wantID:     "C0:FF:EE:12:34:56",
+			wantFormat: "victron",
+			want:       []string{"voltage=12.53", "current=0.000", "soc=50.0", "consumed=-50.0"},
+		},
+		{
+			name: "victron without key",
+			addr: "C0:FF:EE:65:43:21",
+			data: "1a ff e1 02 10 02 89 a3 02 b0 40 af 92 5d 09 a4 d8 9a a0 12 8b de f4 8c 62 98 a9",
+		},
+		{
+			name:       "ibeacon",
+			addr:       "4E:00:00:00:00:01",
+			data:       "02 01 06 1a ff 4c 00 02 15 fd a5 06 93 a4 e2 4f b1 af cf c6 eb 07 64 78 25 00 01 00 02 c5",
+			wantID:     "fda50693a4e24fb1afcfc6eb07647825-1-2",
+			wantFormat: "ibeacon",
+			want:       []string{"distance=1.0"},
+		},
+		{
+			name: "other apple advertisement",
+			addr: "4E:00:00:00:00:02",
+			data: "02 01 1a 0a ff 4c 00 10 05 01 18 f1 2b 6c",
+		},
+		{
+			name: "unknown",
+			addr: "00:11:22:33:44:55",
+			data: "02 01 06 05 09 4c 61 6d 70",
+		},
+		{
+			name: "malformed",
+			addr: "00:11:22:33:44:55",
+			data: "02 01 06 1f 16 d2 fc 40",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			adv := &advertisement{addr: tc.addr, rssi: -59}
+			parseAdvertisingData(adv, unhex(t, tc.data))
+			d, err := decode(adv, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantFormat == "" {
+				if d != nil {
+					t.Errorf("decode = %+v, want nothing", d)
+				}
+				return
+			}
+			if d == nil {
+				t.Fatalf("decode = nil, want %s", tc.wantFormat)
+			}
+			if d.id != tc.wantID || d.format != tc.wantFormat {
+				t.Errorf("decoded %s as %s, want %s as %s", d.id, d.format, tc.wantID, tc.wantFormat)
+			}
+			if got := values(d.readings); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readings = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
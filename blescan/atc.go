@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// environmentalSensingUUID is the service data UUID the ATC1441 and PVVX
+// custom firmwares for Xiaomi thermometers advertise with.
+const environmentalSensingUUID = 0x181a
+
+// decodeATC decodes the ATC1441 (13 bytes, big-endian) and PVVX (15 bytes,
+// little-endian) advertising formats. Both start with the device address.
+func decodeATC(data []byte) ([]reading, error) {
+	switch len(data) {
+	case 13:
+		temp := int16(binary.BigEndian.Uint16(data[6:]))
+		return []reading{
+			numeric("temperature", "Temperature", "temperature", "°C", float64(temp)/10, 1),
+			numeric("humidity", "Humidity", "humidity", "%", float64(data[8]), 0),
+			numeric("battery", "Battery", "battery", "%", float64(data[9]), 0),
+			numeric("battery_voltage", "Battery voltage", "voltage", "V", float64(binary.BigEndian.Uint16(data[10:]))/1000, 3),
+		}, nil
+
+	case 15:
+		temp := int16(binary.LittleEndian.Uint16(data[6:]))
+		return []reading{
+			numeric("temperature", "Temperature", "temperature", "°C", float64(temp)/100, 2),
+			numeric("humidity", "Humidity", "humidity", "%", float64(binary.LittleEndian.Uint16(data[8:]))/100, 2),
+			numeric("battery_voltage", "Battery voltage", "voltage", "V", float64(binary.LittleEndian.Uint16(data[10:]))/1000, 3),
+			numeric("battery", "Battery", "battery", "%", float64(data[12]), 0),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown format of %d bytes", len(data))
+	}
+}
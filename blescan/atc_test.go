@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeATC(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "atc1441",
+			data: "a4 c1 38 aa bb cc 00 e6 2d 5a 0b 8a 01",
+			want: []string{"temperature=23.0", "humidity=45", "battery=90", "battery_voltage=2.954"},
+		},
+		{
+			name: "atc1441 below freezing",
+			data: "a4 c1 38 aa bb cc ff 9c 50 64 0c 1c 02",
+			want: []string{"temperature=-10.0", "humidity=80", "battery=100", "battery_voltage=3.100"},
+		},
+		{
+			name: "pvvx",
+			data: "cc bb aa 38 c1 a4 fc 08 c6 11 8a 0b 5a 01 04",
+			want: []string{"temperature=23.00", "humidity=45.50", "battery_voltage=2.954", "battery=90"},
+		},
+		{
+			name: "pvvx below freezing",
+			data: "cc bb aa 38 c1 a4 18 fc 40 1f 1c 0c 64 02 04",
+			want: []string{"temperature=-10.00", "humidity=80.00", "battery_voltage=3.100", "battery=100"},
+		},
+		{name: "truncated", data: "a4 c1 38 aa bb cc 00 e6 2d 5a 0b 8a", wantErr: true},
+		{name: "empty", data: "", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			readings, err := decodeATC(unhex(t, tc.data))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeATC = %v, want error: %v", err, tc.wantErr)
+			}
+			if got := values(readings); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readings = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
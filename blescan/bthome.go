@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// bthomeUUID is the service data UUID of BTHome, see https://bthome.io.
+const bthomeUUID = 0xfcd2
+
+// bthomeObject describes a BTHome v2 object ID.
+type bthomeObject struct {
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+	// size of the value in bytes; values are little-endian.
+	size   int
+	signed bool
+	factor float64
+	// decimals is the precision implied by factor.
+	decimals int
+	binary   bool
+	total    bool
+}
+
+// bthomeObjects are the object IDs this decoder understands. A packet is
+// decoded up to the first unknown ID, as the size of its value is unknown.
+var bthomeObjects = map[byte]bthomeObject{
+	0x00: {key: "packet_id", size: 1},
+	0x01: {key: "battery", name: "Battery", deviceClass: "battery", unit: "%", size: 1, factor: 1},
+	0x02: {key: "temperature", name: "Temperature", deviceClass: "temperature", unit: "°C", size: 2, signed: true, factor: 0.01, decimals: 2},
+	0x03: {key: "humidity", name: "Humidity", deviceClass: "humidity", unit: "%", size: 2, factor: 0.01, decimals: 2},
+	0x04: {key: "pressure", name: "Pressure", deviceClass: "pressure", unit: "hPa", size: 3, factor: 0.01, decimals: 2},
+	0x05: {key: "illuminance", name: "Illuminance", deviceClass: "illuminance", unit: "lx", size: 3, factor: 0.01, decimals: 2},
+	0x06: {key: "mass", name: "Mass", deviceClass: "weight", unit: "kg", size: 2, factor: 0.01, decimals: 2},
+	0x08: {key: "dewpoint", name: "Dew point", deviceClass: "temperature", unit: "°C", size: 2, signed: true, factor: 0.01, decimals: 2},
+	0x09: {key: "count", name: "Count", size: 1, factor: 1},
+	0x0a: {key: "energy", name: "Energy", deviceClass: "energy", unit: "kWh", size: 3, factor: 0.001, decimals: 3, total: true},
+	0x0b: {key: "power", name: "Power", deviceClass: "power", unit: "W", size: 3, factor: 0.01, decimals: 2},
+	0x0c: {key: "voltage", name: "Voltage", deviceClass: "voltage", unit: "V", size: 2, factor: 0.001, decimals: 3},
+	0x0d: {key: "pm25", name: "PM2.5", deviceClass: "pm25", unit: "µg/m³", size: 2, factor: 1},
+	0x0e: {key: "pm10", name: "PM10", deviceClass: "pm10", unit: "µg/m³", size: 2, factor: 1},
+	0x0f: {key: "generic", name: "Generic", size: 1, binary: true},
+	0x10: {key: "power_on", name: "Power", deviceClass: "power", size: 1, binary: true},
+	0x11: {key: "opening", name: "Opening", deviceClass: "opening", size: 1, binary: true},
+	0x12: {key: "co2", name: "CO2", deviceClass: "carbon_dioxide", unit: "ppm", size: 2, factor: 1},
+	0x13: {key: "tvoc", name: "TVOC", deviceClass: "volatile_organic_compounds", unit: "µg/m³", size: 2, factor: 1},
+	0x14: {key: "moisture", name: "Moisture", deviceClass: "moisture", unit: "%", size: 2, factor: 0.01, decimals: 2},
+	0x15: {key: "battery_low", name: "Battery low", deviceClass: "battery", size: 1, binary: true},
+	0x16: {key: "battery_charging", name: "Battery charging", deviceClass: "battery_charging", size: 1, binary: true},
+	0x17: {key: "carbon_monoxide", name: "Carbon monoxide", deviceClass: "carbon_monoxide", size: 1, binary: true},
+	0x18: {key: "cold", name: "Cold", deviceClass: "cold", size: 1, binary: true},
+	0x19: {key: "connectivity", name: "Connectivity", deviceClass: "connectivity", size: 1, binary: true},
+	0x1a: {key: "door", name: "Door", deviceClass: "door", size: 1, binary: true},
+	0x1b: {key: "garage_door", name: "Garage door", deviceClass: "garage_door", size: 1, binary: true},
+	0x1c: {key: "gas", name: "Gas", deviceClass: "gas", size: 1, binary: true},
+	0x1d: {key: "heat", name: "Heat", deviceClass: "heat", size: 1, binary: true},
+	0x1e: {key: "light", name: "Light", deviceClass: "light", size: 1, binary: true},
+	0x1f: {key: "lock", name: "Lock", deviceClass: "lock", size: 1, binary: true},
+	0x20: {key: "moisture_detected", name: "Moisture", deviceClass: "moisture", size: 1, binary: true},
+	0x21: {key: "motion", name: "Motion", deviceClass: "motion", size: 1, binary: true},
+	0x22: {key: "moving", name: "Moving", deviceClass: "moving", size: 1, binary: true},
+	0x23: {key: "occupancy", name: "Occupancy", deviceClass: "occupancy", size: 1, binary: true},
+	0x24: {key: "plug", name: "Plug", deviceClass: "plug", size: 1, binary: true},
+	0x25: {key: "presence", name: "Presence", deviceClass: "presence", size: 1, binary: true},
+	0x26: {key: "problem", name: "Problem", deviceClass: "problem", size: 1, binary: true},
+	0x27: {key: "running", name: "Running", deviceClass: "running", size: 1, binary: true},
+	0x28: {key: "safety", name: "Safety", deviceClass: "safety", size: 1, binary: true},
+	0x29: {key: "smoke", name: "Smoke", deviceClass: "smoke", size: 1, binary: true},
+	0x2a: {key: "sound", name: "Sound", deviceClass: "sound", size: 1, binary: true},
+	0x2b: {key: "tamper", name: "Tamper", deviceClass: "tamper", size: 1, binary: true},
+	0x2c: {key: "vibration", name: "Vibration", deviceClass: "vibration", size: 1, binary: true},
+	0x2d: {key: "window", name: "Window", deviceClass: "window", size: 1, binary: true},
+	0x2e: {key: "humidity", name: "Humidity", deviceClass: "humidity", unit: "%", size: 1, factor: 1},
+	0x2f: {key: "moisture", name: "Moisture", deviceClass: "moisture", unit: "%", size: 1, factor: 1},
+	0x3f: {key: "rotation", name: "Rotation", unit: "°", size: 2, signed: true, factor: 0.1, decimals: 1},
+	0x40: {key: "distance", name: "Distance", deviceClass: "distance", unit: "mm", size: 2, factor: 1},
+	0x41: {key: "distance", name: "Distance", deviceClass: "distance", unit: "m", size: 2, factor: 0.1, decimals: 1},
+	0x42: {key: "duration", name: "Duration", deviceClass: "duration", unit: "s", size: 3, factor: 0.001, decimals: 3},
+	0x43: {key: "current", name: "Current", deviceClass: "current", unit: "A", size: 2, factor: 0.001, decimals: 3},
+	0x44: {key: "speed", name: "Speed", deviceClass: "speed", unit: "m/s", size: 2, factor: 0.01, decimals: 2},
+	0x45: {key: "temperature", name: "Temperature", deviceClass: "temperature", unit: "°C", size: 2, signed: true, factor: 0.1, decimals: 1},
+	0x46: {key: "uv_index", name: "UV index", size: 1, factor: 0.1, decimals: 1},
+	0x47: {key: "volume", name: "Volume", deviceClass: "volume", unit: "L", size: 2, factor: 0.1, decimals: 1},
+	0x48: {key: "volume", name: "Volume", deviceClass: "volume", unit: "mL", size: 2, factor: 1},
+	0x49: {key: "volume_flow_rate", name: "Volume flow rate", deviceClass: "volume_flow_rate", unit: "m³/h", size: 2, factor: 0.001, decimals: 3},
+	0x4a: {key: "voltage", name: "Voltage", deviceClass: "voltage", unit: "V", size: 2, factor: 0.1, decimals: 1},
+	0x4b: {key: "gas", name: "Gas", deviceClass: "gas", unit: "m³", size: 3, factor: 0.001, decimals: 3, total: true},
+	0x4c: {key: "gas", name: "Gas", deviceClass: "gas", unit: "m³", size: 4, factor: 0.001, decimals: 3, total: true},
+	0x4d: {key: "energy", name: "Energy", deviceClass: "energy", unit: "kWh", size: 4, factor: 0.001, decimals: 3, total: true},
+	0x4e: {key: "volume", name: "Volume", deviceClass: "volume", unit: "L", size: 4, factor: 0.001, decimals: 3, total: true},
+	0x4f: {key: "water", name: "Water", deviceClass: "water", unit: "L", size: 4, factor: 0.001, decimals: 3, total: true},
+	0x50: {key: "timestamp", size: 4},
+	0x51: {key: "acceleration", name: "Acceleration", unit: "m/s²", size: 2, factor: 0.001, decimals: 3},
+	0x52: {key: "gyroscope", name: "Gyroscope", unit: "°/s", size: 2, factor: 0.001, decimals: 3},
+}
+
+const (
+	bthomeEncrypted = 1 << 0
+	bthomeVersion2  = 2 << 5
+	bthomeVersion   = 7 << 5
+)
+
+// decodeBTHome decodes the service data of a BTHome v2 advertisement.
+// Encrypted advertisements are not supported.
+func decodeBTHome(data []byte) ([]reading, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty service data")
+	}
+	info := data[0]
+	if info&bthomeVersion != bthomeVersion2 {
+		return nil, fmt.Errorf("unsupported version %d", info>>5)
+	}
+	if info&bthomeEncrypted != 0 {
+		return nil, fmt.Errorf("encrypted advertisements are not supported")
+	}
+
+	var readings []reading
+	seen := make(map[string]int)
+	for data = data[1:]; len(data) > 0; {
+		id := data[0]
+		obj, ok := bthomeObjects[id]
+		if !ok {
+			if len(readings) == 0 {
+				return nil, fmt.Errorf("unknown object id %#02x", id)
+			}
+			break
+		}
+		if len(data) < 1+obj.size {
+			return nil, fmt.Errorf("object %#02x: short value", id)
+		}
+		raw := data[1 : 1+obj.size]
+		data = data[1+obj.size:]
+		if obj.name == "" {
+			// Packet ID and timestamp are not measurements.
+			continue
+		}
+
+		// Devices with several sensors of a kind repeat the object ID.
+		key, name := obj.key, obj.name
+		if n := seen[obj.key]; n > 0 {
+			key = fmt.Sprintf("%s_%d", obj.key, n+1)
+			name = fmt.Sprintf("%s %d", obj.name, n+1)
+		}
+		seen[obj.key]++
+
+		if obj.binary {
+			readings = append(readings, boolean(key, name, obj.deviceClass, raw[0] != 0))
+			continue
+		}
+		r := numeric(key, name, obj.deviceClass, obj.unit, float64(littleEndian(raw, obj.signed))*obj.factor, obj.decimals)
+		r.total = obj.total
+		readings = append(readings, r)
+	}
+	return readings, nil
+}
+
+// littleEndian returns the little-endian integer in b of up to 8 bytes.
+func littleEndian(b []byte, signed bool) int64 {
+	var buf [8]byte
+	copy(buf[:], b)
+	v := binary.LittleEndian.Uint64(buf[:])
+	if signed {
+		shift := 64 - 8*len(b)
+		return int64(v<<shift) >> shift
+	}
+	return int64(v)
+}
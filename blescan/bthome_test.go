@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeBTHome(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "temperature and humidity",
+			data: "40 00 01 02 c4 09 03 bf 13",
+			want: []string{"temperature=25.00", "humidity=50.55"},
+		},
+		{
+			name: "negative temperature",
+			data: "40 02 18 fc",
+			want: []string{"temperature=-10.00"},
+		},
+		{
+			name: "repeated object",
+			data: "40 02 c4 09 02 18 fc",
+			want: []string{"temperature=25.00", "temperature_2=-10.00"},
+		},
+		{
+			name: "binary",
+			data: "40 01 64 21 01 2d 00",
+			want: []string{"battery=100", "motion=ON", "window=OFF"},
+		},
+		{
+			name: "energy",
+			data: "44 0a 13 8a 14",
+			want: []string{"energy=1346.067"},
+		},
+		{
+			name: "unknown object after known ones",
+			data: "40 02 c4 09 fe 01 02",
+			want: []string{"temperature=25.00"},
+		},
+		{name: "unknown object", data: "40 fe 01 02", wantErr: true},
+		{name: "truncated value", data: "40 02 c4 09 03 bf", wantErr: true},
+		{name: "truncated pressure", data: "40 04 13 8a", wantErr: true},
+		{name: "encrypted", data: "41 a4 72 66 c9 5f 73", wantErr: true},
+		{name: "version 1", data: "20 02 c4 09", wantErr: true},
+		{name: "empty", data: "", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			readings, err := decodeBTHome(unhex(t, tc.data))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeBTHome = %v, want error: %v", err, tc.wantErr)
+			}
+			if got := values(readings); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readings = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBTHomeKinds(t *testing.T) {
+	readings, err := decodeBTHome(unhex(t, "44 0a 13 8a 14 21 01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 2 {
+		t.Fatalf("got %d readings, want 2", len(readings))
+	}
+	if energy := readings[0]; !energy.total || energy.binary || energy.unit != "kWh" {
+		t.Errorf("energy = %+v, want a total in kWh", energy)
+	}
+	if motion := readings[1]; !motion.binary || motion.deviceClass != "motion" {
+		t.Errorf("motion = %+v, want a binary motion reading", motion)
+	}
+}
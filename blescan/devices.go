@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/mqttComponent"
+)
+
+const (
+	// statusUpdateInterval is how often entity states are published, in
+	// seconds.
+	statusUpdateInterval = 30
+	// errorLogInterval limits how often decoding errors are logged per
+	// device.
+	errorLogInterval = time.Hour
+)
+
+// devicesConfig is read from the -devices file, e.g.
+//
+//	{
+//	  "devices": {
+//	    "C0:FF:EE:12:34:56": {"name": "SmartShunt", "key": "0df4d0395b7d1a876c0c33ecb9e70dcd"},
+//	    "A4:C1:38:AA:BB:CC": {"name": "Fridge"},
+//	    "fda50693a4e24fb1afcfc6eb07647825-1-2": {"name": "Keys"}
+//	  }
+//	}
+//
+// Devices are identified by address, except for iBeacons, which are
+// identified by UUID, major and minor.
+type devicesConfig struct {
+	// OnlyConfigured ignores devices that are not listed in Devices.
+	// iBeacons are always ignored unless they are listed.
+	OnlyConfigured bool                    `json:"only_configured"`
+	Devices        map[string]deviceConfig `json:"devices"`
+}
+
+type deviceConfig struct {
+	Name string `json:"name"`
+	// Key is the hex encoded instant readout encryption key of a Victron
+	// device.
+	Key string `json:"key"`
+}
+
+func loadDevicesConfig(path string) (devicesConfig, error) {
+	var cfg devicesConfig
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %v", path, err)
+	}
+	normalized := make(map[string]deviceConfig, len(cfg.Devices))
+	for id, dev := range cfg.Devices {
+		normalized[normalizeID(id)] = dev
+	}
+	cfg.Devices = normalized
+	return cfg, nil
+}
+
+// normalizeID returns addresses in upper and beacon IDs in lower case, as
+// they are reported.
+func normalizeID(id string) string {
+	if strings.Contains(id, ":") {
+		return strings.ToUpper(id)
+	}
+	return strings.ToLower(id)
+}
+
+// victronKeys returns the decoded keys of cfg by address.
+func (cfg devicesConfig) victronKeys() (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for id, dev := range cfg.Devices {
+		if dev.Key == "" {
+			continue
+		}
+		key, err := hex.DecodeString(dev.Key)
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("device %s: key has to be 32 hex digits", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// device is a sensor that was seen and announced to Home Assistant.
+type device struct {
+	id   string
+	name string
+	rssi int
+	// values holds the latest value of each reading by key.
+	values map[string]string
+}
+
+// registry tracks the devices and announces an entity for every reading the
+// first time it is seen.
+type registry struct {
+	mc   *mqttComponent.MqttController
+	cfg  devicesConfig
+	keys map[string][]byte
+
+	mu      sync.Mutex
+	devices map[string]*device
+	// lastError records when a decoding error was last logged, by address.
+	lastError map[string]time.Time
+}
+
+func newRegistry(mc *mqttComponent.MqttController, cfg devicesConfig) (*registry, error) {
+	keys, err := cfg.victronKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &registry{
+		mc:        mc,
+		cfg:       cfg,
+		keys:      keys,
+		devices:   make(map[string]*device),
+		lastError: make(map[string]time.Time),
+	}, nil
+}
+
+func (reg *registry) handle(adv *advertisement) {
+	d, err := decode(adv, reg.keys)
+	if err != nil {
+		reg.logError(adv.addr, err)
+		return
+	}
+	if d == nil || len(d.readings) == 0 {
+		return
+	}
+	conf, configured := reg.cfg.Devices[d.id]
+	if !configured && (reg.cfg.OnlyConfigured || d.format == "ibeacon") {
+		return
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[d.id]
+	if !ok {
+		name := conf.Name
+		if name == "" {
+			name = adv.name
+		}
+		if name == "" {
+			name = fmt.Sprintf("%s %s", d.format, d.id)
+		}
+		dev = &device{id: d.id, name: name, values: make(map[string]string)}
+		reg.devices[d.id] = dev
+		log.Printf("found %s device %s (%s)", d.format, d.id, name)
+		reg.announceRSSI(dev)
+	}
+	dev.rssi = adv.rssi
+	for _, r := range d.readings {
+		if _, ok := dev.values[r.key]; !ok {
+			reg.announce(dev, r)
+		}
+		dev.values[r.key] = r.value
+	}
+}
+
+func (reg *registry) logError(addr string, err error) {
+	reg.mu.Lock()
+	last, ok := reg.lastError[addr]
+	if ok && time.Since(last) < errorLogInterval {
+		reg.mu.Unlock()
+		return
+	}
+	reg.lastError[addr] = time.Now()
+	reg.mu.Unlock()
+	log.Printf("decoding advertisement of %s: %v", addr, err)
+}
+
+// entityID returns a unique ID for a reading of dev.
+func entityID(dev *device, key string) string {
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r - 'A' + 'a'
+		}
+		return -1
+	}, dev.id)
+	return "ble_" + id + "_" + key
+}
+
+// announce adds an entity for reading r of dev. reg.mu is held.
+func (reg *registry) announce(dev *device, r reading) {
+	e := mqttComponent.Entity{
+		Name:           dev.name + " " + r.name,
+		ID:             entityID(dev, r.key),
+		DeviceClass:    r.deviceClass,
+		Unit:           r.unit,
+		UpdateInterval: statusUpdateInterval,
+		State:          reg.value(dev, r.key),
+	}
+	switch {
+	case r.binary:
+		reg.mc.AddDevice(e.BinarySensor())
+		return
+	case r.total:
+		e.StateClass = "total_increasing"
+	case !r.text:
+		e.StateClass = "measurement"
+	}
+	reg.mc.AddDevice(e.Sensor())
+}
+
+func (reg *registry) announceRSSI(dev *device) {
+	reg.mc.AddDevice(mqttComponent.Entity{
+		Name:           dev.name + " signal",
+		ID:             entityID(dev, "rssi"),
+		DeviceClass:    "signal_strength",
+		Unit:           "dBm",
+		StateClass:     "measurement",
+		UpdateInterval: statusUpdateInterval,
+		State: func() string {
+			reg.mu.Lock()
+			defer reg.mu.Unlock()
+			return strconv.Itoa(dev.rssi)
+		},
+	}.Sensor())
+}
+
+func (reg *registry) value(dev *device, key string) func() string {
+	return func() string {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return dev.values[key]
+	}
+}
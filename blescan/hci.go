@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// hciDevUp is HCIDEVUP, _IOW('H', 201, int).
+	hciDevUp = 0x400448c9
+
+	// Socket option of the HCI socket filter, from hci_sock.h.
+	solHCI    = 0
+	hciFilter = 2
+
+	hciCommandPkt = 0x01
+	hciEventPkt   = 0x04
+
+	evtCmdComplete = 0x0e
+	evtCmdStatus   = 0x0f
+	evtLEMeta      = 0x3e
+
+	leAdvertisingReport = 0x02
+
+	// LE controller commands, OGF 0x08.
+	opLESetScanParameters = 0x08<<10 | 0x000b
+	opLESetScanEnable     = 0x08<<10 | 0x000c
+
+	commandTimeout = 2 * time.Second
+)
+
+// hciScanner is a raw HCI socket bound to one adapter.
+type hciScanner struct {
+	fd  int
+	dev int
+}
+
+// openScanner brings up adapter dev and opens a raw socket that receives
+// command results and LE meta events.
+func openScanner(dev int) (*hciScanner, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("opening HCI socket: %v", err)
+	}
+	s := &hciScanner{fd: fd, dev: dev}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), hciDevUp, uintptr(dev)); errno != 0 && errno != unix.EALREADY {
+		s.Close()
+		return nil, fmt.Errorf("bringing up hci%d: %v", dev, errno)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrHCI{Dev: uint16(dev), Channel: unix.HCI_CHANNEL_RAW}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("binding to hci%d: %v", dev, err)
+	}
+
+	// struct hci_filter: type mask, event mask, opcode.
+	var filter [14]byte
+	binary.LittleEndian.PutUint32(filter[0:], 1<<hciEventPkt)
+	binary.LittleEndian.PutUint32(filter[4:], 1<<evtCmdComplete|1<<evtCmdStatus)
+	binary.LittleEndian.PutUint32(filter[8:], 1<<(evtLEMeta-32))
+	if err := unix.SetsockoptString(fd, solHCI, hciFilter, string(filter[:])); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("setting HCI filter: %v", err)
+	}
+	// Reads time out so that the scan loop can notice a stalled scan.
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *hciScanner) Close() error {
+	return unix.Close(s.fd)
+}
+
+// startPassiveScan (re)starts a passive scan that reports every
+// advertisement, not only the first one of each device.
+func (s *hciScanner) startPassiveScan() error {
+	// Scan parameters cannot be changed while a scan runs, e.g. one that
+	// was left running by a previous instance. Disabling an idle scan
+	// fails, which does not matter.
+	s.command(opLESetScanEnable, []byte{0x00, 0x00})
+
+	params := make([]byte, 7)
+	params[0] = 0x00                                // passive
+	binary.LittleEndian.PutUint16(params[1:], 0x60) // interval, 60 ms
+	binary.LittleEndian.PutUint16(params[3:], 0x60) // window, 60 ms
+	params[5] = 0x00                                // public own address
+	params[6] = 0x00                                // accept all advertisements
+	if err := s.command(opLESetScanParameters, params); err != nil {
+		return fmt.Errorf("setting scan parameters: %v", err)
+	}
+	if err := s.command(opLESetScanEnable, []byte{0x01, 0x00}); err != nil {
+		return fmt.Errorf("enabling scan: %v", err)
+	}
+	return nil
+}
+
+func (s *hciScanner) stopScan() error {
+	return s.command(opLESetScanEnable, []byte{0x00, 0x00})
+}
+
+// command sends an HCI command and waits for its completion.
+func (s *hciScanner) command(opcode uint16, params []byte) error {
+	pkt := []byte{hciCommandPkt, byte(opcode), byte(opcode >> 8), byte(len(params))}
+	if _, err := unix.Write(s.fd, append(pkt, params...)); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(commandTimeout)
+	buf := make([]byte, 260)
+	for time.Now().Before(deadline) {
+		n, err := unix.Read(s.fd, buf)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		evt := buf[:n]
+		if len(evt) < 3 || evt[0] != hciEventPkt {
+			continue
+		}
+		switch evt[1] {
+		case evtCmdComplete:
+			// num packets, opcode, status
+			if len(evt) >= 7 && binary.LittleEndian.Uint16(evt[4:]) == opcode {
+				return hciStatus(evt[6])
+			}
+		case evtCmdStatus:
+			// status, num packets, opcode
+			if len(evt) >= 7 && binary.LittleEndian.Uint16(evt[5:]) == opcode {
+				return hciStatus(evt[3])
+			}
+		}
+	}
+	return fmt.Errorf("command %#04x timed out", opcode)
+}
+
+func hciStatus(status byte) error {
+	if status == 0 {
+		return nil
+	}
+	return fmt.Errorf("HCI status %#02x", status)
+}
+
+// errTimeout is returned by read if no event arrived within a second.
+var errTimeout = errors.New("timeout")
+
+// read returns the advertising reports of the next LE meta event.
+func (s *hciScanner) read(buf []byte) ([]*advertisement, error) {
+	n, err := unix.Read(s.fd, buf)
+	if errors.Is(err, unix.EAGAIN) {
+		return nil, errTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	evt := buf[:n]
+	if len(evt) < 5 || evt[0] != hciEventPkt || evt[1] != evtLEMeta || evt[3] != leAdvertisingReport {
+		return nil, nil
+	}
+	return parseAdvertisingReport(evt[4:]), nil
+}
+
+// parseAdvertisingReport parses the reports of an LE Advertising Report
+// event, starting at Num_Reports. Like BlueZ, it reads the reports one
+// after another.
+func parseAdvertisingReport(b []byte) []*advertisement {
+	if len(b) < 1 {
+		return nil
+	}
+	num := int(b[0])
+	b = b[1:]
+	var advs []*advertisement
+	for i := 0; i < num; i++ {
+		// event type, address type, address, data length
+		if len(b) < 9 {
+			break
+		}
+		addr := b[2:8]
+		dataLen := int(b[8])
+		if len(b) < 9+dataLen+1 {
+			break
+		}
+		adv := &advertisement{
+			addr: fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", addr[5], addr[4], addr[3], addr[2], addr[1], addr[0]),
+			rssi: int(int8(b[9+dataLen])),
+		}
+		// Copy the data, buf is reused for the next event.
+		parseAdvertisingData(adv, append([]byte(nil), b[9:9+dataLen]...))
+		advs = append(advs, adv)
+		b = b[9+dataLen+1:]
+	}
+	return advs
+}
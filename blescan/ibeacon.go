@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+// appleCompanyID is the company ID of iBeacon manufacturer data.
+const appleCompanyID = 0x004c
+
+// iBeacon is the payload of an iBeacon advertisement.
+type iBeacon struct {
+	uuid         [16]byte
+	major, minor uint16
+	// txPower is the calibrated RSSI at 1 m.
+	txPower int8
+}
+
+func decodeIBeacon(data []byte) (*iBeacon, bool) {
+	if len(data) != 23 || data[0] != 0x02 || data[1] != 0x15 {
+		return nil, false
+	}
+	b := &iBeacon{
+		major:   binary.BigEndian.Uint16(data[18:]),
+		minor:   binary.BigEndian.Uint16(data[20:]),
+		txPower: int8(data[22]),
+	}
+	copy(b.uuid[:], data[2:18])
+	return b, true
+}
+
+// id identifies a beacon by UUID, major and minor, as beacons like phones
+// change their address.
+func (b *iBeacon) id() string {
+	return fmt.Sprintf("%s-%d-%d", hex.EncodeToString(b.uuid[:]), b.major, b.minor)
+}
+
+// readings estimates the distance to the beacon from rssi with a path loss
+// exponent of 2, which is rough but enough for presence detection.
+func (b *iBeacon) readings(rssi int) []reading {
+	distance := math.Pow(10, float64(int(b.txPower)-rssi)/20)
+	return []reading{
+		numeric("distance", "Distance", "distance", "m", distance, 1),
+	}
+}
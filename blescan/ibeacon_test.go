@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeIBeacon(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   string
+		rssi   int
+		wantID string
+		want   []string
+	}{
+		{
+			name:   "at 1 m",
+			data:   "02 15 fd a5 06 93 a4 e2 4f b1 af cf c6 eb 07 64 78 25 00 01 00 02 c5",
+			rssi:   -59,
+			wantID: "fda50693a4e24fb1afcfc6eb07647825-1-2",
+			want:   []string{"distance=1.0"},
+		},
+		{
+			name:   "at 10 m",
+			data:   "02 15 fd a5 06 93 a4 e2 4f b1 af cf c6 eb 07 64 78 25 01 00 ff ff c5",
+			rssi:   -79,
+			wantID: "fda50693a4e24fb1afcfc6eb07647825-256-65535",
+			want:   []string{"distance=10.0"},
+		},
+		{name: "truncated", data: "02 15 fd a5 06 93 a4 e2 4f b1 af cf c6 eb 07 64 78 25 00 01 00 02"},
+		{name: "nearby info", data: "10 05 01 18 f1 2b 6c"},
+		{name: "empty", data: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, ok := decodeIBeacon(unhex(t, tc.data))
+			if ok != (tc.wantID != "") {
+				t.Fatalf("decodeIBeacon = %v, want %v", ok, tc.wantID != "")
+			}
+			if !ok {
+				return
+			}
+			if got := b.id(); got != tc.wantID {
+				t.Errorf("id = %s, want %s", got, tc.wantID)
+			}
+			if got := values(b.readings(tc.rssi)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readings = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
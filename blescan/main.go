@@ -0,0 +1,183 @@
+// blescan passively scans for Bluetooth LE advertisements and publishes the
+// readings of the sensors it understands to Home Assistant:
+//
+//   - BTHome v2, unencrypted
+//   - Xiaomi thermometers with the ATC1441 or PVVX firmware
+//   - iBeacons, as distance estimate
+//   - Victron instant readout of solar chargers, battery monitors and DC-DC
+//     converters, with the device's key
+//
+// It talks to the adapter over a raw HCI socket and does not need bluetoothd,
+// so it replaces the bluetooth container for reading sensors. Devices are
+// configured in /perm/blescan/devices.json, see devicesConfig.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/containerComponent"
+	"github.com/alf632/gokrazy-ha/kmodComponent"
+	"github.com/alf632/gokrazy-ha/mqttComponent"
+	"github.com/plus3it/gorecurcopy"
+)
+
+const (
+	// adapterTimeout is how long to wait for the adapter to be registered
+	// after the modules are loaded.
+	adapterTimeout = 30 * time.Second
+	// stallTimeout restarts the scan if no advertisement arrived for that
+	// long, e.g. because another program stopped it.
+	stallTimeout = time.Minute
+	retryDelay   = 5 * time.Second
+)
+
+func main() {
+	configFile := flag.String("config", "/perm/blescan/config.json", "path to config file")
+	secretsFile := flag.String("secrets", "/perm/blescan/secrets.json", "path to secrets file")
+	devicesFile := flag.String("devices", "/perm/blescan/devices.json", "path to the device names and keys")
+	device := flag.String("device", "hci0", "HCI device to scan with")
+	broker := flag.String("broker", "localhost:1883", "TCP address of the MQTT broker to wait for before connecting, empty to not wait")
+	flag.Parse()
+
+	if _, err := os.Stat("/perm/blescan/"); os.IsNotExist(err) {
+		if err := gorecurcopy.CopyDirectory("/opt/blescan/", "/perm/blescan/"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	dev, err := strconv.Atoi(strings.TrimPrefix(*device, "hci"))
+	if err != nil {
+		log.Fatalf("invalid -device %q", *device)
+	}
+	devices, err := loadDevicesConfig(*devicesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadModules(); err != nil {
+		log.Fatal(err)
+	}
+	if err := waitForAdapter(*device); err != nil {
+		log.Fatal(err)
+	}
+
+	if *broker != "" {
+		if err := containerComponent.WaitFor(containerComponent.Dependency{TCP: *broker}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mqttc := mqttComponent.NewMqttController(mqttComponent.MQTTConfig{
+		ConfigFile:  configFile,
+		SecretsFile: secretsFile,
+	})
+	defer mqttc.Stop()
+
+	reg, err := newRegistry(mqttc, devices)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			err := scan(dev, reg, stop)
+			if err == nil {
+				return
+			}
+			log.Print(err)
+			time.Sleep(retryDelay)
+		}
+	}()
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+	log.Println("Exiting with signal", (<-done).String())
+	close(stop)
+	<-stopped
+}
+
+// scan reports advertisements to reg until stop is closed.
+func scan(dev int, reg *registry, stop <-chan struct{}) error {
+	s, err := openScanner(dev)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.startPassiveScan(); err != nil {
+		return err
+	}
+	log.Printf("scanning on hci%d", dev)
+
+	buf := make([]byte, 260)
+	lastReport := time.Now()
+	for {
+		select {
+		case <-stop:
+			return s.stopScan()
+		default:
+		}
+		advs, err := s.read(buf)
+		if errors.Is(err, errTimeout) {
+			if time.Since(lastReport) > stallTimeout {
+				log.Printf("no advertisements for %v, restarting the scan", stallTimeout)
+				if err := s.startPassiveScan(); err != nil {
+					return err
+				}
+				lastReport = time.Now()
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading from hci%d: %v", dev, err)
+		}
+		if len(advs) > 0 {
+			lastReport = time.Now()
+		}
+		for _, adv := range advs {
+			reg.handle(adv)
+		}
+	}
+}
+
+// waitForAdapter waits for the kernel to register device, which happens
+// asynchronously for UART adapters.
+func waitForAdapter(device string) error {
+	path := filepath.Join("/sys/class/bluetooth", device)
+	for start := time.Now(); ; time.Sleep(time.Second) {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if time.Since(start) > adapterTimeout {
+			return fmt.Errorf("Bluetooth adapter %s not found after %v", device, adapterTimeout)
+		}
+	}
+}
+
+// loadModules loads hci_uart for the built-in adapter of the Raspberry Pi
+// and the drivers of Bluetooth USB dongles that are plugged in.
+func loadModules() error {
+	l, err := kmodComponent.New()
+	if err != nil {
+		return err
+	}
+	if err := l.Load("hci_uart"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, err := l.LoadDevices("kernel/drivers/bluetooth"); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
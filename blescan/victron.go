@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+)
+
+// victronCompanyID is the company ID of Victron's instant readout
+// manufacturer data.
+const victronCompanyID = 0x02e1
+
+// Record types of the instant readout.
+const (
+	victronSolarCharger   = 0x01
+	victronBatteryMonitor = 0x02
+	victronDCDC           = 0x04
+)
+
+// victronChargeStates are the VE.Direct device states.
+var victronChargeStates = map[uint64]string{
+	0:   "off",
+	1:   "low power",
+	2:   "fault",
+	3:   "bulk",
+	4:   "absorption",
+	5:   "float",
+	6:   "storage",
+	7:   "equalize",
+	9:   "inverting",
+	11:  "power supply",
+	245: "starting up",
+	246: "repeated absorption",
+	247: "auto equalize",
+	248: "battery safe",
+	252: "external control",
+}
+
+// decodeVictron decrypts and decodes instant readout data with the device's
+// encryption key, as shown in VictronConnect under Product info. Record types
+// other than solar chargers, battery monitors and DC-DC converters are
+// ignored.
+func decodeVictron(data, key []byte) ([]reading, error) {
+	if len(data) < 9 || data[0] != 0x10 {
+		return nil, nil
+	}
+	recordType := data[4]
+	iv := binary.LittleEndian.Uint16(data[5:])
+	if data[7] != key[0] {
+		return nil, fmt.Errorf("advertisement is encrypted with a different key")
+	}
+	plain, err := victronDecrypt(key, iv, data[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &bitReader{b: plain}
+	switch recordType {
+	case victronBatteryMonitor:
+		return decodeBatteryMonitor(r), nil
+	case victronSolarCharger:
+		return decodeSolarCharger(r), nil
+	case victronDCDC:
+		return decodeDCDC(r), nil
+	}
+	return nil, nil
+}
+
+// victronDecrypt decrypts data with AES-CTR. The counter starts at iv and
+// is little-endian, unlike the one of crypto/cipher.
+func victronDecrypt(key []byte, iv uint16, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	var ctr, stream [aes.BlockSize]byte
+	binary.LittleEndian.PutUint16(ctr[:], iv)
+	for i := range data {
+		if i%aes.BlockSize == 0 {
+			block.Encrypt(stream[:], ctr[:])
+			// Increment the 128 bit little-endian counter.
+			for j := range ctr {
+				ctr[j]++
+				if ctr[j] != 0 {
+					break
+				}
+			}
+		}
+		plain[i] = data[i] ^ stream[i%aes.BlockSize]
+	}
+	return plain, nil
+}
+
+func decodeBatteryMonitor(r *bitReader) []reading {
+	remaining := r.unsigned(16)
+	voltage := r.signed(16)
+	r.unsigned(16) // alarm
+	aux := r.unsigned(16)
+	auxMode := r.unsigned(2)
+	current := r.signed(22)
+	consumed := r.unsigned(20)
+	soc := r.unsigned(10)
+	if r.short {
+		return nil
+	}
+
+	var readings []reading
+	if voltage != 0x7fff {
+		readings = append(readings, numeric("voltage", "Voltage", "voltage", "V", float64(voltage)/100, 2))
+	}
+	if current != 0x1fffff {
+		readings = append(readings, numeric("current", "Current", "current", "A", float64(current)/1000, 3))
+	}
+	if soc != 0x3ff {
+		readings = append(readings, numeric("soc", "State of charge", "battery", "%", float64(soc)/10, 1))
+	}
+	if consumed != 0xfffff {
+		readings = append(readings, numeric("consumed", "Consumed", "", "Ah", -float64(consumed)/10, 1))
+	}
+	if remaining != 0xffff {
+		readings = append(readings, numeric("remaining", "Time remaining", "duration", "min", float64(remaining), 0))
+	}
+	switch auxMode {
+	case 0:
+		if v := int16(aux); v != 0x7fff {
+			readings = append(readings, numeric("starter_voltage", "Starter voltage", "voltage", "V", float64(v)/100, 2))
+		}
+	case 1:
+		if aux != 0xffff {
+			readings = append(readings, numeric("midpoint_voltage", "Midpoint voltage", "voltage", "V", float64(aux)/100, 2))
+		}
+	case 2:
+		if aux != 0xffff {
+			readings = append(readings, numeric("temperature", "Temperature", "temperature", "°C", float64(aux)/100-273.15, 2))
+		}
+	}
+	return readings
+}
+
+func decodeSolarCharger(r *bitReader) []reading {
+	state := r.unsigned(8)
+	r.unsigned(8) // charger error
+	voltage := r.signed(16)
+	current := r.signed(16)
+	yield := r.unsigned(16)
+	power := r.unsigned(16)
+	load := r.unsigned(9)
+	if r.short {
+		return nil
+	}
+
+	readings := []reading{chargeState(state)}
+	if voltage != 0x7fff {
+		readings = append(readings, numeric("battery_voltage", "Battery voltage", "voltage", "V", float64(voltage)/100, 2))
+	}
+	if current != 0x7fff {
+		readings = append(readings, numeric("battery_current", "Battery current", "current", "A", float64(current)/10, 1))
+	}
+	if yield != 0xffff {
+		r := numeric("yield_today", "Yield today", "energy", "kWh", float64(yield)/100, 2)
+		r.total = true
+		readings = append(readings, r)
+	}
+	if power != 0xffff {
+		readings = append(readings, numeric("solar_power", "Solar power", "power", "W", float64(power), 0))
+	}
+	if load != 0x1ff {
+		readings = append(readings, numeric("load_current", "Load current", "current", "A", float64(load)/10, 1))
+	}
+	return readings
+}
+
+func decodeDCDC(r *bitReader) []reading {
+	state := r.unsigned(8)
+	r.unsigned(8) // charger error
+	input := r.unsigned(16)
+	output := r.signed(16)
+	if r.short {
+		return nil
+	}
+
+	readings := []reading{chargeState(state)}
+	if input != 0xffff {
+		readings = append(readings, numeric("input_voltage", "Input voltage", "voltage", "V", float64(input)/100, 2))
+	}
+	if output != 0x7fff {
+		readings = append(readings, numeric("output_voltage", "Output voltage", "voltage", "V", float64(output)/100, 2))
+	}
+	return readings
+}
+
+func chargeState(state uint64) reading {
+	name, ok := victronChargeStates[state]
+	if !ok {
+		name = fmt.Sprintf("unknown (%d)", state)
+	}
+	return text("charge_state", "Charge state", name)
+}
+
+// bitReader reads the bit fields of instant readout records, which are
+// packed least significant bit first.
+type bitReader struct {
+	b   []byte
+	pos int
+	// short is set once a read went past the end of b.
+	short bool
+}
+
+func (r *bitReader) unsigned(bits int) uint64 {
+	var v uint64
+	for i := 0; i < bits; i++ {
+		byteIdx := r.pos / 8
+		if byteIdx >= len(r.b) {
+			r.short = true
+			return 0
+		}
+		bit := (r.b[byteIdx] >> (r.pos % 8)) & 1
+		v |= uint64(bit) << i
+		r.pos++
+	}
+	return v
+}
+
+// signed reads a two's complement field. The "not available" markers of
+// signed fields are the maximum positive value, so callers compare against
+// that.
+func (r *bitReader) signed(bits int) int64 {
+	v := r.unsigned(bits)
+	shift := 64 - bits
+	return int64(v<<shift) >> shift
+}
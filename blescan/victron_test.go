@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeVictron(t *testing.T) {
+	const (
+		shuntKey   = "aff4d0995b7d1e176c0c33ecb9e70dcd"
+		shunt      = "10 02 89 a3 02 b0 40 af 92 5d 09 a4 d8 9a a0 12 8b de f4 8c 62 98 a9"
+		chargerKey = "adeccb947395801a4dd45a2eaa44bf17"
+		charger    = "10 02 42 a0 01 62 07 ad ce b3 7b 60 5d 7e 0e e2 1b 24 df 5c"
+	)
+	for _, tc := range []struct {
+		name    string
+		data    string
+		key     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "battery monitor",
+			data: shunt,
+			key:  shuntKey,
+			want: []string{"voltage=12.53", "current=0.000", "soc=50.0", "consumed=-50.0"},
+		},
+		{
+			name: "solar charger",
+			data: charger,
+			key:  chargerKey,
+			want: []string{"charge_state=absorption", "battery_voltage=13.88", "battery_current=1.4", "yield_today=0.03", "solar_power=19", "load_current=0.0"},
+		},
+		// The record is too short for its fields.
+		{name: "truncated", data: shunt[:36], key: shuntKey},
+		{name: "unknown record type", data: "10 02 89 a3 09 b0 40 af 92 5d 09 a4 d8 9a a0 12", key: shuntKey},
+		{name: "not instant readout", data: "03 02 89 a3 02 b0 40 af 92", key: shuntKey},
+		{name: "too short", data: "10 02 89 a3 02 b0 40 af", key: shuntKey},
+		{name: "other key", data: shunt, key: chargerKey, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			readings, err := decodeVictron(unhex(t, tc.data), unhex(t, tc.key))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeVictron = %v, want error: %v", err, tc.wantErr)
+			}
+			if got := values(readings); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readings = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBitReader(t *testing.T) {
+	r := &bitReader{b: []byte{0xb4, 0xff, 0x01}}
+	if got := r.unsigned(2); got != 0 {
+		t.Errorf("unsigned(2) = %d, want 0", got)
+	}
+	if got := r.unsigned(4); got != 0xd {
+		t.Errorf("unsigned(4) = %#x, want 0xd", got)
+	}
+	// 10 bits spanning the first two bytes, all but the lowest set.
+	if got := r.signed(10); got != -2 {
+		t.Errorf("signed(10) = %d, want -2", got)
+	}
+	if got := r.unsigned(8); got != 0x1 || r.short {
+		t.Errorf("unsigned(8) = %#x, short %v, want 0x1, not short", got, r.short)
+	}
+	r.unsigned(1)
+	if !r.short {
+		t.Errorf("reading past the end did not set short")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	adapterConfigFile = "/perm/bluetooth/adapter.json"
+
+	// monitorInterval is how often a working adapter is checked.
+	monitorInterval = 10 * time.Second
+	minRetry        = 2 * time.Second
+	maxRetry        = time.Minute
+	// serdevSettle is how long to wait for the kernel to register an
+	// adapter described by the device tree before attaching UART.
+	serdevSettle = 5 * time.Second
+)
+
+// adapterConfig is read from /perm/bluetooth/adapter.json. All fields are
+// optional; the defaults suit the built-in adapter of Raspberry Pi 3 and 4,
+// which the kernel registers from the device tree.
+type adapterConfig struct {
+	// Device is the HCI device to bring up, defaults to hci0.
+	Device string `json:"device"`
+	// UART is a serial port to attach with the HCI line discipline if
+	// Device does not show up by itself, e.g. /dev/ttyAMA0.
+	UART string `json:"uart"`
+	// Protocol is the HCI UART protocol of UART, defaults to bcm.
+	Protocol string `json:"protocol"`
+	// FlowControl enables RTS/CTS on UART, defaults to true.
+	FlowControl *bool `json:"flow_control"`
+	// FirmwareDir is added to the kernel's firmware search path if it
+	// exists, defaults to /perm/bluetooth/firmware. Broadcom firmware goes
+	// to brcm/<chip>.hcd below it, e.g. brcm/BCM4345C0.hcd.
+	FirmwareDir string `json:"firmware_dir"`
+	// ModuleParams are kernel module parameters by module name, e.g.
+	// {"btusb": "enable_autosuspend=0"}.
+	ModuleParams map[string]string `json:"module_params"`
+}
+
+func loadAdapterConfig() (adapterConfig, error) {
+	cfg := adapterConfig{
+		Device:      "hci0",
+		Protocol:    "bcm",
+		FirmwareDir: "/perm/bluetooth/firmware",
+	}
+	b, err := os.ReadFile(adapterConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", adapterConfigFile, err)
+		}
+	}
+	if _, err := hciDevID(cfg.Device); err != nil {
+		return cfg, fmt.Errorf("%s: %v", adapterConfigFile, err)
+	}
+	if _, ok := hciProtocols[cfg.Protocol]; !ok {
+		return cfg, fmt.Errorf("%s: unknown protocol %q", adapterConfigFile, cfg.Protocol)
+	}
+	return cfg, nil
+}
+
+func (cfg adapterConfig) flowControl() bool {
+	return cfg.FlowControl == nil || *cfg.FlowControl
+}
+
+// Adapter states as published over MQTT.
+const (
+	stateMissing   = "missing"
+	stateAttaching = "attaching"
+	stateDown      = "down"
+	stateUp        = "up"
+	stateBlocked   = "blocked"
+)
+
+// adapter brings the HCI device up and keeps track of it for the status
+// entities.
+type adapter struct {
+	cfg adapterConfig
+	// uart is set while cfg.UART is attached.
+	uart *uartAttachment
+
+	mu      sync.Mutex
+	state   string
+	address string
+	lastErr string
+	errors  int
+}
+
+func newAdapter(cfg adapterConfig) *adapter {
+	return &adapter{cfg: cfg, state: stateMissing}
+}
+
+// run brings the adapter up, retrying with backoff, and brings it up again
+// whenever it disappears, e.g. after the controller crashed.
+func (a *adapter) run() {
+	setFirmwarePath(a.cfg.FirmwareDir)
+
+	retry := minRetry
+	for {
+		id, err := a.bringUp()
+		if err != nil {
+			a.failed(err)
+			time.Sleep(retry)
+			if retry *= 2; retry > maxRetry {
+				retry = maxRetry
+			}
+			continue
+		}
+		retry = minRetry
+		a.monitor(id)
+	}
+}
+
+// bringUp finds or attaches the HCI device and brings it up.
+func (a *adapter) bringUp() (int, error) {
+	id, err := a.device()
+	if err != nil {
+		return 0, err
+	}
+	sock, err := openHCISocket()
+	if err != nil {
+		return 0, err
+	}
+	defer sock.Close()
+
+	err = sock.up(id)
+	if errors.Is(err, unix.ERFKILL) {
+		a.setState(stateBlocked, "")
+		log.Printf("hci%d is blocked by rfkill, unblocking", id)
+		if err := unblockRfkill(); err != nil {
+			return 0, fmt.Errorf("unblocking hci%d: %v", id, err)
+		}
+		err = sock.up(id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("bringing up hci%d: %v", id, err)
+	}
+	di, err := sock.devInfo(id)
+	if err != nil {
+		return 0, fmt.Errorf("hci%d: %v", id, err)
+	}
+	a.setState(stateUp, di.address())
+	log.Printf("hci%d is up, address %s", id, di.address())
+	return id, nil
+}
+
+// device returns the index of the configured device, attaching cfg.UART if
+// the device does not exist by itself.
+func (a *adapter) device() (int, error) {
+	id, _ := hciDevID(a.cfg.Device)
+	if deviceExists(a.cfg.Device, serdevSettle) {
+		return id, nil
+	}
+	if a.cfg.UART == "" {
+		a.setState(stateMissing, "")
+		return 0, fmt.Errorf("%s not found and no uart configured in %s", a.cfg.Device, adapterConfigFile)
+	}
+
+	a.setState(stateAttaching, "")
+	if a.uart != nil {
+		// The controller went away, start over with a fresh attachment.
+		a.uart.Close()
+		a.uart = nil
+	}
+	u, err := attachUART(a.cfg.UART, a.cfg.Protocol, a.cfg.flowControl())
+	if err != nil {
+		return 0, fmt.Errorf("attaching %s: %v", a.cfg.UART, err)
+	}
+	a.uart = u
+	log.Printf("attached %s as hci%d", a.cfg.UART, u.dev)
+	if u.dev != id {
+		log.Printf("%s was registered as hci%d instead of %s", a.cfg.UART, u.dev, a.cfg.Device)
+	}
+	return u.dev, nil
+}
+
+// monitor returns once device id is gone.
+func (a *adapter) monitor(id int) {
+	for {
+		time.Sleep(monitorInterval)
+		sock, err := openHCISocket()
+		if err != nil {
+			a.failed(err)
+			continue
+		}
+		di, err := sock.devInfo(id)
+		sock.Close()
+		if errors.Is(err, unix.ENODEV) {
+			a.failed(fmt.Errorf("hci%d disappeared", id))
+			return
+		}
+		if err != nil {
+			a.failed(fmt.Errorf("hci%d: %v", id, err))
+			continue
+		}
+		// bluetoothd powers the adapter down and up on request, so a down
+		// adapter is reported but left alone.
+		if di.up() {
+			a.setState(stateUp, di.address())
+		} else {
+			a.setState(stateDown, di.address())
+		}
+	}
+}
+
+func (a *adapter) setState(state, address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state != a.state {
+		log.Printf("adapter %s -> %s", a.state, state)
+	}
+	a.state = state
+	if address != "" {
+		a.address = address
+	}
+}
+
+func (a *adapter) failed(err error) {
+	log.Print(err)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastErr = err.Error()
+	a.errors++
+}
+
+// deviceExists waits up to timeout for name to appear in sysfs.
+func deviceExists(name string, timeout time.Duration) bool {
+	path := filepath.Join("/sys/class/bluetooth", name)
+	for start := time.Now(); ; time.Sleep(time.Second) {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		if time.Since(start) >= timeout {
+			return false
+		}
+	}
+}
+
+// setFirmwarePath makes the kernel look for firmware in dir before
+// /lib/firmware, which is read-only on gokrazy.
+func setFirmwarePath(dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	const param = "/sys/module/firmware_class/parameters/path"
+	if err := os.WriteFile(param, []byte(dir), 0644); err != nil {
+		log.Printf("setting firmware path to %s: %v", dir, err)
+		return
+	}
+	log.Printf("loading firmware from %s", dir)
+}
+
+// unblockRfkill clears the soft block of all Bluetooth rfkill switches.
+func unblockRfkill() error {
+	switches, err := filepath.Glob("/sys/class/rfkill/rfkill*")
+	if err != nil {
+		return err
+	}
+	for _, sw := range switches {
+		typ, err := os.ReadFile(filepath.Join(sw, "type"))
+		if err != nil || strings.TrimSpace(string(typ)) != "bluetooth" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(sw, "soft"), []byte("0"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
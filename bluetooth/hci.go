@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctls of the HCI socket and the HCI UART line discipline, from
+// include/net/bluetooth/hci_sock.h and drivers/bluetooth/hci_uart.h.
+const (
+	hciDevUp      = 0x400448c9 // _IOW('H', 201, int)
+	hciGetDevInfo = 0x800448d3 // _IOR('H', 211, int)
+
+	hciUARTSetProto  = 0x400455c8 // _IOW('U', 200, int)
+	hciUARTGetDevice = 0x800455ca // _IOR('U', 202, int)
+
+	// nHCI is the HCI line discipline.
+	nHCI = 15
+
+	// hciUp is the bit of hciDevInfo.Flags that is set while the device is
+	// up.
+	hciUp = 1 << 0
+)
+
+// hciProtocols maps the protocol names of the adapter config to the
+// HCI_UART_* protocol IDs.
+var hciProtocols = map[string]int{
+	"h4":    0,
+	"bcsp":  1,
+	"3wire": 2,
+	"ll":    4,
+	"bcm":   7,
+	"qca":   8,
+}
+
+// hciDevInfo is struct hci_dev_info.
+type hciDevInfo struct {
+	DevID      uint16
+	Name       [8]byte
+	Bdaddr     [6]byte
+	Flags      uint32
+	Type       uint8
+	Features   [8]uint8
+	PktType    uint32
+	LinkPolicy uint32
+	LinkMode   uint32
+	ACLMTU     uint16
+	ACLPkts    uint16
+	SCOMTU     uint16
+	SCOPkts    uint16
+	Stat       [10]uint32
+}
+
+// address returns the device address in the usual notation. The kernel
+// stores it least significant byte first.
+func (di *hciDevInfo) address() string {
+	b := di.Bdaddr
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", b[5], b[4], b[3], b[2], b[1], b[0])
+}
+
+func (di *hciDevInfo) up() bool {
+	return di.Flags&hciUp != 0
+}
+
+// hciDevID returns the index of a device name like hci0.
+func hciDevID(name string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(name, "hci"))
+	if err != nil || !strings.HasPrefix(name, "hci") {
+		return 0, fmt.Errorf("invalid HCI device %q", name)
+	}
+	return id, nil
+}
+
+// hciSocket is a raw HCI socket that is not bound to a device, which is all
+// the device ioctls need.
+type hciSocket struct {
+	fd int
+}
+
+func openHCISocket() (*hciSocket, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("opening HCI socket: %v", err)
+	}
+	return &hciSocket{fd: fd}, nil
+}
+
+func (s *hciSocket) Close() error {
+	return unix.Close(s.fd)
+}
+
+// up brings device id up. Devices that are already up are not an error.
+func (s *hciSocket) up(id int) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(s.fd), hciDevUp, uintptr(id))
+	if errno != 0 && errno != unix.EALREADY {
+		return errno
+	}
+	return nil
+}
+
+func (s *hciSocket) devInfo(id int) (*hciDevInfo, error) {
+	di := &hciDevInfo{DevID: uint16(id)}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(s.fd), hciGetDevInfo, uintptr(unsafe.Pointer(di)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return di, nil
+}
@@ -0,0 +1,5 @@
+#!/bin/bash
+# Healthy once bluetoothd has registered the adapter and powered it.
+dbus-send --system --print-reply --dest=org.bluez "/org/bluez/${HCI_DEVICE:-hci0}" \
+  org.freedesktop.DBus.Properties.Get string:org.bluez.Adapter1 string:Powered |
+  grep -q "boolean true"
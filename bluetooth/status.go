@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/alf632/gokrazy-ha/mqttComponent"
+)
+
+// statusUpdateInterval is how often the adapter entities are published, in
+// seconds.
+const statusUpdateInterval = 30
+
+// publish announces the adapter's state, address and errors next to the
+// container status entities.
+func (a *adapter) publish(mc *mqttComponent.MqttController) {
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           "bluetooth adapter state",
+		ID:             "bluetooth_adapter_state",
+		Icon:           "mdi:bluetooth",
+		UpdateInterval: statusUpdateInterval,
+		State:          a.stateString,
+	}.Sensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           "bluetooth adapter address",
+		ID:             "bluetooth_adapter_address",
+		Icon:           "mdi:bluetooth-settings",
+		UpdateInterval: statusUpdateInterval,
+		State:          a.addressString,
+	}.Sensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           "bluetooth adapter error",
+		ID:             "bluetooth_adapter_error",
+		Icon:           "mdi:bluetooth-off",
+		UpdateInterval: statusUpdateInterval,
+		State:          a.lastError,
+	}.Sensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           "bluetooth adapter errors",
+		ID:             "bluetooth_adapter_errors",
+		StateClass:     "total_increasing",
+		Icon:           "mdi:bluetooth-off",
+		UpdateInterval: statusUpdateInterval,
+		State:          a.errorCount,
+	}.Sensor())
+}
+
+func (a *adapter) stateString() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+func (a *adapter) addressString() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.address == "" {
+		return "unknown"
+	}
+	return a.address
+}
+
+func (a *adapter) lastError() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastErr == "" {
+		return "none"
+	}
+	return a.lastErr
+}
+
+func (a *adapter) errorCount() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return strconv.Itoa(a.errors)
+}
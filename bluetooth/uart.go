@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// uartAttachment is a serial port with the HCI line discipline. The HCI
+// device exists as long as the port stays open.
+type uartAttachment struct {
+	f *os.File
+	// dev is the index of the HCI device the kernel registered.
+	dev int
+}
+
+// attachUART does what btattach does: it switches port to the HCI line
+// discipline so that the kernel registers an HCI device for it. For
+// protocols like bcm, the kernel downloads the controller firmware when the
+// device is brought up.
+func attachUART(port, protocol string, flowControl bool) (*uartAttachment, error) {
+	proto, ok := hciProtocols[protocol]
+	if !ok {
+		return nil, fmt.Errorf("unknown HCI UART protocol %q", protocol)
+	}
+	f, err := os.OpenFile(port, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	if err := setRaw(fd, flowControl); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("configuring %s: %v", port, err)
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSETD, nHCI); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("setting line discipline of %s: %v", port, err)
+	}
+	if err := unix.IoctlSetInt(fd, hciUARTSetProto, proto); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("setting HCI UART protocol %s on %s: %v", protocol, port, err)
+	}
+	dev, err := unix.IoctlRetInt(fd, hciUARTGetDevice)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("getting HCI device of %s: %v", port, err)
+	}
+	return &uartAttachment{f: f, dev: dev}, nil
+}
+
+// setRaw puts the port into raw mode at 115200 baud, which all controllers
+// start with. The kernel driver switches to the operational speed itself.
+func setRaw(fd int, flowControl bool) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CBAUD | unix.CRTSCTS
+	t.Cflag |= unix.CS8 | unix.CLOCAL | unix.CREAD | unix.B115200
+	if flowControl {
+		t.Cflag |= unix.CRTSCTS
+	}
+	t.Ispeed, t.Ospeed = unix.B115200, unix.B115200
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		return err
+	}
+	return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
+}
+
+func (u *uartAttachment) Close() error {
+	return u.f.Close()
+}
@@ -0,0 +1,171 @@
+package containerComponent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// contextHashLabel is the image label that records which embedded build
+// context an image was built from.
+const contextHashLabel = "io.github.alf632.gokrazy-ha.context-hash"
+
+// Build describes how to build a Spec's image with podman build.
+type Build struct {
+	// FS is the build context, usually an embed.FS holding the launcher's
+	// Dockerfile and the files it copies. The image is rebuilt only when
+	// the contents of FS change, so a launcher that was built once keeps
+	// working without network access.
+	FS fs.FS
+	// Context is a build context directory or URL, used when FS is nil.
+	// The image is only built if it does not exist yet.
+	Context string
+	NoCache bool
+}
+
+// build makes sure image exists and, for embedded contexts, matches the
+// embedded files. If a rebuild fails, for example because the base image
+// cannot be pulled while offline, an existing older image is kept.
+func (b *Build) build(image string) error {
+	if b.FS == nil {
+		if imageExists(image) {
+			return nil
+		}
+		return podman(b.args(image, b.Context)...)
+	}
+
+	hash, err := hashFS(b.FS)
+	if err != nil {
+		return fmt.Errorf("hashing build context of %s: %v", image, err)
+	}
+	if built := imageLabel(image, contextHashLabel); built == hash {
+		return nil
+	} else if built != "" {
+		log.Printf("build context of %s changed (%.12s → %.12s), rebuilding", image, built, hash)
+	}
+
+	dir, err := os.MkdirTemp("", "containerComponent-build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractFS(b.FS, dir); err != nil {
+		return fmt.Errorf("extracting build context of %s: %v", image, err)
+	}
+
+	if err := podman(b.args(image, dir, "--label", contextHashLabel+"="+hash)...); err != nil {
+		if imageExists(image) {
+			log.Printf("%v, keeping the existing image", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *Build) args(image, context string, extra ...string) []string {
+	// The docker format keeps HEALTHCHECK instructions, which OCI images
+	// drop, for Probe.Podman.
+	args := []string{"build", "--format", "docker", "-t", image}
+	if b.NoCache {
+		args = append(args, "--no-cache")
+	}
+	args = append(args, extra...)
+	return append(args, context)
+}
+
+// imageLabel returns the value of label on the local image, or "" if the
+// image or label does not exist.
+func imageLabel(image, label string) string {
+	podman := podmanCommand("image", "inspect", "--format", fmt.Sprintf("{{index .Labels %q}}", label), image)
+	out, err := podman.Output()
+	if err != nil {
+		return ""
+	}
+	v := strings.TrimSpace(string(out))
+	if v == "<no value>" {
+		return ""
+	}
+	return v
+}
+
+// hashFS returns a hex SHA-256 over the names, modes and contents of all
+// regular files in fsys.
+func hashFS(fsys fs.FS) (string, error) {
+	var files []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, path := range files {
+		f, err := fsys.Open(path)
+		if err != nil {
+			return "", err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%o\x00", path, fi.Size(), fi.Mode().Perm())
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extractFS writes the files of fsys below dir. Shell scripts are made
+// executable, as embed.FS does not keep file modes.
+func extractFS(fsys fs.FS, dir string) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(path, ".sh") {
+			mode = 0755
+		}
+		src, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	})
+}
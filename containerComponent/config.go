@@ -0,0 +1,380 @@
+package containerComponent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Override is the format of /perm/<name>/container.json. All fields are
+// optional and are merged on top of the launcher's built-in Spec:
+//
+//	{
+//	  "image": "koenkk/zigbee2mqtt:1.33.0",
+//	  "env": ["TZ=Europe/Amsterdam"],
+//	  "serial_devices": [{"vendor_id": "0451", "product_id": "16a8", "target": "/dev/ttyACM0"}],
+//	  "limits": {"memory": "256m", "cpus": 1},
+//	  "health": {"http": "http://localhost:8080/", "interval": "1m"}
+//	}
+//
+// env entries replace built-in entries of the same name, volumes and devices
+// replace built-in entries with the same container path, ports and args are
+// added. serial_devices, health and depends_on replace the built-in settings
+// as a whole.
+type Override struct {
+	Image      *string          `json:"image"`
+	Env        []string         `json:"env"`
+	Devices    []string         `json:"devices"`
+	Serial     []serialJSON     `json:"serial_devices"`
+	Volumes    []string         `json:"volumes"`
+	Ports      []string         `json:"ports"`
+	Args       []string         `json:"args"`
+	Network    *string          `json:"network"`
+	Privileged *bool            `json:"privileged"`
+	Limits     *limitsOverride  `json:"limits"`
+	Logs       *logsOverride    `json:"logs"`
+	Update     *updateOverride  `json:"update"`
+	Health     *probeOverride   `json:"health"`
+	DependsOn  []dependencyJSON `json:"depends_on"`
+}
+
+type updateOverride struct {
+	Mode          *UpdateMode `json:"mode"`
+	Interval      *duration   `json:"interval"`
+	Digest        *string     `json:"digest"`
+	HealthTimeout *duration   `json:"health_timeout"`
+}
+
+type limitsOverride struct {
+	Memory    *string  `json:"memory"`
+	CPUs      *float64 `json:"cpus"`
+	PidsLimit *int     `json:"pids_limit"`
+}
+
+type logsOverride struct {
+	Disabled *bool   `json:"disabled"`
+	MaxSize  *int64  `json:"max_size"`
+	Keep     *int    `json:"keep"`
+	Warn     *string `json:"warn"`
+	Error    *string `json:"error"`
+}
+
+type probeOverride struct {
+	HTTP     string   `json:"http"`
+	TCP      string   `json:"tcp"`
+	Podman   bool     `json:"podman"`
+	Interval duration `json:"interval"`
+	Timeout  duration `json:"timeout"`
+}
+
+type serialJSON struct {
+	VendorID  string   `json:"vendor_id"`
+	ProductID string   `json:"product_id"`
+	Serial    string   `json:"serial"`
+	ByID      string   `json:"by_id"`
+	Target    string   `json:"target"`
+	Timeout   duration `json:"timeout"`
+}
+
+type dependencyJSON struct {
+	TCP       string   `json:"tcp"`
+	Container string   `json:"container"`
+	Timeout   duration `json:"timeout"`
+}
+
+// duration is a time.Duration that is written as "30s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (spec Spec) configFile() string {
+	if spec.ConfigFile != "" {
+		return spec.ConfigFile
+	}
+	return filepath.Join(permDir, spec.Name, "container.json")
+}
+
+// loadOverride reads and validates spec's override file. A missing file is
+// not an error.
+func (spec Spec) loadOverride() (*Override, error) {
+	path := spec.configFile()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s does not exist, using built-in defaults", path)
+			return nil, nil
+		}
+		return nil, err
+	}
+	var o Override
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&o); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	log.Printf("applying overrides from %s", path)
+	return &o, nil
+}
+
+func (o *Override) validate() error {
+	if o.Image != nil && *o.Image == "" {
+		return fmt.Errorf("image: must not be empty")
+	}
+	for _, e := range o.Env {
+		if key, _, ok := strings.Cut(e, "="); !ok || key == "" {
+			return fmt.Errorf("env: %q is not of the form KEY=value", e)
+		}
+	}
+	for _, v := range o.Volumes {
+		parts := strings.Split(v, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !filepath.IsAbs(parts[1]) {
+			return fmt.Errorf("volumes: %q is not of the form host:/container[:options]", v)
+		}
+	}
+	for _, dev := range o.Devices {
+		parts := strings.Split(dev, ":")
+		if len(parts) > 3 || !filepath.IsAbs(parts[0]) || (len(parts) > 1 && !filepath.IsAbs(parts[1])) {
+			return fmt.Errorf("devices: %q is not of the form /dev/host[:/dev/container[:permissions]]", dev)
+		}
+	}
+	for _, d := range o.Serial {
+		if err := d.serialDevice().validate(); err != nil {
+			return fmt.Errorf("serial_devices: %v", err)
+		}
+	}
+	for _, p := range o.Ports {
+		if err := validatePort(p); err != nil {
+			return fmt.Errorf("ports: %v", err)
+		}
+	}
+	if o.Update != nil && o.Update.Mode != nil {
+		switch *o.Update.Mode {
+		case UpdateNever, UpdateOnBoot, UpdateInterval:
+		default:
+			return fmt.Errorf("update: unknown mode %q, want %q, %q or %q",
+				*o.Update.Mode, UpdateNever, UpdateOnBoot, UpdateInterval)
+		}
+	}
+	if o.Limits != nil {
+		if err := o.Limits.apply(Resources{}).validate(); err != nil {
+			return fmt.Errorf("limits: %v", err)
+		}
+	}
+	if o.Logs != nil {
+		if err := o.Logs.apply(Logs{}).validate(); err != nil {
+			return fmt.Errorf("logs: %v", err)
+		}
+	}
+	if o.Health != nil {
+		if err := o.Health.probe().validate(); err != nil {
+			return fmt.Errorf("health: %v", err)
+		}
+	}
+	for _, d := range o.DependsOn {
+		if err := d.dependency().validate(); err != nil {
+			return fmt.Errorf("depends_on: %v", err)
+		}
+	}
+	return nil
+}
+
+// validatePort accepts podman's [[ip:]hostPort:]containerPort[/protocol].
+func validatePort(p string) error {
+	spec, proto, _ := strings.Cut(p, "/")
+	switch proto {
+	case "", "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("%q: unknown protocol %q", p, proto)
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return fmt.Errorf("%q is not of the form [[ip:]hostPort:]containerPort[/protocol]", p)
+	}
+	for i, part := range parts {
+		if i == 0 && len(parts) == 3 {
+			continue // ip
+		}
+		if i < len(parts)-1 && part == "" {
+			continue // random host port
+		}
+		for _, port := range strings.Split(part, "-") {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("%q: invalid port %q", p, part)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *limitsOverride) apply(r Resources) Resources {
+	if l.Memory != nil {
+		r.Memory = *l.Memory
+	}
+	if l.CPUs != nil {
+		r.CPUs = *l.CPUs
+	}
+	if l.PidsLimit != nil {
+		r.PidsLimit = *l.PidsLimit
+	}
+	return r
+}
+
+func (l *logsOverride) apply(logs Logs) Logs {
+	if l.Disabled != nil {
+		logs.Disabled = *l.Disabled
+	}
+	if l.MaxSize != nil {
+		logs.MaxSize = *l.MaxSize
+	}
+	if l.Keep != nil {
+		logs.Keep = *l.Keep
+	}
+	if l.Warn != nil {
+		logs.Warn = *l.Warn
+	}
+	if l.Error != nil {
+		logs.Error = *l.Error
+	}
+	return logs
+}
+
+func (p *probeOverride) probe() *Probe {
+	return &Probe{
+		HTTP:     p.HTTP,
+		TCP:      p.TCP,
+		Podman:   p.Podman,
+		Interval: time.Duration(p.Interval),
+		Timeout:  time.Duration(p.Timeout),
+	}
+}
+
+func (d serialJSON) serialDevice() SerialDevice {
+	return SerialDevice{
+		VendorID:  d.VendorID,
+		ProductID: d.ProductID,
+		Serial:    d.Serial,
+		ByID:      d.ByID,
+		Target:    d.Target,
+		Timeout:   time.Duration(d.Timeout),
+	}
+}
+
+func (d dependencyJSON) dependency() Dependency {
+	return Dependency{
+		TCP:       d.TCP,
+		Container: d.Container,
+		Timeout:   time.Duration(d.Timeout),
+	}
+}
+
+// apply returns spec with o merged on top.
+func (o *Override) apply(spec Spec) Spec {
+	if o.Image != nil {
+		spec.Image = *o.Image
+	}
+	spec.Env = mergeBy(spec.Env, o.Env, envKey)
+	spec.Volumes = mergeBy(spec.Volumes, o.Volumes, volumeTarget)
+	spec.Devices = mergeBy(spec.Devices, o.Devices, deviceTarget)
+	if o.Serial != nil {
+		spec.SerialDevices = nil
+		for _, d := range o.Serial {
+			spec.SerialDevices = append(spec.SerialDevices, d.serialDevice())
+		}
+	}
+	spec.Ports = mergeBy(spec.Ports, o.Ports, func(p string) string { return p })
+	spec.Args = append(append([]string(nil), spec.Args...), o.Args...)
+	if o.Network != nil {
+		spec.Network = *o.Network
+	}
+	if o.Privileged != nil {
+		spec.Privileged = *o.Privileged
+	}
+	if u := o.Update; u != nil {
+		if u.Mode != nil {
+			spec.Update.Mode = *u.Mode
+		}
+		if u.Interval != nil {
+			spec.Update.Interval = time.Duration(*u.Interval)
+		}
+		if u.Digest != nil {
+			spec.Update.Digest = *u.Digest
+		}
+		if u.HealthTimeout != nil {
+			spec.Update.HealthTimeout = time.Duration(*u.HealthTimeout)
+		}
+	}
+	if o.Limits != nil {
+		spec.Limits = o.Limits.apply(spec.Limits)
+	}
+	if o.Logs != nil {
+		spec.Logs = o.Logs.apply(spec.Logs)
+	}
+	if o.Health != nil {
+		spec.Health = o.Health.probe()
+	}
+	if o.DependsOn != nil {
+		spec.DependsOn = nil
+		for _, d := range o.DependsOn {
+			spec.DependsOn = append(spec.DependsOn, d.dependency())
+		}
+	}
+	return spec
+}
+
+// mergeBy returns defaults with overrides applied: an override replaces the
+// default with the same key, all other overrides are appended.
+func mergeBy(defaults, overrides []string, key func(string) string) []string {
+	merged := append([]string(nil), defaults...)
+Override:
+	for _, o := range overrides {
+		for i, d := range merged {
+			if key(d) == key(o) {
+				merged[i] = o
+				continue Override
+			}
+		}
+		merged = append(merged, o)
+	}
+	return merged
+}
+
+func envKey(e string) string {
+	key, _, _ := strings.Cut(e, "=")
+	return key
+}
+
+func volumeTarget(v string) string {
+	parts := strings.Split(v, ":")
+	if len(parts) < 2 {
+		return v
+	}
+	return parts[1]
+}
+
+func deviceTarget(d string) string {
+	parts := strings.Split(d, ":")
+	if len(parts) < 2 {
+		return parts[0]
+	}
+	return parts[1]
+}
@@ -0,0 +1,229 @@
+// Package containerComponent runs podman containers as gokrazy services.
+//
+// A launcher describes its container with a Spec and hands it to Main, which
+// stays in the foreground for as long as the container runs:
+//
+//	func main() {
+//		containerComponent.Main(containerComponent.Spec{
+//			Name:    "mqtt",
+//			Image:   "eclipse-mosquitto",
+//			Volumes: []string{"/perm/mqtt/config:/mosquitto/config"},
+//			Network: "host",
+//		})
+//	}
+//
+// If the launcher finds an mqttComponent configuration in
+// /perm/<name>/mqtt/config.json and secrets.json, it announces a problem
+// binary_sensor, restart count, uptime and OOM kill sensors and an event that
+// fires when the container is OOM killed to Home Assistant. The default
+// broker.json of the mqtt launcher provisions a <name>-status user for it,
+// with <name> as node_id.
+package containerComponent
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/mqttComponent"
+	"github.com/gokrazy/gokrazy"
+)
+
+// Spec declares a container and how to run it.
+type Spec struct {
+	// Name is the container name, e.g. "homeassistant".
+	Name string
+	// Image is the image reference to run, e.g. "eclipse-mosquitto".
+	Image string
+	// Build, if non-nil, builds Image locally instead of pulling it.
+	Build *Build
+	// Update controls when Image is pulled. It is ignored for built images.
+	Update UpdatePolicy
+	// Health, if non-nil, is probed periodically while the container runs.
+	// The result feeds the published problem binary_sensor and decides
+	// whether an image update is rolled back.
+	Health *Probe
+	// DependsOn lists conditions that have to hold before the container is
+	// started, e.g. the MQTT broker accepting connections.
+	DependsOn []Dependency
+
+	// Volumes are passed as -v, in podman's host:container[:options] form.
+	Volumes []string
+	// Env entries are passed as -e, in KEY=value form.
+	Env []string
+	// Devices are passed as --device, in host[:container[:permissions]] form.
+	Devices []string
+	// SerialDevices are located by their USB identity when the launcher
+	// starts and passed as --device. The launcher waits for them to be
+	// plugged in.
+	SerialDevices []SerialDevice
+	// Ports are passed as -p, e.g. "8080:80/tcp".
+	Ports []string
+	// Network is passed as --network, e.g. "host".
+	Network    string
+	Privileged bool
+	// Args are passed to podman run before the image name.
+	Args []string
+	// Limits caps the container's memory, CPU and process usage.
+	Limits Resources
+	// Logs configures the log file and which lines are forwarded to MQTT.
+	Logs Logs
+
+	// UID and GID own the directories below /perm that are created for
+	// Volumes which do not exist yet. Both default to root.
+	UID, GID int
+
+	// ConfigFile overrides the location of the JSON file that is merged on
+	// top of this Spec, see Override. Defaults to /perm/<name>/container.json.
+	ConfigFile string
+
+	// StopTimeout is the grace period passed to podman stop before the
+	// container is killed. Defaults to 10 seconds.
+	StopTimeout time.Duration
+
+	// PublishStatus, if set, is called with the launcher's MQTT controller
+	// after the container status entities are announced, so that a
+	// launcher can publish entities of its own on the same connection.
+	PublishStatus func(mc *mqttComponent.MqttController)
+}
+
+// clockTimeout bounds how long Run waits for the clock to be set.
+const clockTimeout = 2 * time.Minute
+
+// Run (re)creates the container described by spec and supervises it until it
+// exits. A non-zero container exit code is returned as *ExitError.
+func Run(spec Spec) error {
+	if spec.Name == "" {
+		return fmt.Errorf("container spec needs a name")
+	}
+	override, err := spec.loadOverride()
+	if err != nil {
+		return err
+	}
+	if override != nil {
+		spec = override.apply(spec)
+	}
+	if spec.Image == "" {
+		return fmt.Errorf("container %s: no image configured", spec.Name)
+	}
+	if err := spec.Update.validate(); err != nil {
+		return fmt.Errorf("container %s: %v", spec.Name, err)
+	}
+	if spec.Health != nil {
+		if err := spec.Health.validate(); err != nil {
+			return fmt.Errorf("container %s: %v", spec.Name, err)
+		}
+	}
+	if err := spec.Limits.validate(); err != nil {
+		return fmt.Errorf("container %s: %v", spec.Name, err)
+	}
+	if err := spec.Logs.validate(); err != nil {
+		return fmt.Errorf("container %s: %v", spec.Name, err)
+	}
+	for _, d := range spec.SerialDevices {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("container %s: %v", spec.Name, err)
+		}
+	}
+
+	// Ensure we have an up-to-date clock, which in turn also means that
+	// networking is up. This is relevant because podman takes what’s in
+	// /etc/resolv.conf (nothing at boot) and holds on to it, meaning your
+	// container will never have working networking if it starts too early.
+	// Without connectivity the clock is never set, so give up after a while
+	// and run offline.
+	waitForClock(clockTimeout)
+
+	if err := setupStorage(spec); err != nil {
+		return err
+	}
+
+	if err := WaitFor(spec.DependsOn...); err != nil {
+		return err
+	}
+
+	spec, err = spec.resolveSerialDevices()
+	if err != nil {
+		return err
+	}
+
+	if spec.Build != nil {
+		if err := spec.Build.build(spec.Image); err != nil {
+			return err
+		}
+	}
+
+	s := newSupervisor(spec)
+	defer s.close()
+
+	// The image we ran last time is the one to fall back to if a freshly
+	// pulled image does not come up.
+	image := spec.imageRef()
+	previous := imageID(image)
+	if spec.Build == nil && (spec.Update.Mode == UpdateOnBoot || spec.Update.Mode == UpdateInterval) {
+		id, err := s.pull(previous)
+		if err != nil {
+			// Most likely we are offline; keep running what we have.
+			log.Printf("pulling %s: %v", image, err)
+		}
+		if id == previous || previous == "" {
+			previous = ""
+		} else {
+			log.Printf("updated %s from %s to %s", image, shortID(previous), shortID(id))
+		}
+	} else {
+		previous = ""
+	}
+
+	if err := podman("kill", spec.Name); err != nil {
+		log.Print(err)
+	}
+
+	if err := podman("rm", spec.Name); err != nil {
+		log.Print(err)
+	}
+
+	go s.publishStatus()
+
+	return s.supervise(image, previous)
+}
+
+// waitForClock is gokrazy.WaitForClock with a timeout.
+func waitForClock(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		gokrazy.WaitForClock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("clock not set after %v, starting without network time", timeout)
+	}
+}
+
+func (spec Spec) runArgs(image string) []string {
+	args := []string{"run", "--sig-proxy=false"}
+	for _, v := range spec.Volumes {
+		args = append(args, "-v", v)
+	}
+	for _, e := range spec.Env {
+		args = append(args, "-e", e)
+	}
+	for _, d := range spec.Devices {
+		args = append(args, "--device", d)
+	}
+	for _, p := range spec.Ports {
+		args = append(args, "-p", p)
+	}
+	if spec.Network != "" {
+		args = append(args, "--network", spec.Network)
+	}
+	if spec.Privileged {
+		args = append(args, "--privileged")
+	}
+	args = append(args, spec.Limits.args()...)
+	args = append(args, "--name", spec.Name)
+	args = append(args, spec.Args...)
+	return append(args, image)
+}
@@ -0,0 +1,113 @@
+package containerComponent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const dependencyPollInterval = 2 * time.Second
+
+// Dependency is a condition a service waits for before it starts, e.g. the
+// MQTT broker accepting connections.
+type Dependency struct {
+	// TCP, if non-empty, is a host:port that has to accept connections.
+	TCP string
+	// Container, if non-empty, names a container that has to be running
+	// and, if its image defines a healthcheck, healthy.
+	Container string
+	// Timeout bounds the wait. Zero waits forever.
+	Timeout time.Duration
+}
+
+func (d Dependency) String() string {
+	switch {
+	case d.TCP != "" && d.Container != "":
+		return fmt.Sprintf("tcp %s and container %s", d.TCP, d.Container)
+	case d.TCP != "":
+		return "tcp " + d.TCP
+	default:
+		return "container " + d.Container
+	}
+}
+
+func (d Dependency) validate() error {
+	if d.TCP == "" && d.Container == "" {
+		return fmt.Errorf("dependency needs a tcp address or a container")
+	}
+	if d.TCP != "" {
+		if _, _, err := net.SplitHostPort(d.TCP); err != nil {
+			return fmt.Errorf("dependency %v: %v", d, err)
+		}
+	}
+	return nil
+}
+
+// check returns nil if d is currently satisfied.
+func (d Dependency) check() error {
+	if d.TCP != "" {
+		conn, err := net.DialTimeout("tcp", d.TCP, dependencyPollInterval)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	if d.Container != "" {
+		inspect, err := inspectContainer(d.Container)
+		if err != nil {
+			return err
+		}
+		if !inspect.State.Running {
+			return fmt.Errorf("container %s is not running", d.Container)
+		}
+		if status := inspect.healthStatus(); status != "" && status != "healthy" {
+			return fmt.Errorf("container %s is %s", d.Container, status)
+		}
+	}
+	return nil
+}
+
+// WaitFor blocks until all deps are satisfied, in order. It returns an error
+// as soon as one of them is not satisfied within its timeout, so that the
+// calling service exits and gokrazy retries it later.
+func WaitFor(deps ...Dependency) error {
+	for _, d := range deps {
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+	for _, d := range deps {
+		if err := d.wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Dependency) wait() error {
+	start := time.Now()
+	err := d.check()
+	if err == nil {
+		log.Printf("dependency %v is ready", d)
+		return nil
+	}
+	log.Printf("waiting for %v: %v", d, err)
+
+	lastLog := start
+	for {
+		time.Sleep(dependencyPollInterval)
+		err := d.check()
+		if err == nil {
+			log.Printf("dependency %v is ready after %v", d, time.Since(start).Round(time.Second))
+			return nil
+		}
+		if d.Timeout > 0 && time.Since(start) > d.Timeout {
+			return fmt.Errorf("%v not ready after %v: %v", d, d.Timeout, err)
+		}
+		if time.Since(lastLog) >= 30*time.Second {
+			log.Printf("still waiting for %v after %v: %v", d, time.Since(start).Round(time.Second), err)
+			lastLog = time.Now()
+		}
+	}
+}
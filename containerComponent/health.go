@@ -0,0 +1,104 @@
+package containerComponent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+)
+
+// Probe checks whether a running container does its job. Exactly one of HTTP,
+// TCP and Podman has to be set.
+type Probe struct {
+	// HTTP is a URL that has to answer a GET with a 2xx or 3xx status.
+	HTTP string
+	// TCP is a host:port that has to accept connections.
+	TCP string
+	// Podman runs the healthcheck defined by the image, using
+	// podman healthcheck run.
+	Podman bool
+
+	// Interval between probes, defaults to 30 seconds.
+	Interval time.Duration
+	// Timeout of a single probe, defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (p *Probe) String() string {
+	switch {
+	case p.HTTP != "":
+		return "http " + p.HTTP
+	case p.TCP != "":
+		return "tcp " + p.TCP
+	default:
+		return "podman healthcheck"
+	}
+}
+
+func (p *Probe) validate() error {
+	set := 0
+	for _, b := range []bool{p.HTTP != "", p.TCP != "", p.Podman} {
+		if b {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("health probe needs exactly one of http, tcp or podman")
+	}
+	if p.TCP != "" {
+		if _, _, err := net.SplitHostPort(p.TCP); err != nil {
+			return fmt.Errorf("health probe: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *Probe) interval() time.Duration {
+	if p.Interval == 0 {
+		return defaultProbeInterval
+	}
+	return p.Interval
+}
+
+func (p *Probe) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return defaultProbeTimeout
+	}
+	return p.Timeout
+}
+
+// check runs the probe once against container name.
+func (p *Probe) check(name string) error {
+	switch {
+	case p.HTTP != "":
+		client := &http.Client{Timeout: p.timeout()}
+		resp, err := client.Get(p.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", p.HTTP, resp.Status)
+		}
+		return nil
+
+	case p.TCP != "":
+		conn, err := net.DialTimeout("tcp", p.TCP, p.timeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	default:
+		podman := podmanCommand("healthcheck", "run", name)
+		if out, err := podman.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %v: %s", podman.Args, err, out)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package containerComponent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// containerInspect holds the parts of podman inspect output we look at.
+type containerInspect struct {
+	Image     string
+	ImageName string
+	State     struct {
+		Running   bool
+		ExitCode  int
+		OOMKilled bool
+		// Health is only present for images that define a healthcheck.
+		Health *struct {
+			Status string
+		}
+	}
+}
+
+func inspectContainer(name string) (*containerInspect, error) {
+	podman := podmanCommand("inspect", "--type", "container", name)
+	var stdout bytes.Buffer
+	podman.Stdout = &stdout
+	if err := podman.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %v", podman.Args, err)
+	}
+	var inspects []containerInspect
+	if err := json.Unmarshal(stdout.Bytes(), &inspects); err != nil {
+		return nil, fmt.Errorf("parsing podman inspect %s: %v", name, err)
+	}
+	if len(inspects) != 1 {
+		return nil, fmt.Errorf("podman inspect %s: got %d results", name, len(inspects))
+	}
+	return &inspects[0], nil
+}
+
+// healthStatus returns podman's healthcheck status, or "" if the container's
+// image defines no healthcheck.
+func (ci *containerInspect) healthStatus() string {
+	if ci.State.Health == nil {
+		return ""
+	}
+	return ci.State.Health.Status
+}
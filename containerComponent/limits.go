@@ -0,0 +1,86 @@
+package containerComponent
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Resources limits what a container may use, so that one service cannot
+// starve the others on a small board.
+type Resources struct {
+	// Memory is passed as --memory, e.g. "512m". The container is killed
+	// when it exceeds the limit.
+	Memory string
+	// CPUs is passed as --cpus, e.g. 1.5 for one and a half cores.
+	CPUs float64
+	// PidsLimit is passed as --pids-limit.
+	PidsLimit int
+}
+
+var memoryLimit = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+
+func (r Resources) validate() error {
+	if r.Memory != "" && !memoryLimit.MatchString(r.Memory) {
+		return fmt.Errorf("memory limit %q is not of the form <number>[b|k|m|g]", r.Memory)
+	}
+	if r.CPUs < 0 {
+		return fmt.Errorf("cpus limit must not be negative")
+	}
+	if r.PidsLimit < 0 {
+		return fmt.Errorf("pids limit must not be negative")
+	}
+	return nil
+}
+
+func (r Resources) args() []string {
+	var args []string
+	if r.Memory != "" {
+		args = append(args, "--memory", r.Memory)
+	}
+	if r.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(r.CPUs, 'f', -1, 64))
+	}
+	if r.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(r.PidsLimit))
+	}
+	return args
+}
+
+// oomEvent records a container that was killed for exceeding its memory
+// limit.
+type oomEvent struct {
+	Time        time.Time `json:"time"`
+	Image       string    `json:"image"`
+	MemoryLimit string    `json:"memory_limit,omitempty"`
+}
+
+// checkOOM asks podman whether the container that just exited was killed by
+// the OOM killer and, if so, counts and reports it.
+func (s *supervisor) checkOOM() {
+	inspect, err := inspectContainer(s.spec.Name)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !inspect.State.OOMKilled {
+		return
+	}
+	ev := oomEvent{
+		Time:        time.Now().UTC(),
+		Image:       inspect.ImageName,
+		MemoryLimit: s.spec.Limits.Memory,
+	}
+	log.Printf("container %s was killed for running out of memory (limit %q)", s.spec.Name, ev.MemoryLimit)
+
+	s.state.OOMKills++
+	s.status.oomKilled(s.state.OOMKills, ev)
+	// Events that could not be published yet are kept for the next start
+	// of the launcher.
+	s.state.UnreportedOOM = s.status.unreportedOOM()
+	if err := s.state.save(s.spec.Name); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,263 @@
+package containerComponent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxSize = 1 << 20
+	defaultLogKeep    = 3
+
+	// logForwardLimit caps how many lines are forwarded to MQTT per
+	// logForwardWindow, so that a crash loop does not flood Home Assistant.
+	logForwardLimit  = 10
+	logForwardWindow = time.Minute
+)
+
+// Logs configures where a container's output goes besides the gokrazy log.
+type Logs struct {
+	// Disabled turns off writing /perm/<name>/logs/<name>.log.
+	Disabled bool
+	// MaxSize is the size in bytes at which the log file is rotated,
+	// defaults to 1 MiB.
+	MaxSize int64
+	// Keep is the number of rotated files to keep, defaults to 3.
+	Keep int
+	// Warn and Error are regular expressions. Matching lines are published
+	// as warning and error events of the <name>_log event entity.
+	Warn, Error string
+}
+
+func (l Logs) validate() error {
+	for _, re := range []string{l.Warn, l.Error} {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("log pattern: %v", err)
+		}
+	}
+	if l.MaxSize < 0 || l.Keep < 0 {
+		return fmt.Errorf("log max size and keep must not be negative")
+	}
+	return nil
+}
+
+// logLine is a container output line to be forwarded to MQTT.
+type logLine struct {
+	level string
+	text  string
+	time  time.Time
+}
+
+// logSink receives the container's output line by line, appends it to the
+// log file and picks out lines to forward.
+type logSink struct {
+	mu      sync.Mutex
+	file    *rotatingFile
+	warn    *regexp.Regexp
+	err     *regexp.Regexp
+	forward chan<- logLine
+
+	windowStart time.Time
+	forwarded   int
+	dropped     int
+}
+
+func (spec Spec) logDir() string {
+	return filepath.Join(permDir, spec.Name, "logs")
+}
+
+// newLogSink opens spec's log file. Forwarded lines are sent to forward
+// without blocking. If the log file cannot be opened, output still goes to
+// the gokrazy log and MQTT.
+func newLogSink(spec Spec, forward chan<- logLine) *logSink {
+	ls := &logSink{forward: forward}
+	if spec.Logs.Warn != "" {
+		ls.warn = regexp.MustCompile(spec.Logs.Warn)
+	}
+	if spec.Logs.Error != "" {
+		ls.err = regexp.MustCompile(spec.Logs.Error)
+	}
+	if !spec.Logs.Disabled {
+		maxSize, keep := spec.Logs.MaxSize, spec.Logs.Keep
+		if maxSize == 0 {
+			maxSize = defaultLogMaxSize
+		}
+		if keep == 0 {
+			keep = defaultLogKeep
+		}
+		f, err := openRotatingFile(filepath.Join(spec.logDir(), spec.Name+".log"), maxSize, keep)
+		if err != nil {
+			log.Printf("not writing a log file for %s: %v", spec.Name, err)
+		}
+		ls.file = f
+	}
+	return ls
+}
+
+func (ls *logSink) line(b []byte) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.file != nil {
+		if err := ls.file.write(b); err != nil {
+			log.Printf("writing container log: %v", err)
+		}
+	}
+
+	level := ""
+	switch {
+	case ls.err != nil && ls.err.Match(b):
+		level = "error"
+	case ls.warn != nil && ls.warn.Match(b):
+		level = "warning"
+	default:
+		return
+	}
+	now := time.Now()
+	if now.Sub(ls.windowStart) > logForwardWindow {
+		if ls.dropped > 0 {
+			log.Printf("dropped %d log lines that exceeded the MQTT forwarding limit", ls.dropped)
+		}
+		ls.windowStart, ls.forwarded, ls.dropped = now, 0, 0
+	}
+	if ls.forwarded >= logForwardLimit {
+		ls.dropped++
+		return
+	}
+	select {
+	case ls.forward <- logLine{level: level, text: string(bytes.TrimRight(b, "\r\n")), time: now}:
+		ls.forwarded++
+	default:
+		ls.dropped++
+	}
+}
+
+func (ls *logSink) close() error {
+	if ls.file == nil {
+		return nil
+	}
+	return ls.file.close()
+}
+
+// writer returns an io.Writer for one output stream of the container that
+// passes complete lines to ls and everything to w.
+func (ls *logSink) writer(w io.Writer) io.Writer {
+	return &lineWriter{sink: ls, out: w}
+}
+
+type lineWriter struct {
+	sink    *logSink
+	out     io.Writer
+	partial []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n, err := lw.out.Write(p)
+	lw.partial = append(lw.partial, p...)
+	for {
+		i := bytes.IndexByte(lw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lw.sink.line(lw.partial[:i+1])
+		lw.partial = lw.partial[i+1:]
+	}
+	// Do not buffer endless lines.
+	if len(lw.partial) > 64<<10 {
+		lw.sink.line(append(lw.partial, '\n'))
+		lw.partial = nil
+	}
+	return n, err
+}
+
+// rotatingFile is a log file that is renamed to path.1, path.2, … once it
+// reaches maxSize.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	rf := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// write appends b, rotating the file first if b does not fit. b is written
+// even if rotating fails, as long as a file could be opened.
+func (rf *rotatingFile) write(b []byte) error {
+	var rerr error
+	if rf.f == nil || rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		rerr = rf.rotate()
+	}
+	if rf.f == nil {
+		return rerr
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// rotate moves the file out of the way and opens a new one. The file is
+// opened again if that fails, so that later writes append to it, and the
+// first error is returned.
+func (rf *rotatingFile) rotate() error {
+	var err error
+	if rf.f != nil {
+		err = rf.f.Close()
+		rf.f = nil
+	}
+	if err == nil {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+		for i := rf.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if rf.keep > 0 {
+			err = os.Rename(rf.path, rf.path+".1")
+		} else {
+			err = os.Remove(rf.path)
+		}
+	}
+	if oerr := rf.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (rf *rotatingFile) close() error {
+	if rf.f == nil {
+		return nil
+	}
+	return rf.f.Close()
+}
@@ -0,0 +1,72 @@
+package containerComponent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "mqtt.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if err := rf.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "four\nfive\n",
+		path + ".1": "three\n",
+		path + ".2": "one\ntwo\n",
+	} {
+		if got := readFile(t, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.log")
+	rf, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.close()
+	// A non-empty directory in the way of mqtt.log.1 makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.write([]byte("a\n")); err == nil {
+		t.Errorf("write succeeded although rotating failed")
+	}
+
+	// Once the way is clear, writing and rotating work again.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.write([]byte("b\n")); err != nil {
+		t.Fatalf("write after rotating failed: %v", err)
+	}
+	if got, want := readFile(t, path+".1"), "0123456789a\n"; got != want {
+		t.Errorf("%s.1 = %q, want %q", path, got, want)
+	}
+	if got, want := readFile(t, path), "b\n"; got != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+}
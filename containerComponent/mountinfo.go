@@ -0,0 +1,148 @@
+package containerComponent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mountInfo is one line of /proc/<pid>/mountinfo, see proc(5).
+type mountInfo struct {
+	ID, ParentID int
+	Major, Minor int
+	// Root is the directory of the mounted file system that forms the
+	// root of this mount, e.g. "/container-storage" for a bind mount.
+	Root       string
+	MountPoint string
+	Options    []string
+	// Optional holds tagged fields such as "shared:1" or "master:2".
+	Optional     []string
+	FSType       string
+	Source       string
+	SuperOptions []string
+}
+
+func (m mountInfo) readOnly() bool {
+	for _, opt := range m.Options {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		m, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("mountinfo line %d: %v", lineno, err)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+func parseMountInfoLine(line string) (mountInfo, error) {
+	var m mountInfo
+	fields := strings.Fields(line)
+	// The optional fields are variable in number and terminated by a
+	// single hyphen, after which exactly three fields follow.
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if len(fields) < 6 || sep == -1 || len(fields) < sep+3 {
+		return m, fmt.Errorf("malformed entry %q", line)
+	}
+
+	var err error
+	if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return m, fmt.Errorf("mount ID: %v", err)
+	}
+	if m.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return m, fmt.Errorf("parent ID: %v", err)
+	}
+	major, minor, ok := strings.Cut(fields[2], ":")
+	if !ok {
+		return m, fmt.Errorf("malformed major:minor %q", fields[2])
+	}
+	if m.Major, err = strconv.Atoi(major); err != nil {
+		return m, fmt.Errorf("major: %v", err)
+	}
+	if m.Minor, err = strconv.Atoi(minor); err != nil {
+		return m, fmt.Errorf("minor: %v", err)
+	}
+	if m.Root, err = unescapeMountPath(fields[3]); err != nil {
+		return m, err
+	}
+	if m.MountPoint, err = unescapeMountPath(fields[4]); err != nil {
+		return m, err
+	}
+	m.Options = strings.Split(fields[5], ",")
+	m.Optional = fields[6:sep]
+	m.FSType = fields[sep+1]
+	if m.Source, err = unescapeMountPath(fields[sep+2]); err != nil {
+		return m, err
+	}
+	if len(fields) > sep+3 {
+		m.SuperOptions = strings.Split(fields[sep+3], ",")
+	}
+	return m, nil
+}
+
+// unescapeMountPath undoes the octal escaping the kernel applies to space,
+// tab, newline and backslash in mountinfo paths (e.g. "\040" for a space).
+func unescapeMountPath(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+4 > len(s) {
+			return "", fmt.Errorf("truncated escape in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 3
+	}
+	return b.String(), nil
+}
+
+// findMount returns the entry that is visible at mountpoint, i.e. the last
+// one mounted there, if any.
+func findMount(mounts []mountInfo, mountpoint string) (mountInfo, bool) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == mountpoint {
+			return mounts[i], true
+		}
+	}
+	return mountInfo{}, false
+}
@@ -0,0 +1,178 @@
+package containerComponent
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfoLine(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		line    string
+		want    mountInfo
+		wantErr bool
+	}{
+		{
+			name: "no optional fields",
+			line: `22 20 0:20 / /proc rw,relatime - proc proc rw`,
+			want: mountInfo{
+				ID: 22, ParentID: 20, Major: 0, Minor: 20,
+				Root: "/", MountPoint: "/proc",
+				Options:      []string{"rw", "relatime"},
+				Optional:     []string{},
+				FSType:       "proc",
+				Source:       "proc",
+				SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name: "several optional fields",
+			line: `23 20 0:21 / /sys rw shared:3 master:1 propagate_from:1 - sysfs sysfs rw`,
+			want: mountInfo{
+				ID: 23, ParentID: 20, Major: 0, Minor: 21,
+				Root: "/", MountPoint: "/sys",
+				Options:      []string{"rw"},
+				Optional:     []string{"shared:3", "master:1", "propagate_from:1"},
+				FSType:       "sysfs",
+				Source:       "sysfs",
+				SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name: "escapes",
+			line: `27 20 179:4 /a\040b /mnt/back\134slash rw - ext4 tab\011dev rw`,
+			want: mountInfo{
+				ID: 27, ParentID: 20, Major: 179, Minor: 4,
+				Root: "/a b", MountPoint: `/mnt/back\slash`,
+				Options:      []string{"rw"},
+				Optional:     []string{},
+				FSType:       "ext4",
+				Source:       "tab\tdev",
+				SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name: "no super options",
+			line: `22 20 0:20 / /proc rw - proc proc`,
+			want: mountInfo{
+				ID: 22, ParentID: 20, Major: 0, Minor: 20,
+				Root: "/", MountPoint: "/proc",
+				Options:  []string{"rw"},
+				Optional: []string{},
+				FSType:   "proc",
+				Source:   "proc",
+			},
+		},
+		{name: "truncated escape", line: `27 20 179:4 / /mnt/a\04 rw - ext4 /dev/sda rw`, wantErr: true},
+		{name: "invalid escape", line: `27 20 179:4 / /mnt/a\09x rw - ext4 /dev/sda rw`, wantErr: true},
+		{name: "missing separator", line: `21 20 0:5 / /dev rw shared:2 devtmpfs devtmpfs rw`, wantErr: true},
+		{name: "too few fields after separator", line: `21 20 0:5 / /dev rw - devtmpfs`, wantErr: true},
+		{name: "malformed major:minor", line: `21 20 5 / /dev rw - devtmpfs devtmpfs rw`, wantErr: true},
+		{name: "too short", line: `21 20 0:5 /`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMountInfoLine(tc.line)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseMountInfoLine(%q) = %+v, want error", tc.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseMountInfoLine(%q) =\n%+v, want\n%+v", tc.line, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "/perm", want: "/perm"},
+		{in: `/a\040b`, want: "/a b"},
+		{in: `/a\011b`, want: "/a\tb"},
+		{in: `/a\134b`, want: `/a\b`},
+		{in: `\040\040`, want: "  "},
+		{in: `/a\`, wantErr: true},
+		{in: `/a\13`, wantErr: true},
+		{in: `/a\999`, wantErr: true},
+	} {
+		got, err := unescapeMountPath(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("unescapeMountPath(%q) error = %v, want error %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func readMountInfoFixture(t *testing.T, name string) ([]mountInfo, error) {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+func TestParseMountInfoFixture(t *testing.T) {
+	mounts, err := readMountInfoFixture(t, "mountinfo.gokrazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(mounts), 10; got != want {
+		t.Fatalf("got %d mounts, want %d", got, want)
+	}
+	if got, want := mounts[7].MountPoint, "/perm/home assistant"; got != want {
+		t.Errorf("mount point = %q, want %q", got, want)
+	}
+	if got, want := mounts[8].Source, "tmp\tfs"; got != want {
+		t.Errorf("source = %q, want %q", got, want)
+	}
+
+	_, err = readMountInfoFixture(t, "mountinfo.malformed")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("malformed fixture: error = %v, want one for line 2", err)
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	mounts, err := readMountInfoFixture(t, "mountinfo.gokrazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		mountpoint string
+		wantID     int
+		readOnly   bool
+		found      bool
+	}{
+		// /perm is mounted twice, the tmpfs on top is what is visible.
+		{mountpoint: "/perm", wantID: 28, readOnly: true, found: true},
+		{mountpoint: "/var/lib/containers", wantID: 26, found: true},
+		{mountpoint: "/mnt/back\\slash", wantID: 29, found: true},
+		{mountpoint: "/perm/containers"},
+	} {
+		m, ok := findMount(mounts, tc.mountpoint)
+		if ok != tc.found {
+			t.Errorf("findMount(%q) found = %v, want %v", tc.mountpoint, ok, tc.found)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if m.ID != tc.wantID || m.readOnly() != tc.readOnly {
+			t.Errorf("findMount(%q) = ID %d, read-only %v, want ID %d, read-only %v", tc.mountpoint, m.ID, m.readOnly(), tc.wantID, tc.readOnly)
+		}
+	}
+}
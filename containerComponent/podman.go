@@ -0,0 +1,88 @@
+package containerComponent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func podmanCommand(args ...string) *exec.Cmd {
+	podman := exec.Command("/usr/local/bin/podman", args...)
+	podman.Env = expandPath(os.Environ())
+	podman.Env = append(podman.Env, "TMPDIR=/tmp")
+	return podman
+}
+
+func podman(args ...string) error {
+	podman := podmanCommand(args...)
+	podman.Stdin = os.Stdin
+	podman.Stdout = os.Stdout
+	podman.Stderr = os.Stderr
+	if err := podman.Run(); err != nil {
+		return fmt.Errorf("%v: %v", podman.Args, err)
+	}
+	return nil
+}
+
+// imageExists reports whether image is present in the local container storage.
+func imageExists(image string) bool {
+	return podmanCommand("image", "exists", image).Run() == nil
+}
+
+// expandPath returns env, but with PATH= modified or added
+// such that both /user and /usr/local/bin are included, which podman needs.
+func expandPath(env []string) []string {
+	extra := "/user:/usr/local/bin"
+	found := false
+	for idx, val := range env {
+		parts := strings.Split(val, "=")
+		if len(parts) < 2 {
+			continue // malformed entry
+		}
+		key := parts[0]
+		if key != "PATH" {
+			continue
+		}
+		val := strings.Join(parts[1:], "=")
+		env[idx] = fmt.Sprintf("%s=%s:%s", key, extra, val)
+		found = true
+	}
+	if !found {
+		const busyboxDefaultPATH = "/usr/local/sbin:/sbin:/usr/sbin:/usr/local/bin:/bin:/usr/bin"
+		env = append(env, fmt.Sprintf("PATH=%s:%s", extra, busyboxDefaultPATH))
+	}
+	return env
+}
+
+// Signal sends sig to the main process of the running container name, e.g.
+// SIGHUP to make it reload its configuration.
+func Signal(name string, sig syscall.Signal) error {
+	return podman("kill", "--signal", strconv.Itoa(int(sig)), name)
+}
+
+// Pause freezes the processes of container name, e.g. to copy its volumes
+// while nothing writes to them, and returns a function that thaws them again.
+// A container that is not running is left alone and resume is a no-op.
+func Pause(name string) (resume func() error, err error) {
+	ci, err := inspectContainer(name)
+	if err != nil || !ci.State.Running {
+		return func() error { return nil }, nil
+	}
+	if err := podman("pause", name); err != nil {
+		return nil, err
+	}
+	return func() error { return podman("unpause", name) }, nil
+}
+
+// Stop stops container name. Its launcher then exits and is restarted by
+// gokrazy, which recreates the container, e.g. after its volumes were
+// replaced.
+func Stop(name string) error {
+	if ci, err := inspectContainer(name); err != nil || !ci.State.Running {
+		return nil
+	}
+	return podman("stop", name)
+}
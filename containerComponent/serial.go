@@ -0,0 +1,271 @@
+package containerComponent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sysfsRoot     = "/sys"
+	devSerialByID = "/dev/serial/by-id"
+)
+
+// SerialDevice selects a USB serial adapter by its identity instead of by the
+// order in which the kernel enumerated it. All non-empty match fields have
+// to match.
+type SerialDevice struct {
+	// VendorID and ProductID are the USB IDs in hex, e.g. "10c4" and "ea60".
+	VendorID  string
+	ProductID string
+	// Serial is the USB serial number.
+	Serial string
+	// ByID is a glob matched against the device's /dev/serial/by-id name,
+	// e.g. "usb-ITead_Sonoff_Zigbee_3.0_USB_Dongle_Plus_*-if00-port0".
+	// gokrazy has no udev, so the name is derived from sysfs the same way
+	// udev would.
+	ByID string
+
+	// Target is the device path inside the container. Defaults to the
+	// device's path on the host.
+	Target string
+	// Timeout bounds the wait for the device to appear. Zero waits forever.
+	Timeout time.Duration
+}
+
+func (d SerialDevice) String() string {
+	var parts []string
+	if d.VendorID != "" || d.ProductID != "" {
+		parts = append(parts, d.VendorID+":"+d.ProductID)
+	}
+	if d.Serial != "" {
+		parts = append(parts, "serial "+d.Serial)
+	}
+	if d.ByID != "" {
+		parts = append(parts, "by-id "+d.ByID)
+	}
+	return "USB serial device " + strings.Join(parts, ", ")
+}
+
+func (d SerialDevice) validate() error {
+	if d.VendorID == "" && d.ProductID == "" && d.Serial == "" && d.ByID == "" {
+		return fmt.Errorf("serial device needs at least one of vendor/product ID, serial or by-id glob")
+	}
+	if d.ByID != "" {
+		if _, err := filepath.Match(d.ByID, ""); err != nil {
+			return fmt.Errorf("serial device by-id %q: %v", d.ByID, err)
+		}
+	}
+	if d.Target != "" && !filepath.IsAbs(d.Target) {
+		return fmt.Errorf("serial device target %q is not an absolute path", d.Target)
+	}
+	return nil
+}
+
+// usbSerial is a tty that belongs to a USB device.
+type usbSerial struct {
+	// Node is the device node, e.g. /dev/ttyUSB1.
+	Node      string
+	VendorID  string
+	ProductID string
+	Serial    string
+	// ByID is the name udev would create in /dev/serial/by-id.
+	ByID string
+}
+
+func (d SerialDevice) matches(s usbSerial) bool {
+	if d.VendorID != "" && !strings.EqualFold(d.VendorID, s.VendorID) {
+		return false
+	}
+	if d.ProductID != "" && !strings.EqualFold(d.ProductID, s.ProductID) {
+		return false
+	}
+	if d.Serial != "" && d.Serial != s.Serial {
+		return false
+	}
+	if d.ByID != "" {
+		if ok, _ := filepath.Match(d.ByID, s.ByID); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scanUSBSerial lists the USB serial ttys below sysfs (usually /sys).
+func scanUSBSerial(sysfs string) ([]usbSerial, error) {
+	entries, err := os.ReadDir(filepath.Join(sysfs, "class", "tty"))
+	if err != nil {
+		return nil, err
+	}
+	var found []usbSerial
+	for _, e := range entries {
+		tty := filepath.Join(sysfs, "class", "tty", e.Name())
+		// ttys without a device link are virtual (tty0, ptmx, …).
+		dev, err := filepath.EvalSymlinks(filepath.Join(tty, "device"))
+		if err != nil {
+			continue
+		}
+		usbDev, iface := findUSBDevice(dev)
+		if usbDev == "" {
+			continue
+		}
+		s := usbSerial{
+			Node:      filepath.Join("/dev", e.Name()),
+			VendorID:  readAttr(usbDev, "idVendor"),
+			ProductID: readAttr(usbDev, "idProduct"),
+			Serial:    readAttr(usbDev, "serial"),
+		}
+		s.ByID = udevByID(s, readAttr(usbDev, "manufacturer"), readAttr(usbDev, "product"),
+			readAttr(iface, "bInterfaceNumber"), readAttr(dev, "port_number"))
+		found = append(found, s)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Node < found[j].Node })
+	return found, nil
+}
+
+// findUSBDevice walks up from a tty's device directory to the USB interface
+// and USB device it belongs to.
+func findUSBDevice(dev string) (usbDev, iface string) {
+	for dir := dev; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "bInterfaceNumber")); err == nil && iface == "" {
+			iface = dir
+		}
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return dir, iface
+		}
+	}
+	return "", ""
+}
+
+func readAttr(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// udevByID builds the name udev's 60-serial.rules would link in
+// /dev/serial/by-id, e.g. usb-Silicon_Labs_CP2102N_USB_to_UART_Bridge_Controller_8a3c…-if00-port0.
+func udevByID(s usbSerial, manufacturer, product, ifaceNum, port string) string {
+	vendor := udevSanitize(manufacturer)
+	if vendor == "" {
+		vendor = s.VendorID
+	}
+	model := udevSanitize(product)
+	if model == "" {
+		model = s.ProductID
+	}
+	id := "usb-" + vendor + "_" + model
+	if serial := udevSanitize(s.Serial); serial != "" {
+		id += "_" + serial
+	}
+	if ifaceNum != "" {
+		id += "-if" + ifaceNum
+	}
+	if port != "" {
+		id += "-port" + port
+	}
+	return id
+}
+
+// udevSanitize replaces whitespace and characters udev does not allow in
+// device names with underscores.
+func udevSanitize(s string) string {
+	s = strings.TrimSpace(s)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			return r
+		case strings.ContainsRune("#+-.:=@_", r), r > 0x7f:
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// realByID returns the /dev/serial/by-id name pointing to node, for systems
+// that do run udev.
+func realByID(node string) string {
+	entries, err := os.ReadDir(devSerialByID)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(devSerialByID, e.Name()))
+		if err == nil && target == node {
+			return e.Name()
+		}
+	}
+	return ""
+}
+
+// resolve waits until exactly one USB serial device matches d and returns its
+// device node.
+func (d SerialDevice) resolve() (string, error) {
+	start := time.Now()
+	var lastLog time.Time
+	for {
+		found, err := scanUSBSerial(sysfsRoot)
+		if err != nil {
+			return "", err
+		}
+		var matches []usbSerial
+		for _, s := range found {
+			if name := realByID(s.Node); name != "" {
+				s.ByID = name
+			}
+			if d.matches(s) {
+				matches = append(matches, s)
+			}
+		}
+		switch len(matches) {
+		case 1:
+			log.Printf("found %v at %s (%s)", d, matches[0].Node, matches[0].ByID)
+			return matches[0].Node, nil
+		case 0:
+			if d.Timeout > 0 && time.Since(start) > d.Timeout {
+				return "", fmt.Errorf("%v did not appear within %v", d, d.Timeout)
+			}
+			if time.Since(lastLog) >= 30*time.Second {
+				log.Printf("waiting for %v to be plugged in", d)
+				for _, s := range found {
+					log.Printf("  present: %s %s:%s serial %q (%s)", s.Node, s.VendorID, s.ProductID, s.Serial, s.ByID)
+				}
+				lastLog = time.Now()
+			}
+			time.Sleep(dependencyPollInterval)
+		default:
+			var nodes []string
+			for _, m := range matches {
+				nodes = append(nodes, m.Node)
+			}
+			return "", fmt.Errorf("%v is ambiguous, matches %s; add a serial number or by-id glob", d, strings.Join(nodes, ", "))
+		}
+	}
+}
+
+// resolveSerialDevices turns spec's SerialDevices into --device arguments.
+func (spec Spec) resolveSerialDevices() (Spec, error) {
+	devices := append([]string(nil), spec.Devices...)
+	for _, d := range spec.SerialDevices {
+		node, err := d.resolve()
+		if err != nil {
+			return spec, err
+		}
+		target := d.Target
+		if target == "" {
+			target = node
+		}
+		devices = append(devices, node+":"+target)
+	}
+	spec.Devices = devices
+	return spec, nil
+}
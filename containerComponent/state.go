@@ -0,0 +1,73 @@
+package containerComponent
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// launcherState is persisted across launcher restarts in the container
+// storage on /perm.
+type launcherState struct {
+	// Bad is the ID of the last image that was rolled back, so that it is
+	// not rolled out again on the next boot.
+	Bad string `json:"bad,omitempty"`
+	// BootID identifies the boot Restarts counts for.
+	BootID   string `json:"boot_id,omitempty"`
+	Restarts int    `json:"restarts"`
+	// OOMKills counts the times the container was killed for exceeding
+	// its memory limit, across boots.
+	OOMKills int `json:"oom_kills,omitempty"`
+	// UnreportedOOM holds OOM events that were not published yet.
+	UnreportedOOM []oomEvent `json:"unreported_oom,omitempty"`
+}
+
+const stateDir = "/var/lib/containerComponent"
+
+func statePath(name string) string {
+	return filepath.Join(stateDir, name+".json")
+}
+
+func loadState(name string) launcherState {
+	var st launcherState
+	b, err := os.ReadFile(statePath(name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		log.Printf("%s: %v", statePath(name), err)
+	}
+	return st
+}
+
+func (st launcherState) save(name string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(name), b, 0644)
+}
+
+// countStart records a container start: the first start of a boot resets
+// Restarts, every further one increments it.
+func (st *launcherState) countStart() {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		log.Print(err)
+	}
+	bootID := string(bytes.TrimSpace(b))
+	if bootID != st.BootID {
+		st.BootID = bootID
+		st.Restarts = 0
+		return
+	}
+	st.Restarts++
+}
@@ -0,0 +1,248 @@
+package containerComponent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/mqttComponent"
+)
+
+// statusUpdateInterval is how often entity states are published, in seconds.
+const statusUpdateInterval = 30
+
+// status is what the supervisor knows about its container.
+type status struct {
+	mu        sync.Mutex
+	running   bool
+	startedAt time.Time
+	restarts  int
+	// probeErr is the result of the last health probe.
+	probeErr error
+
+	oomKills int
+	// pendingOOM are OOM events that still have to be published on event.
+	pendingOOM []oomEvent
+	event      *mqttComponent.EventEntity
+	// flushMu serializes publishing of pendingOOM.
+	flushMu sync.Mutex
+}
+
+func (st *status) started(restarts int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.running = true
+	st.startedAt = time.Now()
+	st.restarts = restarts
+	st.probeErr = nil
+}
+
+func (st *status) exited() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.running = false
+}
+
+func (st *status) probed(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.probeErr = err
+}
+
+func (st *status) problem() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.running || st.probeErr != nil {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func (st *status) uptime() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.running {
+		return "0"
+	}
+	return strconv.Itoa(int(time.Since(st.startedAt).Seconds()))
+}
+
+func (st *status) restartCount() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strconv.Itoa(st.restarts)
+}
+
+func (st *status) oomKillCount() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strconv.Itoa(st.oomKills)
+}
+
+func (st *status) oomKilled(count int, ev oomEvent) {
+	st.mu.Lock()
+	st.oomKills = count
+	st.pendingOOM = append(st.pendingOOM, ev)
+	st.mu.Unlock()
+	st.flushOOM()
+}
+
+func (st *status) unreportedOOM() []oomEvent {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]oomEvent(nil), st.pendingOOM...)
+}
+
+// flushOOM publishes pending OOM events once the MQTT connection is up.
+func (st *status) flushOOM() {
+	st.flushMu.Lock()
+	defer st.flushMu.Unlock()
+
+	st.mu.Lock()
+	event, pending := st.event, append([]oomEvent(nil), st.pendingOOM...)
+	st.mu.Unlock()
+	if event == nil {
+		return
+	}
+
+	published := 0
+	for _, ev := range pending {
+		err := event.Fire("oom_killed", map[string]any{
+			"time":         ev.Time,
+			"image":        ev.Image,
+			"memory_limit": ev.MemoryLimit,
+		})
+		if err != nil {
+			log.Printf("publishing OOM event: %v", err)
+			break
+		}
+		published++
+	}
+
+	st.mu.Lock()
+	st.pendingOOM = st.pendingOOM[published:]
+	st.mu.Unlock()
+}
+
+// probe runs spec's health probe until exited is closed and records the
+// results in s.status.
+func (s *supervisor) probe(exited <-chan struct{}) {
+	p := s.spec.Health
+	ticker := time.NewTicker(p.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		err := p.check(s.spec.Name)
+		if err != nil {
+			log.Printf("health probe %v for %s failed: %v", p, s.spec.Name, err)
+		}
+		s.status.probed(err)
+	}
+}
+
+// mqttConfigFiles returns the mqttComponent config and secrets files of the
+// launcher, e.g. /perm/zigbee2mqtt/mqtt/secrets.json.
+func (spec Spec) mqttConfigFiles() (config, secrets string) {
+	dir := filepath.Join(permDir, spec.Name, "mqtt")
+	return filepath.Join(dir, "config.json"), filepath.Join(dir, "secrets.json")
+}
+
+// publishStatus announces the container's health, restart count, uptime and
+// OOM kills to Home Assistant, and forwards log lines matching the Logs
+// patterns. It is a no-op unless the launcher has an mqttComponent
+// configuration.
+func (s *supervisor) publishStatus() {
+	config, secrets := s.spec.mqttConfigFiles()
+	for _, f := range []string{config, secrets} {
+		if _, err := os.Stat(f); err != nil {
+			log.Printf("not publishing status of %s: %v", s.spec.Name, err)
+			return
+		}
+	}
+
+	// NewMqttController blocks until the broker is reachable, which for
+	// the mqtt launcher is only the case once its container runs.
+	mc := mqttComponent.NewMqttController(mqttComponent.MQTTConfig{
+		ConfigFile:  &config,
+		SecretsFile: &secrets,
+	})
+
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           fmt.Sprintf("%s problem", s.spec.Name),
+		ID:             s.spec.Name + "_problem",
+		DeviceClass:    "problem",
+		UpdateInterval: statusUpdateInterval,
+		State:          s.status.problem,
+	}.BinarySensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           fmt.Sprintf("%s restarts", s.spec.Name),
+		ID:             s.spec.Name + "_restarts",
+		StateClass:     "total_increasing",
+		Icon:           "mdi:restart",
+		UpdateInterval: statusUpdateInterval,
+		State:          s.status.restartCount,
+	}.Sensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           fmt.Sprintf("%s uptime", s.spec.Name),
+		ID:             s.spec.Name + "_uptime",
+		DeviceClass:    "duration",
+		Unit:           "s",
+		StateClass:     "measurement",
+		UpdateInterval: statusUpdateInterval,
+		State:          s.status.uptime,
+	}.Sensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           fmt.Sprintf("%s OOM kills", s.spec.Name),
+		ID:             s.spec.Name + "_oom_kills",
+		StateClass:     "total_increasing",
+		Icon:           "mdi:memory",
+		UpdateInterval: statusUpdateInterval,
+		State:          s.status.oomKillCount,
+	}.Sensor())
+	if s.spec.PublishStatus != nil {
+		s.spec.PublishStatus(mc)
+	}
+
+	event, err := mc.AddEvent(mqttComponent.Event{
+		Name:       fmt.Sprintf("%s OOM killed", s.spec.Name),
+		ID:         s.spec.Name + "_oom_killed",
+		Icon:       "mdi:memory",
+		EventTypes: []string{"oom_killed"},
+	})
+	if err != nil {
+		log.Printf("announcing OOM event of %s: %v", s.spec.Name, err)
+		return
+	}
+	s.status.mu.Lock()
+	s.status.event = event
+	s.status.mu.Unlock()
+	s.status.flushOOM()
+
+	logEvent, err := mc.AddEvent(mqttComponent.Event{
+		Name:       fmt.Sprintf("%s log", s.spec.Name),
+		ID:         s.spec.Name + "_log",
+		Icon:       "mdi:text-box-outline",
+		EventTypes: []string{"warning", "error"},
+	})
+	if err != nil {
+		log.Printf("announcing log event of %s: %v", s.spec.Name, err)
+		return
+	}
+	for l := range s.logLines {
+		err := logEvent.Fire(l.level, map[string]any{
+			"message": l.text,
+			"time":    l.time.UTC(),
+		})
+		if err != nil {
+			log.Printf("forwarding log line of %s: %v", s.spec.Name, err)
+		}
+	}
+}
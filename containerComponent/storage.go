@@ -0,0 +1,132 @@
+package containerComponent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	permDir          = "/perm"
+	containerStorage = "/perm/container-storage"
+	storageLock      = "/tmp/containerComponent-storage.lock"
+)
+
+// setupStorage prepares persistent storage for spec: it checks that /perm is
+// a writable file system, creates the host directories of spec's volumes and
+// bind-mounts /perm/container-storage to /var, where podman keeps its images.
+//
+// All launchers start at boot, so setupStorage holds an exclusive lock while
+// it inspects and changes mount state.
+func setupStorage(spec Spec) error {
+	lock, err := os.OpenFile(storageLock, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("locking %s: %v", storageLock, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+	perm, err := checkPerm(mounts)
+	if err != nil {
+		return err
+	}
+
+	if err := mkdirOwned(containerStorage, 0, 0); err != nil {
+		return err
+	}
+	for _, dir := range spec.hostDirs() {
+		if err := mkdirOwned(dir, spec.UID, spec.GID); err != nil {
+			return err
+		}
+	}
+
+	return mountVar(mounts, perm)
+}
+
+// checkPerm verifies that /perm is mounted read-write from a persistent file
+// system and returns its mount entry.
+func checkPerm(mounts []mountInfo) (mountInfo, error) {
+	perm, ok := findMount(mounts, permDir)
+	if !ok {
+		return perm, fmt.Errorf("%s is not mounted, refusing to put container data on the root file system", permDir)
+	}
+	switch perm.FSType {
+	case "tmpfs", "ramfs", "squashfs":
+		return perm, fmt.Errorf("%s is a %s, not a persistent file system", permDir, perm.FSType)
+	}
+	if perm.readOnly() {
+		return perm, fmt.Errorf("%s (%s) is mounted read-only", permDir, perm.Source)
+	}
+	f, err := os.CreateTemp(permDir, ".containerComponent-")
+	if err != nil {
+		return perm, fmt.Errorf("%s is not writable: %v", permDir, err)
+	}
+	f.Close()
+	return perm, os.Remove(f.Name())
+}
+
+// mountVar bind-mounts /perm/container-storage to /var unless that is already
+// the case.
+func mountVar(mounts []mountInfo, perm mountInfo) error {
+	wantRoot := filepath.Join(perm.Root, strings.TrimPrefix(containerStorage, permDir))
+	if m, ok := findMount(mounts, "/var"); ok {
+		if m.Major == perm.Major && m.Minor == perm.Minor && m.Root == wantRoot {
+			log.Printf("%s already mounted on /var", containerStorage)
+			return nil
+		}
+		log.Printf("/var is already mounted from %s (%s), leaving it alone", m.Source, m.FSType)
+		return nil
+	}
+
+	if err := syscall.Mount(containerStorage, "/var", "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("mounting %s to /var: %v", containerStorage, err)
+	}
+	log.Printf("mounted %s on /var", containerStorage)
+	return nil
+}
+
+// hostDirs returns the host side of spec's volumes that live below /perm.
+func (spec Spec) hostDirs() []string {
+	var dirs []string
+	for _, v := range spec.Volumes {
+		host, _, _ := strings.Cut(v, ":")
+		host = filepath.Clean(host)
+		if strings.HasPrefix(host, permDir+"/") {
+			dirs = append(dirs, host)
+		}
+	}
+	return dirs
+}
+
+// mkdirOwned creates dir and any missing parents below /perm, and chowns the
+// directories it created to uid:gid. Existing directories are left as they
+// are, as the container may have changed their ownership itself.
+func mkdirOwned(dir string, uid, gid int) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent != permDir && parent != "/" {
+		if err := mkdirOwned(parent, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return err
+	}
+	log.Printf("created %s (owner %d:%d)", dir, uid, gid)
+	return nil
+}
@@ -0,0 +1,301 @@
+package containerComponent
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStopTimeout = 10 * time.Second
+	healthPollInterval = 5 * time.Second
+)
+
+// ExitError is returned by Run when the container exited with a non-zero code.
+type ExitError struct {
+	Name string
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("container %s exited with code %d", e.Name, e.Code)
+}
+
+// Main runs spec and exits with the container's exit code, so that gokrazy's
+// restart and backoff logic applies to the container. The -config flag
+// overrides spec.ConfigFile.
+func Main(spec Spec) {
+	config := flag.String("config",
+		spec.configFile(),
+		"path to a JSON file whose settings are merged on top of the built-in container spec")
+	flag.Parse()
+	spec.ConfigFile = *config
+
+	err := Run(spec)
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		log.Print(err)
+		os.Exit(exitErr.Code)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// stopReason records why the supervisor stopped a container itself.
+type stopReason int
+
+const (
+	stopNone stopReason = iota
+	stopSignal
+	stopUpdate
+	stopRollback
+)
+
+type supervisor struct {
+	spec  Spec
+	state launcherState
+	sigs  chan os.Signal
+
+	// running is the ID of the image the current container was started from.
+	running string
+	status  status
+
+	logs *logSink
+	// logLines are output lines to be published by publishStatus.
+	logLines chan logLine
+}
+
+func newSupervisor(spec Spec) *supervisor {
+	s := &supervisor{
+		spec:  spec,
+		state: loadState(spec.Name),
+		sigs:  make(chan os.Signal, 1),
+
+		logLines: make(chan logLine, logForwardLimit),
+	}
+	s.logs = newLogSink(spec, s.logLines)
+	s.status.oomKills = s.state.OOMKills
+	s.status.pendingOOM = s.state.UnreportedOOM
+	signal.Notify(s.sigs, syscall.SIGTERM, syscall.SIGINT)
+	return s
+}
+
+func (s *supervisor) close() {
+	signal.Stop(s.sigs)
+	if err := s.logs.close(); err != nil {
+		log.Print(err)
+	}
+}
+
+// supervise runs image in the foreground until the container exits. If
+// previous is non-empty, image was just pulled and previous is the image
+// ID to fall back to should image not become healthy.
+func (s *supervisor) supervise(image, previous string) error {
+	for {
+		started := time.Now()
+		reason, err := s.runOnce(image, previous != "")
+		if reason == stopNone && previous != "" && time.Since(started) < s.spec.Update.healthTimeout() {
+			log.Printf("container %s exited shortly after an image update: %v", s.spec.Name, err)
+			reason = stopRollback
+		}
+
+		switch reason {
+		case stopUpdate:
+			previous = s.running
+			s.remove()
+			image = s.spec.imageRef()
+
+		case stopRollback:
+			if previous == "" {
+				return err
+			}
+			bad := s.running
+			log.Printf("rolling back container %s from image %s to %s", s.spec.Name, shortID(bad), shortID(previous))
+			s.state.Bad = bad
+			if err := s.state.save(s.spec.Name); err != nil {
+				log.Print(err)
+			}
+			s.retag(previous)
+			s.remove()
+			image, previous = previous, ""
+
+		default:
+			return err
+		}
+	}
+}
+
+// runOnce starts the container and waits for it to exit. SIGTERM and SIGINT
+// are translated into podman stop, so the container gets its grace period
+// instead of being killed along with the launcher.
+func (s *supervisor) runOnce(image string, candidate bool) (stopReason, error) {
+	s.running = imageID(image)
+	podman := podmanCommand(s.spec.runArgs(image)...)
+	// Container output goes to the gokrazy log as before, and to the log
+	// file and MQTT.
+	podman.Stdout = s.logs.writer(os.Stdout)
+	podman.Stderr = s.logs.writer(os.Stderr)
+	// Signals meant for the launcher must not reach podman directly.
+	podman.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	log.Printf("starting %v", podman.Args)
+	if err := podman.Start(); err != nil {
+		return stopNone, fmt.Errorf("%v: %v", podman.Args, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- podman.Wait() }()
+
+	s.state.countStart()
+	s.state.UnreportedOOM = s.status.unreportedOOM()
+	if err := s.state.save(s.spec.Name); err != nil {
+		log.Print(err)
+	}
+	s.status.started(s.state.Restarts)
+	defer s.status.exited()
+
+	exited := make(chan struct{})
+	defer close(exited)
+
+	if s.spec.Health != nil {
+		go s.probe(exited)
+	}
+
+	unhealthy := make(chan error, 1)
+	if candidate {
+		go s.watchCandidate(exited, unhealthy)
+	}
+
+	var tick <-chan time.Time
+	if s.spec.Update.Mode == UpdateInterval && s.spec.Build == nil {
+		ticker := time.NewTicker(s.spec.Update.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	updated := make(chan bool, 1)
+
+	reason := stopNone
+	for {
+		select {
+		case sig := <-s.sigs:
+			log.Printf("received %v, stopping container %s", sig, s.spec.Name)
+			reason = stopSignal
+			go s.stop()
+
+		case err := <-unhealthy:
+			if reason == stopNone {
+				log.Printf("container %s did not become healthy: %v", s.spec.Name, err)
+				reason = stopRollback
+				go s.stop()
+			}
+
+		case <-tick:
+			go func() {
+				id, err := s.pull(s.running)
+				if err != nil {
+					log.Printf("update check for %s: %v", s.spec.Name, err)
+				}
+				select {
+				case updated <- id != "" && id != s.running:
+				case <-exited:
+				}
+			}()
+
+		case u := <-updated:
+			if u && reason == stopNone {
+				log.Printf("new image for %s, restarting", s.spec.Name)
+				reason = stopUpdate
+				go s.stop()
+			}
+
+		case err := <-done:
+			s.checkOOM()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return reason, &ExitError{Name: s.spec.Name, Code: exitErr.ExitCode()}
+			}
+			if err != nil {
+				return reason, fmt.Errorf("%v: %v", podman.Args, err)
+			}
+			log.Printf("container %s exited", s.spec.Name)
+			return reason, nil
+		}
+	}
+}
+
+// watchCandidate checks a container that was started from a newly pulled
+// image until its health timeout expires, and reports on unhealthy if the
+// container stopped running or failed its health probe or healthcheck.
+func (s *supervisor) watchCandidate(exited <-chan struct{}, unhealthy chan<- error) {
+	deadline := time.Now().Add(s.spec.Update.healthTimeout())
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		inspect, err := inspectContainer(s.spec.Name)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		status := inspect.healthStatus()
+		if !inspect.State.Running {
+			unhealthy <- fmt.Errorf("not running")
+			return
+		}
+		if status == "unhealthy" {
+			unhealthy <- fmt.Errorf("healthcheck reports %s", status)
+			return
+		}
+
+		var probeErr error
+		if s.spec.Health != nil {
+			if probeErr = s.spec.Health.check(s.spec.Name); probeErr == nil {
+				log.Printf("container %s passed health probe %v", s.spec.Name, s.spec.Health)
+				return
+			}
+		} else if status == "healthy" {
+			log.Printf("container %s is healthy", s.spec.Name)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			switch {
+			case probeErr != nil:
+				unhealthy <- fmt.Errorf("health probe %v: %v", s.spec.Health, probeErr)
+			case status != "":
+				unhealthy <- fmt.Errorf("healthcheck still %s after %v", status, s.spec.Update.healthTimeout())
+			default:
+				log.Printf("container %s is still running after %v", s.spec.Name, s.spec.Update.healthTimeout())
+			}
+			return
+		}
+	}
+}
+
+func (s *supervisor) stop() {
+	timeout := s.spec.StopTimeout
+	if timeout == 0 {
+		timeout = defaultStopTimeout
+	}
+	secs := strconv.Itoa(int(timeout.Round(time.Second) / time.Second))
+	if err := podman("stop", "-t", secs, s.spec.Name); err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *supervisor) remove() {
+	if err := podman("rm", "--force", s.spec.Name); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,118 @@
+package containerComponent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// UpdateMode selects when an image is pulled from its registry.
+type UpdateMode string
+
+const (
+	// UpdateNever runs whatever image is in the local storage. podman still
+	// pulls the image if it is missing entirely.
+	UpdateNever UpdateMode = "never"
+	// UpdateOnBoot pulls the image once when the launcher starts.
+	UpdateOnBoot UpdateMode = "on-boot"
+	// UpdateInterval pulls on start and then every UpdatePolicy.Interval,
+	// restarting the container when a new image arrived.
+	UpdateInterval UpdateMode = "interval"
+)
+
+const defaultHealthTimeout = 2 * time.Minute
+
+// UpdatePolicy controls how a Spec's image is kept up to date.
+type UpdatePolicy struct {
+	// Mode defaults to UpdateNever.
+	Mode     UpdateMode
+	Interval time.Duration
+	// Digest pins the image, e.g. "sha256:0123…". Image is then run as
+	// Image@Digest and pulls never move it to a different image.
+	Digest string
+	// HealthTimeout is how long a container started from a newly pulled
+	// image has to prove itself healthy. If it exits or turns unhealthy
+	// within that time, the previous image is started again. Defaults to
+	// two minutes.
+	HealthTimeout time.Duration
+}
+
+func (p UpdatePolicy) healthTimeout() time.Duration {
+	if p.HealthTimeout == 0 {
+		return defaultHealthTimeout
+	}
+	return p.HealthTimeout
+}
+
+func (p UpdatePolicy) validate() error {
+	switch p.Mode {
+	case "", UpdateNever, UpdateOnBoot:
+	case UpdateInterval:
+		if p.Interval <= 0 {
+			return fmt.Errorf("update mode %q needs a positive interval", p.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown update mode %q", p.Mode)
+	}
+	if p.Digest != "" && !strings.Contains(p.Digest, ":") {
+		return fmt.Errorf("digest %q is not of the form algorithm:hex", p.Digest)
+	}
+	return nil
+}
+
+// imageRef returns the reference under which spec's image is pulled and run.
+func (spec Spec) imageRef() string {
+	if spec.Update.Digest == "" {
+		return spec.Image
+	}
+	return spec.Image + "@" + spec.Update.Digest
+}
+
+// imageID returns the ID of the local image ref, or "" if there is none.
+func imageID(ref string) string {
+	podman := podmanCommand("image", "inspect", "--format", "{{.Id}}", ref)
+	var stdout bytes.Buffer
+	podman.Stdout = &stdout
+	if err := podman.Run(); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout.String())
+}
+
+// pull fetches spec's image and returns the resulting local image ID. An
+// image that was rolled back before is not rolled out again: pull then
+// returns the ID of the image that is currently in use.
+func (s *supervisor) pull(current string) (string, error) {
+	ref := s.spec.imageRef()
+	if err := podman("pull", ref); err != nil {
+		return current, err
+	}
+	id := imageID(ref)
+	if id != "" && id == s.state.Bad && current != "" {
+		log.Printf("image %s (%s) was rolled back before, staying on %s", ref, shortID(id), shortID(current))
+		s.retag(current)
+		return current, nil
+	}
+	return id, nil
+}
+
+// retag points spec's image tag back to id, so that a plain podman run of the
+// tag does not pick up a rolled back image. Digest references cannot be
+// retagged and are left alone.
+func (s *supervisor) retag(id string) {
+	if s.spec.Update.Digest != "" {
+		return
+	}
+	if err := podman("tag", id, s.spec.Image); err != nil {
+		log.Print(err)
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/alf632/gokrazy-ha/containerComponent"
 	"github.com/alf632/gokrazy-ha/mqttComponent"
 )
 
@@ -19,6 +20,7 @@ func main() {
 	configFile := flag.String("config", "/perm/nextion/config.json", "path to config file")
 	secretsFile := flag.String("secrets", "/perm/nextion/secrets.json", "path to secrets file")
 	serialPort := flag.String("port", "/dev/ttyS0", "path to tty interface")
+	broker := flag.String("broker", "localhost:1883", "TCP address of the MQTT broker to wait for before connecting, empty to not wait")
 	flag.Parse()
 	config := Config{
 		MQTT: mqttComponent.MQTTConfig{
@@ -34,6 +36,12 @@ func main() {
 				log.Fatal(err)
 			}
 		}*/
+	if *broker != "" {
+		if err := containerComponent.WaitFor(containerComponent.Dependency{TCP: *broker}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	nc := NewNextionController(NewSerialController(config), mqttComponent.NewMqttController(config.MQTT))
 	defer nc.mc.Stop()
 	defer nc.sc.stop()
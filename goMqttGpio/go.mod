@@ -5,18 +5,30 @@ go 1.21.1
 require github.com/racerxdl/go-mcp23017 v0.0.0-20200119181255-c8f9b9777b0e
 
 require (
+	github.com/gokrazy/gokrazy v0.0.0-20230731075250-64a92c26fe45 // indirect
+	github.com/gokrazy/internal v0.0.0-20220129150711-9ed298107648 // indirect
+	github.com/google/renameio/v2 v2.0.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/iancoleman/strcase v0.2.0 // indirect
+	github.com/kenshaw/evdev v0.1.0 // indirect
+	github.com/mdlayher/watchdog v0.0.0-20201005150459-8bdc4f41966b // indirect
 	golang.org/x/net v0.9.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.7.0 // indirect
 )
 
 require (
-	dario.cat/mergo v1.0.0
+	dario.cat/mergo v1.0.0 // indirect
 	github.com/W-Floyd/ha-mqtt-iot v0.0.0-20230406181311-8b8c6bf30434
-	github.com/denisbrodbeck/machineid v1.0.1
+	github.com/alf632/gokrazy-ha/containerComponent v0.0.0-00010101000000-000000000000
+	github.com/alf632/gokrazy-ha/mqttComponent v0.0.0-00010101000000-000000000000
+	github.com/denisbrodbeck/machineid v1.0.1 // indirect
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/logrusorgru/aurora v0.0.0-20181002194514-a7b3b318ed4e // indirect
+	github.com/plus3it/gorecurcopy v0.0.1
 	github.com/quan-to/slog v0.0.0-20190414172229-8bce0937f2c1 // indirect
 )
+
+replace github.com/alf632/gokrazy-ha/containerComponent => ../containerComponent
+
+replace github.com/alf632/gokrazy-ha/mqttComponent => ../mqttComponent
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/alf632/gokrazy-ha/containerComponent"
 	"github.com/alf632/gokrazy-ha/mqttComponent"
 	"github.com/plus3it/gorecurcopy"
 	"github.com/racerxdl/go-mcp23017"
@@ -15,6 +16,7 @@ import (
 func main() {
 	configFile := flag.String("config", "/perm/goMqttGpio/config.json", "path to config file")
 	secretsFile := flag.String("secrets", "/perm/goMqttGpio/secrets.json", "path to secrets file")
+	broker := flag.String("broker", "localhost:1883", "TCP address of the MQTT broker to wait for before connecting, empty to not wait")
 	flag.Parse()
 	config := mqttComponent.MQTTConfig{
 		ConfigFile:  configFile,
@@ -34,6 +36,12 @@ func main() {
 	}
 	defer d.Close()
 
+	if *broker != "" {
+		if err := containerComponent.WaitFor(containerComponent.Dependency{TCP: *broker}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.Println("initializing mqtt controller")
 	mqttc := mqttComponent.NewMqttController(config)
 	defer mqttc.Stop()
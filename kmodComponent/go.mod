@@ -0,0 +1,5 @@
+module github.com/alf632/gokrazy-ha/kmodComponent
+
+go 1.21.1
+
+require golang.org/x/sys v0.7.0
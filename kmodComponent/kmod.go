@@ -0,0 +1,383 @@
+// Package kmodComponent loads kernel modules the way modprobe does, which
+// gokrazy does not ship: modules are looked up in modules.dep and
+// modules.alias of the running kernel and loaded after their dependencies.
+//
+// Drivers for hotplugged devices, e.g. USB WiFi or Bluetooth dongles, are
+// found by matching the modalias files in sysfs against modules.alias.
+package kmodComponent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Loader loads the modules of one kernel release. Its fields can point to a
+// fixture tree, so that resolution can be tested without a kernel.
+type Loader struct {
+	// Dir is the module directory containing modules.dep, e.g.
+	// /lib/modules/6.1.21-v8+.
+	Dir string
+	// Sysfs is the sysfs mount point, /sys by default.
+	Sysfs string
+	// Params holds module parameters by module name, e.g.
+	// {"brcmfmac": "roamoff=1 feature_disable=0x82000"}.
+	Params map[string]string
+	// Init loads a module file with parameters. It defaults to
+	// finit_module(2).
+	Init func(f *os.File, params string) error
+
+	once sync.Once
+	err  error
+	// paths maps module names to their path relative to Dir.
+	paths map[string]string
+	// deps maps a module path to the paths it depends on, in the order
+	// of modules.dep.
+	deps    map[string][]string
+	aliases []alias
+	builtin map[string]bool
+
+	mu     sync.Mutex
+	loaded map[string]bool
+}
+
+type alias struct {
+	pattern string
+	module  string
+}
+
+// Release returns the release of the running kernel, e.g. 6.1.21-v8+.
+func Release() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+	return string(uts.Release[:bytes.IndexByte(uts.Release[:], 0)]), nil
+}
+
+// New returns a Loader for the running kernel.
+func New() (*Loader, error) {
+	release, err := Release()
+	if err != nil {
+		return nil, err
+	}
+	return &Loader{Dir: filepath.Join("/lib/modules", release)}, nil
+}
+
+// Name normalizes a module name or path the way the kernel does: brcmfmac-wcc
+// and kernel/.../brcmfmac-wcc.ko are both brcmfmac_wcc.
+func Name(mod string) string {
+	name := path.Base(mod)
+	if i := strings.Index(name, ".ko"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+func (l *Loader) sysfs() string {
+	if l.Sysfs == "" {
+		return "/sys"
+	}
+	return l.Sysfs
+}
+
+func (l *Loader) index() error {
+	l.once.Do(func() {
+		l.paths = make(map[string]string)
+		l.deps = make(map[string][]string)
+		l.builtin = make(map[string]bool)
+		l.loaded = make(map[string]bool)
+		if l.err = l.readDep(); l.err != nil {
+			return
+		}
+		if l.err = l.readAlias(); l.err != nil {
+			return
+		}
+		l.err = l.readBuiltin()
+	})
+	return l.err
+}
+
+// readDep parses lines like
+//
+//	kernel/.../brcmfmac.ko: kernel/.../brcmutil.ko kernel/.../cfg80211.ko
+func (l *Loader) readDep() error {
+	return l.readLines("modules.dep", func(line string) error {
+		mod, deps, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("missing colon")
+		}
+		l.paths[Name(mod)] = mod
+		l.deps[mod] = strings.Fields(deps)
+		return nil
+	})
+}
+
+// readAlias parses lines like
+//
+//	alias usb:v0BDAp8179d*dc*dsc*dp*ic*isc*ip*in* r8188eu
+func (l *Loader) readAlias() error {
+	err := l.readLines("modules.alias", func(line string) error {
+		f := strings.Fields(line)
+		if len(f) != 3 || f[0] != "alias" {
+			return fmt.Errorf("malformed alias")
+		}
+		l.aliases = append(l.aliases, alias{pattern: f[1], module: Name(f[2])})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *Loader) readBuiltin() error {
+	err := l.readLines("modules.builtin", func(line string) error {
+		l.builtin[Name(line)] = true
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *Loader) readLines(name string, parse func(line string) error) error {
+	f, err := os.Open(filepath.Join(l.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", f.Name(), n, err)
+		}
+	}
+	return s.Err()
+}
+
+// Resolve returns the paths, relative to Dir, of the modules that have to be
+// loaded for module name, dependencies first. Built-in modules resolve to
+// nothing. Unknown modules yield an error wrapping fs.ErrNotExist.
+func (l *Loader) Resolve(name string) ([]string, error) {
+	if err := l.index(); err != nil {
+		return nil, err
+	}
+	name = Name(name)
+	if l.builtin[name] {
+		return nil, nil
+	}
+	mod, ok := l.paths[name]
+	if !ok {
+		return nil, fmt.Errorf("module %s: %w", name, fs.ErrNotExist)
+	}
+	// modules.dep lists the dependencies such that loading them in reverse
+	// order satisfies their own dependencies, as modprobe does.
+	deps := l.deps[mod]
+	order := make([]string, 0, len(deps)+1)
+	for i := len(deps) - 1; i >= 0; i-- {
+		order = append(order, deps[i])
+	}
+	return append(order, mod), nil
+}
+
+// Lookup returns the names of the modules whose aliases match modalias, e.g.
+// usb:v0BDAp8179d0000dc00dsc00dp00icFFiscFFipFFin00.
+func (l *Loader) Lookup(modalias string) ([]string, error) {
+	if err := l.index(); err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, a := range l.aliases {
+		if seen[a.module] {
+			continue
+		}
+		if ok, _ := path.Match(a.pattern, modalias); ok {
+			seen[a.module] = true
+			names = append(names, a.module)
+		}
+	}
+	return names, nil
+}
+
+// Load loads module name, which is a module name or an alias, together with
+// its dependencies. Modules that are loaded already are skipped.
+func (l *Loader) Load(name string) error {
+	if err := l.index(); err != nil {
+		return err
+	}
+	if _, ok := l.paths[Name(name)]; !ok && !l.builtin[Name(name)] {
+		names, err := l.Lookup(name)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("module %s: %w", name, fs.ErrNotExist)
+		}
+		for _, n := range names {
+			if err := l.Load(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	mods, err := l.Resolve(name)
+	if err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		if err := l.insert(mod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadDevices loads the drivers of all devices in sysfs, as udev does for
+// the devices present at boot. Only modules below one of the dirs relative to
+// Dir are considered, e.g. kernel/drivers/net/wireless, so that a service
+// only loads the drivers it is responsible for. It returns the names of the
+// modules that matched. Calling it again picks up hotplugged devices.
+func (l *Loader) LoadDevices(dirs ...string) ([]string, error) {
+	if err := l.index(); err != nil {
+		return nil, err
+	}
+	modaliases, err := l.modaliases()
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	seen := make(map[string]bool)
+	for _, ma := range modaliases {
+		names, err := l.Lookup(ma)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if seen[name] || !l.below(name, dirs) {
+				continue
+			}
+			seen[name] = true
+			matched = append(matched, name)
+		}
+	}
+	sort.Strings(matched)
+	var errs []string
+	for _, name := range matched {
+		if err := l.Load(name); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return matched, fmt.Errorf("loading device drivers: %s", strings.Join(errs, "; "))
+	}
+	return matched, nil
+}
+
+func (l *Loader) below(name string, dirs []string) bool {
+	mod, ok := l.paths[name]
+	if !ok {
+		return false
+	}
+	if len(dirs) == 0 {
+		return true
+	}
+	for _, dir := range dirs {
+		if strings.HasPrefix(mod, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// modaliases returns the contents of all modalias files below
+// <Sysfs>/devices.
+func (l *Loader) modaliases() ([]string, error) {
+	var modaliases []string
+	root := filepath.Join(l.sysfs(), "devices")
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Devices can disappear while walking.
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Name() != "modalias" || !d.Type().IsRegular() {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		if ma := strings.TrimSpace(string(b)); ma != "" {
+			modaliases = append(modaliases, ma)
+		}
+		return nil
+	})
+	return modaliases, err
+}
+
+// insert loads the module at mod, relative to Dir, unless it is loaded
+// already.
+func (l *Loader) insert(mod string) error {
+	name := Name(mod)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.loaded[name] {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(l.sysfs(), "module", name)); err == nil {
+		l.loaded[name] = true
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(l.Dir, mod))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	init := l.Init
+	if init == nil {
+		init = finitModule
+	}
+	if err := init(f, l.Params[name]); err != nil {
+		return fmt.Errorf("loading %s: %v", name, err)
+	}
+	log.Printf("modprobe %v", name)
+	l.loaded[name] = true
+	return nil
+}
+
+// finitModule loads f. Modules that are loaded already, or that do not find
+// their device, are not an error.
+func finitModule(f *os.File, params string) error {
+	flags := 0
+	switch filepath.Ext(f.Name()) {
+	case ".xz", ".gz", ".zst":
+		flags |= unix.MODULE_INIT_COMPRESSED_FILE
+	}
+	err := unix.FinitModule(int(f.Fd()), params, flags)
+	switch err {
+	case nil, unix.EEXIST, unix.EBUSY, unix.ENODEV, unix.ENOENT:
+		return nil
+	}
+	return err
+}
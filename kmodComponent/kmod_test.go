@@ -0,0 +1,193 @@
+package kmodComponent
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const (
+	rfkill   = "kernel/net/rfkill/rfkill.ko"
+	cfg80211 = "kernel/net/wireless/cfg80211.ko"
+	brcmutil = "kernel/drivers/net/wireless/broadcom/brcm80211/brcmutil/brcmutil.ko"
+	brcmfmac = "kernel/drivers/net/wireless/broadcom/brcm80211/brcmfmac/brcmfmac.ko"
+	wcc      = "kernel/drivers/net/wireless/broadcom/brcm80211/brcmfmac/wcc/brcmfmac-wcc.ko"
+)
+
+// fixture returns a Loader for the tree in testdata, which records the
+// modules it loads instead of loading them. rfkill is loaded already
+// according to testdata/sys/module.
+func fixture() (*Loader, *[]string) {
+	var inits []string
+	l := &Loader{
+		Dir:    "testdata",
+		Sysfs:  "testdata/sys",
+		Params: map[string]string{"brcmfmac": "roamoff=1"},
+		Init: func(f *os.File, params string) error {
+			name := Name(f.Name())
+			if params != "" {
+				name += " " + params
+			}
+			inits = append(inits, name)
+			return nil
+		},
+	}
+	return l, &inits
+}
+
+func TestName(t *testing.T) {
+	for in, want := range map[string]string{
+		"brcmfmac":     "brcmfmac",
+		"brcmfmac-wcc": "brcmfmac_wcc",
+		wcc:            "brcmfmac_wcc",
+		"btusb.ko.xz":  "btusb",
+	} {
+		if got := Name(in); got != want {
+			t.Errorf("Name(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		want    []string
+		wantErr error
+	}{
+		{name: "rfkill", want: []string{rfkill}},
+		// modules.dep lists brcmutil cfg80211 rfkill, which load in
+		// reverse.
+		{name: "brcmfmac", want: []string{rfkill, cfg80211, brcmutil, brcmfmac}},
+		{name: "brcmfmac-wcc", want: []string{rfkill, cfg80211, brcmutil, brcmfmac, wcc}},
+		{name: "brcmfmac_wcc", want: []string{rfkill, cfg80211, brcmutil, brcmfmac, wcc}},
+		{name: "ipv6"},
+		{name: "usbcore"},
+		{name: "nonexistent", wantErr: fs.ErrNotExist},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, _ := fixture()
+			got, err := l.Resolve(tc.name)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Resolve(%q) error = %v, want %v", tc.name, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Resolve(%q) = %q, want %q", tc.name, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, tc := range []struct {
+		modalias string
+		want     []string
+	}{
+		{modalias: "usb:v0BDAp8179d0000dc00dsc00dp00icFFiscFFipFFin00", want: []string{"rtl8xxxu"}},
+		{modalias: "usb:v0A12p0001d8891dcE0dsc01dp01icE0isc01ip01in00", want: []string{"btusb"}},
+		{modalias: "sdio:c00v02D0d4345", want: []string{"brcmfmac"}},
+		{modalias: "of:NwifiT(null)Cbrcm,bcm4329-fmacCbrcm,bcm4345-fmac", want: []string{"brcmfmac"}},
+		{modalias: "net-pf-31", want: []string{"bluetooth"}},
+		{modalias: "usb:v0BDAp8178d0000dc00dsc00dp00icFFiscFFipFFin00"},
+	} {
+		l, _ := fixture()
+		got, err := l.Lookup(tc.modalias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Lookup(%q) = %q, want %q", tc.modalias, got, tc.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		load    []string
+		want    []string
+		wantErr error
+	}{
+		// rfkill is in sysfs already and skipped.
+		{name: "dependencies first", load: []string{"brcmfmac"}, want: []string{"cfg80211", "brcmutil", "brcmfmac roamoff=1"}},
+		{name: "loaded once", load: []string{"brcmfmac", "brcmfmac-wcc", "brcmfmac"}, want: []string{"cfg80211", "brcmutil", "brcmfmac roamoff=1", "brcmfmac_wcc"}},
+		{name: "alias", load: []string{"net-pf-31"}, want: []string{"bluetooth"}},
+		{name: "modalias", load: []string{"usb:v0A12p0001d8891dcE0dsc01dp01icE0isc01ip01in00"}, want: []string{"bluetooth", "btusb"}},
+		{name: "in sysfs", load: []string{"rfkill"}},
+		{name: "builtin", load: []string{"ipv6"}},
+		{name: "unknown", load: []string{"nonexistent"}, wantErr: fs.ErrNotExist},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, inits := fixture()
+			var err error
+			for _, name := range tc.load {
+				if err = l.Load(name); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Load(%q) error = %v, want %v", tc.load, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(*inits, tc.want) {
+				t.Errorf("Load(%q) loaded %q, want %q", tc.load, *inits, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		dirs        []string
+		wantMatched []string
+		wantLoaded  []string
+	}{
+		{
+			name:        "all",
+			wantMatched: []string{"brcmfmac", "btusb", "rtl8xxxu"},
+			wantLoaded:  []string{"cfg80211", "brcmutil", "brcmfmac roamoff=1", "bluetooth", "btusb", "mac80211", "rtl8xxxu"},
+		},
+		{
+			name:        "wireless",
+			dirs:        []string{"kernel/drivers/net/wireless/"},
+			wantMatched: []string{"brcmfmac", "rtl8xxxu"},
+			wantLoaded:  []string{"cfg80211", "brcmutil", "brcmfmac roamoff=1", "mac80211", "rtl8xxxu"},
+		},
+		{
+			name:        "bluetooth",
+			dirs:        []string{"kernel/drivers/bluetooth"},
+			wantMatched: []string{"btusb"},
+			wantLoaded:  []string{"bluetooth", "btusb"},
+		},
+		{
+			// A prefix of a directory name is not the directory.
+			name: "prefix",
+			dirs: []string{"kernel/drivers/blue"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, inits := fixture()
+			matched, err := l.LoadDevices(tc.dirs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(matched, tc.wantMatched) {
+				t.Errorf("LoadDevices(%q) matched %q, want %q", tc.dirs, matched, tc.wantMatched)
+			}
+			if !reflect.DeepEqual(*inits, tc.wantLoaded) {
+				t.Errorf("LoadDevices(%q) loaded %q, want %q", tc.dirs, *inits, tc.wantLoaded)
+			}
+
+			// Nothing is loaded twice when looking for hotplugged
+			// devices again.
+			n := len(*inits)
+			if _, err := l.LoadDevices(tc.dirs...); err != nil {
+				t.Fatal(err)
+			}
+			if len(*inits) != n {
+				t.Errorf("second LoadDevices(%q) loaded %q", tc.dirs, (*inits)[n:])
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Broker is the format of /perm/mqtt/broker.json, from which the mosquitto
+// configuration, password file and ACL file are generated:
+//
+//	{
+//	  "listeners": [
+//	    {"port": 1883},
+//	    {"port": 8883, "tls": {"cert": "certs/server.crt", "key": "certs/server.key"}},
+//	    {"port": 9001, "protocol": "websockets"}
+//	  ],
+//	  "users": [
+//	    {"name": "relay", "password": "…", "secrets": "/perm/goMqttGpio/secrets.json",
+//	     "acl": [{"topic": "gpio1/#", "access": "readwrite"}]}
+//	  ],
+//	  "bridges": [
+//	    {"name": "cloud", "address": "broker.example.com:8883", "tls": {"ca": "certs/ca.crt"},
+//	     "topics": [{"pattern": "van/#", "direction": "out", "qos": 1}]}
+//	  ]
+//	}
+//
+// File paths are relative to /perm/mqtt/config.
+type Broker struct {
+	// Mode is "mosquitto" (the default), which runs eclipse-mosquitto with
+	// podman, or "embedded", which runs a broker inside the launcher. The
+	// embedded broker needs no container runtime but does not support
+	// bridges.
+	Mode string `json:"mode,omitempty"`
+	// AllowAnonymous permits clients without credentials. They get the
+	// permissions in AnonymousACL.
+	AllowAnonymous bool       `json:"allow_anonymous"`
+	AnonymousACL   []ACL      `json:"anonymous_acl,omitempty"`
+	Listeners      []Listener `json:"listeners"`
+	Users          []User     `json:"users"`
+	Bridges        []Bridge   `json:"bridges,omitempty"`
+}
+
+type Listener struct {
+	Port int `json:"port"`
+	// Bind restricts the listener to one address, e.g. "127.0.0.1".
+	Bind string `json:"bind,omitempty"`
+	// Protocol is "mqtt" (the default) or "websockets".
+	Protocol string `json:"protocol,omitempty"`
+	TLS      *TLS   `json:"tls,omitempty"`
+}
+
+type TLS struct {
+	CA   string `json:"ca,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// RequireCertificate makes clients authenticate with a certificate
+	// signed by CA.
+	RequireCertificate bool `json:"require_certificate,omitempty"`
+}
+
+type User struct {
+	Name string `json:"name"`
+	// Password is hashed into the password file. PasswordHash can be given
+	// instead, in mosquitto_passwd's format.
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	ACL          []ACL  `json:"acl"`
+	// Secrets is an mqttComponent secrets file whose username and password
+	// are kept in sync with this user, e.g. /perm/goMqttGpio/secrets.json.
+	Secrets string `json:"secrets,omitempty"`
+}
+
+// ACL grants access to a topic filter.
+type ACL struct {
+	Topic string `json:"topic"`
+	// Access is "read", "write", "readwrite" or "deny".
+	Access string `json:"access"`
+	// Pattern allows %u and %c substitutions in Topic.
+	Pattern bool `json:"pattern,omitempty"`
+}
+
+type Bridge struct {
+	Name string `json:"name"`
+	// Address is the remote broker's host:port.
+	Address        string        `json:"address"`
+	Topics         []BridgeTopic `json:"topics"`
+	RemoteUsername string        `json:"remote_username,omitempty"`
+	RemotePassword string        `json:"remote_password,omitempty"`
+	RemoteClientID string        `json:"remote_clientid,omitempty"`
+	TLS            *TLS          `json:"tls,omitempty"`
+}
+
+type BridgeTopic struct {
+	Pattern string `json:"pattern"`
+	// Direction is "in", "out" or "both".
+	Direction    string `json:"direction"`
+	QoS          int    `json:"qos"`
+	LocalPrefix  string `json:"local_prefix,omitempty"`
+	RemotePrefix string `json:"remote_prefix,omitempty"`
+}
+
+// watchInterval is how often brokerFile is checked for changes.
+const watchInterval = 10 * time.Second
+
+const (
+	modeMosquitto = "mosquitto"
+	modeEmbedded  = "embedded"
+)
+
+// validName matches names that can be used in mosquitto's config and
+// password files without quoting.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func (b *Broker) validate() error {
+	switch b.Mode {
+	case "", modeMosquitto, modeEmbedded:
+	default:
+		return fmt.Errorf("unknown mode %q, want %q or %q", b.Mode, modeMosquitto, modeEmbedded)
+	}
+	if len(b.Listeners) == 0 {
+		return fmt.Errorf("no listeners configured")
+	}
+	ports := make(map[string]bool)
+	for _, l := range b.Listeners {
+		if l.Port < 1 || l.Port > 65535 {
+			return fmt.Errorf("listener: invalid port %d", l.Port)
+		}
+		if l.Bind != "" && net.ParseIP(l.Bind) == nil {
+			return fmt.Errorf("listener %d: bind %q is not an IP address", l.Port, l.Bind)
+		}
+		key := net.JoinHostPort(l.Bind, fmt.Sprint(l.Port))
+		if ports[key] {
+			return fmt.Errorf("listener %s configured twice", key)
+		}
+		ports[key] = true
+		switch l.Protocol {
+		case "", "mqtt", "websockets":
+		default:
+			return fmt.Errorf("listener %d: unknown protocol %q", l.Port, l.Protocol)
+		}
+		if l.TLS != nil && (l.TLS.Cert == "" || l.TLS.Key == "") {
+			return fmt.Errorf("listener %d: tls needs cert and key", l.Port)
+		}
+		if l.TLS != nil && l.TLS.RequireCertificate && l.TLS.CA == "" {
+			return fmt.Errorf("listener %d: require_certificate needs a ca", l.Port)
+		}
+	}
+	if err := validateACLs(b.AnonymousACL); err != nil {
+		return fmt.Errorf("anonymous_acl: %v", err)
+	}
+	users := make(map[string]bool)
+	for _, u := range b.Users {
+		if !validName.MatchString(u.Name) {
+			return fmt.Errorf("user %q: invalid name", u.Name)
+		}
+		if users[u.Name] {
+			return fmt.Errorf("user %s configured twice", u.Name)
+		}
+		users[u.Name] = true
+		if (u.Password == "") == (u.PasswordHash == "") {
+			return fmt.Errorf("user %s: needs exactly one of password or password_hash", u.Name)
+		}
+		if u.Secrets != "" && u.Password == "" {
+			return fmt.Errorf("user %s: secrets needs a plain password", u.Name)
+		}
+		if err := validateACLs(u.ACL); err != nil {
+			return fmt.Errorf("user %s: %v", u.Name, err)
+		}
+	}
+	bridges := make(map[string]bool)
+	for _, br := range b.Bridges {
+		if !validName.MatchString(br.Name) {
+			return fmt.Errorf("bridge %q: invalid name", br.Name)
+		}
+		if bridges[br.Name] {
+			return fmt.Errorf("bridge %s configured twice", br.Name)
+		}
+		bridges[br.Name] = true
+		if _, _, err := net.SplitHostPort(br.Address); err != nil {
+			return fmt.Errorf("bridge %s: %v", br.Name, err)
+		}
+		if len(br.Topics) == 0 {
+			return fmt.Errorf("bridge %s: no topics", br.Name)
+		}
+		for _, t := range br.Topics {
+			if t.Pattern == "" || strings.ContainsAny(t.Pattern+t.LocalPrefix+t.RemotePrefix, " \t\n\"") {
+				return fmt.Errorf("bridge %s: invalid topic %q", br.Name, t.Pattern)
+			}
+			switch t.Direction {
+			case "in", "out", "both":
+			default:
+				return fmt.Errorf("bridge %s: topic %s: direction must be in, out or both", br.Name, t.Pattern)
+			}
+			if t.QoS < 0 || t.QoS > 2 {
+				return fmt.Errorf("bridge %s: topic %s: invalid qos %d", br.Name, t.Pattern, t.QoS)
+			}
+		}
+	}
+	return nil
+}
+
+func validateACLs(acls []ACL) error {
+	for _, a := range acls {
+		if a.Topic == "" || strings.ContainsAny(a.Topic, "\n") {
+			return fmt.Errorf("acl: invalid topic %q", a.Topic)
+		}
+		switch a.Access {
+		case "read", "write", "readwrite", "deny":
+		default:
+			return fmt.Errorf("acl %s: access must be read, write, readwrite or deny", a.Topic)
+		}
+	}
+	return nil
+}
+
+// haClientACL is what an mqttComponent client with the given node_id needs:
+// its own state and command topics, its discovery messages and Home
+// Assistant's birth message.
+func haClientACL(nodeID string) []ACL {
+	return []ACL{
+		{Topic: nodeID + "/#", Access: "readwrite"},
+		{Topic: "homeassistant/+/" + nodeID + "/#", Access: "write"},
+		{Topic: "homeassistant/status", Access: "read"},
+	}
+}
+
+// statusClients are the launchers that publish their container status, and
+// for bluetooth the adapter state, from /perm/<name>/mqtt. Their users are
+// named <name>-status and expect <name> as node_id.
+var statusClients = []string{"homeassistant", "zigbee2mqtt", "node-red", "esphome", "vanpi", "bluetooth", "mqtt"}
+
+// defaultBroker is written to /perm/mqtt/broker.json on first start. Every
+// client gets its own random password; the mqttComponent clients are
+// provisioned through their secrets files, the users in manualSetup have to
+// be configured by hand.
+func defaultBroker() (*Broker, error) {
+	b := &Broker{
+		Listeners: []Listener{
+			{Port: 1883},
+			{Port: 9001, Protocol: "websockets"},
+		},
+		Users: []User{
+			{Name: "homeassistant", ACL: []ACL{{Topic: "#", Access: "readwrite"}}},
+			{Name: "zigbee2mqtt", ACL: []ACL{
+				{Topic: "zigbee2mqtt/#", Access: "readwrite"},
+				{Topic: "homeassistant/#", Access: "readwrite"},
+			}},
+			{Name: "node-red", ACL: []ACL{{Topic: "#", Access: "readwrite"}}},
+			{Name: "relay", ACL: haClientACL("gpio1"), Secrets: "/perm/goMqttGpio/secrets.json"},
+			{Name: "display", ACL: haClientACL("nextion1"), Secrets: "/perm/nextion/secrets.json"},
+			{Name: "blescan", ACL: haClientACL("ble1"), Secrets: "/perm/blescan/secrets.json"},
+			{Name: "wifi", ACL: haClientACL("wifi"), Secrets: "/perm/wifi/mqtt/secrets.json"},
+		},
+	}
+	for _, name := range statusClients {
+		b.Users = append(b.Users, User{
+			Name:    name + "-status",
+			ACL:     haClientACL(name),
+			Secrets: filepath.Join("/perm", name, "mqtt", "secrets.json"),
+		})
+	}
+	for i := range b.Users {
+		pw, err := randomPassword()
+		if err != nil {
+			return nil, err
+		}
+		b.Users[i].Password = pw
+	}
+	return b, nil
+}
+
+// manualSetup tells where the users of defaultBroker without secrets file
+// need their credentials.
+var manualSetup = map[string]string{
+	"homeassistant": "the MQTT integration of Home Assistant",
+	"zigbee2mqtt":   "mqtt.user and mqtt.password of /perm/zigbee2mqtt/data/configuration.yaml",
+	"node-red":      "the mqtt-broker config node of Node-RED",
+}
+
+func randomPassword() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// loadBroker reads and validates path. If path does not exist, a default
+// configuration is written, unless a hand-written mosquitto.conf is already
+// in place, in which case loadBroker returns nil.
+func loadBroker(path string) (*Broker, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if handWritten(filepath.Join(configDir, "mosquitto.conf")) {
+			log.Printf("%s does not exist, leaving the hand-written %s/mosquitto.conf alone", path, configDir)
+			return nil, nil
+		}
+		log.Printf("%s does not exist, writing a default with random passwords", path)
+		broker, err := defaultBroker()
+		if err != nil {
+			return nil, err
+		}
+		out, err := json.MarshalIndent(broker, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		// The file holds plain passwords, keep it away from the container
+		// and other users.
+		if err := os.WriteFile(path, append(out, '\n'), 0600); err != nil {
+			return nil, err
+		}
+		for _, u := range broker.Users {
+			if u.Secrets == "" {
+				log.Printf("user %s has to be configured by hand in %s, its password is in %s", u.Name, manualSetup[u.Name], path)
+			}
+		}
+		return broker, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var broker Broker
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&broker); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := broker.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &broker, nil
+}
+
+// provisionSecrets writes each user's credentials into its mqttComponent
+// secrets file. Files that do not exist yet are skipped; the owning service
+// creates them on its first start and picks the credentials up on the next
+// pass.
+func (b *Broker) provisionSecrets() {
+	for _, u := range b.Users {
+		if u.Secrets == "" {
+			continue
+		}
+		if err := provisionSecrets(u.Secrets, u.Name, u.Password); err != nil && !os.IsNotExist(err) {
+			log.Printf("provisioning credentials of %s: %v", u.Name, err)
+		}
+	}
+}
+
+func provisionSecrets(path, username, password string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var secrets map[string]json.RawMessage
+	if err := json.Unmarshal(b, &secrets); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	var conn map[string]any
+	if raw, ok := secrets["mqtt"]; ok {
+		if err := json.Unmarshal(raw, &conn); err != nil {
+			return fmt.Errorf("%s: mqtt: %v", path, err)
+		}
+	}
+	if conn == nil {
+		conn = make(map[string]any)
+	}
+	if conn["username"] == username && conn["password"] == password {
+		return nil
+	}
+	conn["username"] = username
+	conn["password"] = password
+	raw, err := json.Marshal(conn)
+	if err != nil {
+		return err
+	}
+	secrets["mqtt"] = raw
+	out, err := json.MarshalIndent(secrets, "", "    ")
+	if err != nil {
+		return err
+	}
+	log.Printf("updating MQTT credentials in %s", path)
+	return writeFileAtomic(path, append(out, '\n'), 0600, -1, -1)
+}
+
+// watchBroker calls apply with the new configuration whenever brokerFile
+// changes. Client credentials are provisioned on every pass, as secrets files
+// may appear after the broker started.
+func watchBroker(b *Broker, apply func(*Broker) error) {
+	last, _ := os.Stat(brokerFile)
+	for range time.Tick(watchInterval) {
+		b.provisionSecrets()
+
+		fi, err := os.Stat(brokerFile)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+
+		next, err := loadBroker(brokerFile)
+		if err == nil {
+			err = apply(next)
+		}
+		if err != nil {
+			log.Printf("keeping the current broker configuration: %v", err)
+			continue
+		}
+		b = next
+		b.provisionSecrets()
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// embeddedStore holds retained messages, sessions and inflight messages of
+// the embedded broker, next to where mosquitto keeps its database.
+const embeddedStore = "/perm/mqtt/data/embedded.db"
+
+// authHook checks logins and topic access of the embedded broker against the
+// users and ACLs of a Broker. The Broker is swapped when broker.json changes.
+type authHook struct {
+	mochi.HookBase
+	broker atomic.Pointer[Broker]
+}
+
+func (h *authHook) ID() string {
+	return "broker-json-auth"
+}
+
+func (h *authHook) Provides(b byte) bool {
+	return b == mochi.OnConnectAuthenticate || b == mochi.OnACLCheck
+}
+
+func (h *authHook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	b := h.broker.Load()
+	username := string(pk.Connect.Username)
+	if username == "" {
+		return b.AllowAnonymous
+	}
+	u := b.user(username)
+	if u == nil {
+		log.Printf("client %s: unknown user %q", cl.ID, username)
+		return false
+	}
+	password := string(pk.Connect.Password)
+	ok := checkPassword(password, u.PasswordHash)
+	if u.Password != "" {
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) == 1
+	}
+	if !ok {
+		log.Printf("client %s: wrong password for %s", cl.ID, username)
+		return false
+	}
+	return true
+}
+
+func (h *authHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	b := h.broker.Load()
+	username := string(cl.Properties.Username)
+	acls := b.AnonymousACL
+	if username != "" {
+		u := b.user(username)
+		if u == nil {
+			return false
+		}
+		acls = u.ACL
+	}
+	return aclAllows(acls, username, cl.ID, topic, write)
+}
+
+func (b *Broker) user(name string) *User {
+	for i := range b.Users {
+		if b.Users[i].Name == name {
+			return &b.Users[i]
+		}
+	}
+	return nil
+}
+
+// aclAllows applies mosquitto's ACL semantics: a matching deny entry wins,
+// otherwise access is granted if any matching entry allows it.
+func aclAllows(acls []ACL, username, clientID, topic string, write bool) bool {
+	allowed := false
+	for _, a := range acls {
+		filter := a.Topic
+		if a.Pattern {
+			filter = strings.NewReplacer("%u", username, "%c", clientID).Replace(filter)
+		}
+		if !topicMatches(filter, topic) {
+			continue
+		}
+		switch a.Access {
+		case "deny":
+			return false
+		case "readwrite":
+			allowed = true
+		case "read":
+			allowed = allowed || !write
+		case "write":
+			allowed = allowed || write
+		}
+	}
+	return allowed
+}
+
+// topicMatches reports whether the ACL topic filter covers topic, which may
+// itself be a subscription filter.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// validateEmbedded checks the parts of b that the embedded broker handles
+// differently from mosquitto.
+func (b *Broker) validateEmbedded() error {
+	for _, u := range b.Users {
+		if u.PasswordHash != "" && !strings.HasPrefix(u.PasswordHash, "$7$") {
+			return fmt.Errorf("user %s: the embedded broker only supports $7$ (PBKDF2-SHA512) password hashes", u.Name)
+		}
+	}
+	if len(b.Bridges) > 0 {
+		log.Printf("the embedded broker does not support bridges, ignoring %d configured bridges", len(b.Bridges))
+	}
+	return nil
+}
+
+// tlsConfig loads a listener's certificates from configDir.
+func (t *TLS) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(configPath(t.Cert), configPath(t.Key))
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(configPath(t.CA))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", t.CA)
+		}
+		config.ClientCAs = pool
+		if t.RequireCertificate {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// configPath maps a path relative to configDir to the host.
+func configPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(configDir, p)
+}
+
+// runEmbedded serves MQTT from within the launcher until it receives SIGTERM
+// or SIGINT.
+func runEmbedded(b *Broker) error {
+	if err := b.validateEmbedded(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(embeddedStore), 0755); err != nil {
+		return err
+	}
+
+	server := mochi.New(&mochi.Options{
+		Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	})
+	auth := new(authHook)
+	auth.broker.Store(b)
+	if err := server.AddHook(auth, nil); err != nil {
+		return err
+	}
+	if err := server.AddHook(new(bolt.Hook), &bolt.Options{Path: embeddedStore}); err != nil {
+		return fmt.Errorf("opening %s: %v", embeddedStore, err)
+	}
+
+	for _, l := range b.Listeners {
+		var config *listeners.Config
+		if l.TLS != nil {
+			tlsConfig, err := l.TLS.tlsConfig()
+			if err != nil {
+				return fmt.Errorf("listener %d: %v", l.Port, err)
+			}
+			config = &listeners.Config{TLSConfig: tlsConfig}
+		}
+		addr := net.JoinHostPort(l.Bind, fmt.Sprint(l.Port))
+		id := fmt.Sprintf("%s-%d", l.protocol(), l.Port)
+		var listener listeners.Listener
+		if l.Protocol == "websockets" {
+			listener = listeners.NewWebsocket(id, addr, config)
+		} else {
+			listener = listeners.NewTCP(id, addr, config)
+		}
+		if err := server.AddListener(listener); err != nil {
+			return err
+		}
+		log.Printf("embedded broker listening on %s (%s)", addr, l.protocol())
+	}
+
+	if err := server.Serve(); err != nil {
+		return err
+	}
+	go watchBroker(b, func(next *Broker) error {
+		if err := next.validateEmbedded(); err != nil {
+			return err
+		}
+		if next.Mode != modeEmbedded {
+			log.Printf("%s switched to mode %q, restart the mqtt service to apply", brokerFile, next.Mode)
+		}
+		auth.broker.Store(next)
+		log.Printf("reloaded users and ACLs from %s; listener changes take effect when the mqtt service is restarted", brokerFile)
+		return nil
+	})
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.Printf("received %v, stopping the embedded broker", sig)
+	return server.Close()
+}
+
+func (l Listener) protocol() string {
+	if l.Protocol == "" {
+		return "mqtt"
+	}
+	return l.Protocol
+}
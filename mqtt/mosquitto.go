@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/alf632/gokrazy-ha/containerComponent"
+)
+
+const (
+	brokerFile = "/perm/mqtt/broker.json"
+	// configDir is mounted into the container as containerConfigDir.
+	configDir          = "/perm/mqtt/config"
+	containerConfigDir = "/mosquitto/config"
+
+	// generatedHeader marks files that are owned by the launcher and may be
+	// overwritten or removed.
+	generatedHeader = "# Generated by the mqtt launcher from " + brokerFile + ", do not edit.\n"
+
+	// mosquittoUID is the user the eclipse-mosquitto image runs as.
+	mosquittoUID = 1883
+)
+
+// handWritten reports whether path exists and was not generated by us.
+func handWritten(path string) bool {
+	b, err := os.ReadFile(path)
+	return err == nil && !bytes.HasPrefix(b, []byte(generatedHeader))
+}
+
+// containerPath maps a path relative to configDir to where the broker sees it.
+func containerPath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(containerConfigDir, p)
+}
+
+// mosquittoConf renders the main configuration file. Listeners and bridges
+// go to conf.d.
+func (b *Broker) mosquittoConf() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(generatedHeader)
+	fmt.Fprintf(&buf, `
+per_listener_settings false
+allow_anonymous %t
+password_file %s
+acl_file %s
+
+persistence true
+persistence_location /mosquitto/data/
+
+log_dest stdout
+
+include_dir %s
+`, b.AllowAnonymous, containerPath("passwd"), containerPath("acl"), containerPath("conf.d"))
+	return buf.Bytes()
+}
+
+func (b *Broker) listenersConf() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(generatedHeader)
+	for _, l := range b.Listeners {
+		fmt.Fprintf(&buf, "\nlistener %d", l.Port)
+		if l.Bind != "" {
+			fmt.Fprintf(&buf, " %s", l.Bind)
+		}
+		buf.WriteString("\n")
+		if l.Protocol != "" {
+			fmt.Fprintf(&buf, "protocol %s\n", l.Protocol)
+		}
+		if t := l.TLS; t != nil {
+			if t.CA != "" {
+				fmt.Fprintf(&buf, "cafile %s\n", containerPath(t.CA))
+			}
+			fmt.Fprintf(&buf, "certfile %s\n", containerPath(t.Cert))
+			fmt.Fprintf(&buf, "keyfile %s\n", containerPath(t.Key))
+			if t.RequireCertificate {
+				buf.WriteString("require_certificate true\n")
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func (br *Bridge) conf() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(generatedHeader)
+	fmt.Fprintf(&buf, "\nconnection %s\naddress %s\n", br.Name, br.Address)
+	for _, t := range br.Topics {
+		fmt.Fprintf(&buf, "topic %s %s %d", t.Pattern, t.Direction, t.QoS)
+		if t.LocalPrefix != "" || t.RemotePrefix != "" {
+			fmt.Fprintf(&buf, " %q %q", t.LocalPrefix, t.RemotePrefix)
+		}
+		buf.WriteString("\n")
+	}
+	if br.RemoteClientID != "" {
+		fmt.Fprintf(&buf, "remote_clientid %s\n", br.RemoteClientID)
+	}
+	if br.RemoteUsername != "" {
+		fmt.Fprintf(&buf, "remote_username %s\n", br.RemoteUsername)
+	}
+	if br.RemotePassword != "" {
+		fmt.Fprintf(&buf, "remote_password %s\n", br.RemotePassword)
+	}
+	if t := br.TLS; t != nil {
+		if t.CA != "" {
+			fmt.Fprintf(&buf, "bridge_cafile %s\n", containerPath(t.CA))
+		}
+		if t.Cert != "" {
+			fmt.Fprintf(&buf, "bridge_certfile %s\n", containerPath(t.Cert))
+		}
+		if t.Key != "" {
+			fmt.Fprintf(&buf, "bridge_keyfile %s\n", containerPath(t.Key))
+		}
+	}
+	return buf.Bytes()
+}
+
+// aclFile renders mosquitto's ACL file. Topics before the first user line
+// apply to anonymous clients.
+func (b *Broker) aclFile() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(generatedHeader)
+	writeACLs := func(acls []ACL) {
+		for _, a := range acls {
+			kind := "topic"
+			if a.Pattern {
+				kind = "pattern"
+			}
+			fmt.Fprintf(&buf, "%s %s %s\n", kind, a.Access, a.Topic)
+		}
+	}
+	if b.AllowAnonymous {
+		buf.WriteString("\n")
+		writeACLs(b.AnonymousACL)
+	}
+	for _, u := range b.Users {
+		fmt.Fprintf(&buf, "\nuser %s\n", u.Name)
+		writeACLs(u.ACL)
+	}
+	return buf.Bytes()
+}
+
+type generatedFile struct {
+	name    string
+	content []byte
+	mode    os.FileMode
+}
+
+// generate writes the broker configuration below dir. It reports whether
+// anything changed and whether the change needs a broker restart, because
+// mosquitto does not reload listeners and bridges on SIGHUP.
+func (b *Broker) generate(dir string) (changed, restart bool, err error) {
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		return false, false, err
+	}
+	if err := os.Chown(dir, mosquittoUID, mosquittoUID); err != nil {
+		return false, false, err
+	}
+
+	current, err := readPasswd(filepath.Join(dir, "passwd"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, false, err
+	}
+	passwd, err := b.passwdFile(current)
+	if err != nil {
+		return false, false, err
+	}
+
+	files := []generatedFile{
+		{"mosquitto.conf", b.mosquittoConf(), 0644},
+		// mosquitto refuses password and ACL files that others can read.
+		{"passwd", passwd, 0600},
+		{"acl", b.aclFile(), 0600},
+		{"conf.d/listeners.conf", b.listenersConf(), 0644},
+	}
+	for _, br := range b.Bridges {
+		files = append(files, generatedFile{"conf.d/bridge-" + br.Name + ".conf", br.conf(), 0644})
+	}
+
+	wanted := make(map[string]bool)
+	for _, f := range files {
+		wanted[f.name] = true
+		path := filepath.Join(dir, f.name)
+		old, err := os.ReadFile(path)
+		if err == nil && bytes.Equal(old, f.content) {
+			continue
+		}
+		if err := writeFileAtomic(path, f.content, f.mode, mosquittoUID, mosquittoUID); err != nil {
+			return changed, restart, err
+		}
+		log.Printf("wrote %s", path)
+		changed = true
+		if strings.HasPrefix(f.name, "conf.d/") {
+			restart = true
+		}
+	}
+
+	// Remove bridges that are no longer configured and warn about
+	// hand-written snippets, which might clash with generated listeners.
+	entries, err := os.ReadDir(filepath.Join(dir, "conf.d"))
+	if err != nil {
+		return changed, restart, err
+	}
+	var foreign []string
+	for _, e := range entries {
+		name := "conf.d/" + e.Name()
+		path := filepath.Join(dir, name)
+		if wanted[name] || e.IsDir() {
+			continue
+		}
+		if handWritten(path) {
+			foreign = append(foreign, e.Name())
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return changed, restart, err
+		}
+		log.Printf("removed %s", path)
+		changed, restart = true, true
+	}
+	if len(foreign) > 0 {
+		sort.Strings(foreign)
+		log.Printf("%s/conf.d also contains hand-written %s", dir, strings.Join(foreign, ", "))
+	}
+	return changed, restart, nil
+}
+
+// writeFileAtomic replaces path with content. uid and gid of -1 keep the
+// file owned by the launcher.
+func writeFileAtomic(path string, content []byte, mode os.FileMode, uid, gid int) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chown(uid, gid); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// reloadMosquitto regenerates the configuration from b and makes the running
+// broker reload it.
+func reloadMosquitto(b *Broker) error {
+	changed, restart, err := b.generate(configDir)
+	if err != nil || !changed {
+		return err
+	}
+	log.Printf("%s changed, reloading the broker", brokerFile)
+	if err := containerComponent.Signal(spec.Name, syscall.SIGHUP); err != nil {
+		log.Print(err)
+	}
+	if restart {
+		log.Printf("listener and bridge changes take effect when the mqtt service is restarted")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// These match what mosquitto_passwd writes by default.
+const (
+	pbkdf2Iterations = 101
+	pbkdf2SaltLen    = 12
+)
+
+// hashPassword returns password in mosquitto's PBKDF2-SHA512 password file
+// format, $7$iterations$salt$hash.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, pbkdf2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return formatPBKDF2(password, salt, pbkdf2Iterations), nil
+}
+
+func formatPBKDF2(password string, salt []byte, iterations int) string {
+	hash := pbkdf2.Key([]byte(password), salt, iterations, sha512.Size, sha512.New)
+	return fmt.Sprintf("$7$%d$%s$%s", iterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(hash))
+}
+
+// checkPassword reports whether hash, in $7$ format, was made from password.
+func checkPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "7" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(formatPBKDF2(password, salt, iterations)), []byte(hash)) == 1
+}
+
+// readPasswd returns the user → hash entries of a mosquitto password file.
+func readPasswd(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		user, hash, ok := strings.Cut(scanner.Text(), ":")
+		if ok {
+			entries[user] = hash
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// passwdFile renders the password file for users. Hashes from the current
+// file are kept when they still match, so that an unchanged configuration
+// produces an unchanged file and does not trigger a reload.
+func (b *Broker) passwdFile(current map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, u := range b.Users {
+		hash := u.PasswordHash
+		if hash == "" {
+			if old := current[u.Name]; checkPassword(u.Password, old) {
+				hash = old
+			} else {
+				var err error
+				if hash, err = hashPassword(u.Password); err != nil {
+					return nil, err
+				}
+			}
+		}
+		fmt.Fprintf(&buf, "%s:%s\n", u.Name, hash)
+	}
+	return buf.Bytes(), nil
+}
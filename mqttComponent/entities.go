@@ -0,0 +1,151 @@
+package mqttComponent
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ExternalDevice "github.com/W-Floyd/ha-mqtt-iot/devices/externaldevice"
+	InternalDevice "github.com/W-Floyd/ha-mqtt-iot/devices/internaldevice"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Entity describes a read-only Home Assistant entity whose state is polled
+// from a function.
+type Entity struct {
+	Name string
+	// ID is used as object and unique ID, so it has to be unique per broker.
+	ID          string
+	DeviceClass string
+	// Unit and StateClass only apply to sensors.
+	Unit       string
+	StateClass string
+	Icon       string
+	// UpdateInterval is the polling interval in seconds.
+	UpdateInterval float64
+	State          func() string
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// BinarySensor returns e as a binary_sensor. State has to return "ON" or "OFF".
+func (e Entity) BinarySensor() *ExternalDevice.BinarySensor {
+	internalDevice := InternalDevice.BinarySensor{
+		Name:        &e.Name,
+		ObjectId:    &e.ID,
+		UniqueId:    &e.ID,
+		DeviceClass: optional(e.DeviceClass),
+		Icon:        optional(e.Icon),
+	}
+	internalDevice.MQTT.UpdateInterval = &e.UpdateInterval
+	externalDevice := internalDevice.Translate()
+	externalDevice.StateFunc = e.State
+	externalDevice.Initialize()
+	return &externalDevice
+}
+
+// Sensor returns e as a sensor.
+func (e Entity) Sensor() *ExternalDevice.Sensor {
+	internalDevice := InternalDevice.Sensor{
+		Name:              &e.Name,
+		ObjectId:          &e.ID,
+		UniqueId:          &e.ID,
+		DeviceClass:       optional(e.DeviceClass),
+		UnitOfMeasurement: optional(e.Unit),
+		StateClass:        optional(e.StateClass),
+		Icon:              optional(e.Icon),
+	}
+	internalDevice.MQTT.UpdateInterval = &e.UpdateInterval
+	externalDevice := internalDevice.Translate()
+	externalDevice.StateFunc = e.State
+	externalDevice.Initialize()
+	return &externalDevice
+}
+
+// Button returns e as a button that calls press when pressed in Home
+// Assistant. State, Unit, StateClass and UpdateInterval are not used.
+func (e Entity) Button(press func()) *ExternalDevice.Button {
+	internalDevice := InternalDevice.Button{
+		Name:        &e.Name,
+		ObjectId:    &e.ID,
+		UniqueId:    &e.ID,
+		DeviceClass: optional(e.DeviceClass),
+		Icon:        optional(e.Icon),
+	}
+	externalDevice := internalDevice.Translate()
+	externalDevice.CommandFunc = func(mqtt.Message, mqtt.Client) {
+		press()
+	}
+	externalDevice.Initialize()
+	return &externalDevice
+}
+
+// Event describes a Home Assistant event entity. ha-mqtt-iot has no event
+// platform, so AddEvent publishes the discovery message itself.
+type Event struct {
+	Name string
+	// ID is used as object and unique ID, so it has to be unique per broker.
+	ID         string
+	Icon       string
+	EventTypes []string
+}
+
+// EventEntity fires the events of an Event added with AddEvent.
+type EventEntity struct {
+	client mqtt.Client
+	topic  string
+}
+
+// publishTimeout bounds how long a publish waits for the broker.
+const publishTimeout = 10 * time.Second
+
+// AddEvent announces e to Home Assistant. The discovery message is retained,
+// so it survives Home Assistant restarts.
+func (mc *MqttController) AddEvent(e Event) (*EventEntity, error) {
+	ev := &EventEntity{
+		client: mc.client,
+		topic:  ExternalDevice.NodeID + "/event/" + e.ID + "/state",
+	}
+	config := map[string]any{
+		"name":        e.Name,
+		"object_id":   e.ID,
+		"unique_id":   e.ID,
+		"state_topic": ev.topic,
+		"event_types": e.EventTypes,
+	}
+	if e.Icon != "" {
+		config["icon"] = e.Icon
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	topic := ExternalDevice.DiscoveryPrefix + "/event/" + ExternalDevice.NodeID + "/" + e.ID + "/config"
+	return ev, publish(mc.client, topic, true, b)
+}
+
+// Fire publishes an event of eventType with additional attributes.
+func (ev *EventEntity) Fire(eventType string, attributes map[string]any) error {
+	payload := map[string]any{"event_type": eventType}
+	for k, v := range attributes {
+		payload[k] = v
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return publish(ev.client, ev.topic, false, b)
+}
+
+func publish(client mqtt.Client, topic string, retained bool, payload []byte) error {
+	token := client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("publishing to %s: timeout after %v", topic, publishTimeout)
+	}
+	return token.Error()
+}
@@ -11,7 +11,7 @@ require golang.org/x/sys v0.7.0 // indirect
 
 require (
 	github.com/denisbrodbeck/machineid v1.0.1
-	github.com/eclipse/paho.mqtt.golang v1.4.2 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/iancoleman/strcase v0.2.0 // indirect
 	golang.org/x/net v0.9.0 // indirect
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"dario.cat/mergo"
@@ -27,7 +28,11 @@ type MQTTConfig struct {
 }
 
 type MqttController struct {
-	client  mqtt.Client
+	client mqtt.Client
+
+	// mu guards tickers and devices, which AddDevice may change while
+	// the MQTT callbacks iterate them.
+	mu      sync.Mutex
 	tickers []*time.Ticker
 	devices []ExternalDevice.Device
 }
@@ -132,12 +137,16 @@ func NewMqttController(mqttConfig MQTTConfig) *MqttController {
 		log.Println("homeassistant status", string(m.Payload()))
 		if string(m.Payload()) == "online" {
 			log.Println("homeassistant started")
-			for _, d := range devices {
+			for _, d := range newMqttController.GetDevices() {
 				switch dev := d.(type) {
 				case *ExternalDevice.Switch:
 					dev.AnnounceAvailable()
 				case *ExternalDevice.BinarySensor:
 					dev.AnnounceAvailable()
+				case *ExternalDevice.Sensor:
+					dev.AnnounceAvailable()
+				case *ExternalDevice.Button:
+					dev.AnnounceAvailable()
 				default:
 					fmt.Printf("I don't know about type %T!\n", dev)
 				}
@@ -151,8 +160,11 @@ func NewMqttController(mqttConfig MQTTConfig) *MqttController {
 
 }
 
+// GetDevices returns a copy of the devices added so far.
 func (mc *MqttController) GetDevices() []ExternalDevice.Device {
-	return mc.devices
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return append([]ExternalDevice.Device(nil), mc.devices...)
 }
 
 func (mc *MqttController) AddDevice(device ExternalDevice.Device) {
@@ -160,6 +172,7 @@ func (mc *MqttController) AddDevice(device ExternalDevice.Device) {
 	f.Client = &mc.client
 	device.SetMQTTFields(f)
 
+	mc.mu.Lock()
 	if device.GetMQTTFields().UpdateInterval != nil && !almostEqual(*device.GetMQTTFields().UpdateInterval, 0) {
 		newTicker := time.NewTicker(time.Duration(*device.GetMQTTFields().UpdateInterval) * time.Second)
 		mc.tickers = append(mc.tickers, newTicker)
@@ -170,18 +183,21 @@ func (mc *MqttController) AddDevice(device ExternalDevice.Device) {
 		}(newTicker, device)
 	}
 	mc.devices = append(mc.devices, device)
+	mc.mu.Unlock()
 	common.LogDebug("Connecting " + device.GetRawId() + "." + device.GetUniqueId())
 	go device.Subscribe()
 	common.LogDebug(fmt.Sprintf("Added Device %v+", device))
 }
 
 func (mc *MqttController) Stop() {
+	mc.mu.Lock()
 	for _, t := range mc.tickers {
 		t.Stop()
 	}
+	mc.mu.Unlock()
 	common.LogDebug("Server Stopped")
 
-	for _, d := range mc.devices {
+	for _, d := range mc.GetDevices() {
 		d.UnSubscribe()
 		common.LogDebug(d.GetRawId() + " Unsubscribed")
 	}
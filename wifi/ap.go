@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mdlayher/wifi"
+)
+
+const (
+	defaultAPAddress = "192.168.4.1/24"
+	defaultAPChannel = 6
+	defaultAPAfter   = 2 * time.Minute
+	defaultAPRetry   = 5 * time.Minute
+
+	// beaconInterval is in time units of 1024µs.
+	beaconInterval = 100
+)
+
+// apConfig is the "ap" object of wifi.json, or set with the -ap-ssid and
+// -ap-psk flags:
+//
+//	"ap": {"ssid": "van-setup", "psk": "secret", "address": "192.168.4.1/24"}
+//
+// If no configured network could be joined for After, or if there are no
+// networks configured, the daemon turns the interface into an access point
+// with a setup page at http://<address>/, which scans for networks and
+// writes /perm/wifi.json. As the interface cannot be an access point and a
+// station at the same time, the access point is paused every Retry to try
+// the configured networks again unless a client is connected, and it stays
+// off once one of them was joined.
+//
+// Without psk, the access point is open and only starts while no network is
+// configured, as anyone nearby could add a network through the setup page.
+//
+// The driver has to run the access point by itself, which brcmfmac of the
+// Raspberry Pi does; drivers that need hostapd are not supported.
+type apConfig struct {
+	SSID string `json:"ssid"`
+	// PSK is the WPA2 passphrase; the access point is open if empty.
+	PSK string `json:"psk"`
+	// Address is the address of the interface in access point mode and
+	// the subnet the DHCP server hands out, defaults to 192.168.4.1/24.
+	Address string `json:"address"`
+	// Channel is the 2.4 GHz channel, defaults to 6.
+	Channel int      `json:"channel"`
+	After   duration `json:"after"`
+	Retry   duration `json:"retry"`
+
+	static *staticConfig
+}
+
+func (ap *apConfig) init() error {
+	if ap.SSID == "" {
+		return fmt.Errorf("ap: ssid is required")
+	}
+	if ap.PSK != "" && (len(ap.PSK) < 8 || len(ap.PSK) > 63) {
+		return fmt.Errorf("ap: psk must have 8 to 63 characters")
+	}
+	if ap.Address == "" {
+		ap.Address = defaultAPAddress
+	}
+	ap.static = &staticConfig{Address: ap.Address}
+	if err := ap.static.init(); err != nil {
+		return fmt.Errorf("ap: %v", err)
+	}
+	if ones, _ := ap.static.mask.Size(); ones > 29 {
+		return fmt.Errorf("ap: subnet of %s is too small for clients", ap.Address)
+	}
+	if ap.Channel == 0 {
+		ap.Channel = defaultAPChannel
+	}
+	if ap.Channel < 1 || ap.Channel > 13 {
+		return fmt.Errorf("ap: channel must be between 1 and 13")
+	}
+	if ap.After == 0 {
+		ap.After = duration(defaultAPAfter)
+	}
+	if ap.Retry == 0 {
+		ap.Retry = duration(defaultAPRetry)
+	}
+	return nil
+}
+
+func (ap *apConfig) params() apParams {
+	p := apParams{SSID: ap.SSID, Channel: ap.Channel}
+	if ap.PSK != "" {
+		p.PMK = pmk(ap.SSID, ap.PSK)
+	}
+	return p
+}
+
+// apParams describes the access point to start.
+type apParams struct {
+	SSID    string
+	Channel int
+	// PMK is the WPA2 pairwise master key; the access point is open if
+	// nil.
+	PMK []byte
+}
+
+func (p apParams) frequency() int {
+	return 2407 + 5*p.Channel
+}
+
+// Information element IDs of beacons.
+const (
+	ieSupportedRates = 1
+	ieDSParameterSet = 3
+	ieExtendedRates  = 50
+)
+
+// beacon returns the beacon frame of the access point, split into the part
+// before and after the TIM element, which the driver inserts.
+func (p apParams) beacon(bssid net.HardwareAddr) (head, tail []byte) {
+	head = []byte{
+		0x80, 0x00, // frame control: management, beacon
+		0x00, 0x00, // duration
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // destination: broadcast
+	}
+	head = append(head, bssid...) // source
+	head = append(head, bssid...) // BSSID
+	head = append(head, 0, 0)     // sequence control
+	head = append(head, make([]byte, 8)...)
+	head = binary.LittleEndian.AppendUint16(head, beaconInterval)
+	capability := uint16(1 << 0) // ESS
+	if p.PMK != nil {
+		capability |= capabilityPrivacy
+	}
+	head = binary.LittleEndian.AppendUint16(head, capability)
+	head = appendIE(head, ieSSID, []byte(p.SSID))
+	// 1, 2, 5.5 and 11 Mbit/s are basic rates, then 6 to 18 Mbit/s.
+	head = appendIE(head, ieSupportedRates, []byte{0x82, 0x84, 0x8b, 0x96, 0x0c, 0x12, 0x18, 0x24})
+	head = appendIE(head, ieDSParameterSet, []byte{byte(p.Channel)})
+
+	tail = appendIE(nil, ieExtendedRates, []byte{0x30, 0x48, 0x60, 0x6c})
+	if p.PMK != nil {
+		rsn := []byte{
+			1, 0, // version
+			0x00, 0x0f, 0xac, 4, // group cipher CCMP
+			1, 0, 0x00, 0x0f, 0xac, 4, // pairwise cipher CCMP
+			1, 0, 0x00, 0x0f, 0xac, 2, // AKM PSK
+			0, 0, // capabilities
+		}
+		tail = appendIE(tail, ieRSN, rsn)
+	}
+	return head, tail
+}
+
+func appendIE(b []byte, id byte, data []byte) []byte {
+	return append(append(b, id, byte(len(data))), data...)
+}
+
+// accessPoint is the running access point with its services.
+type accessPoint struct {
+	cfg   *apConfig
+	since time.Time
+	dhcp  *dhcpServer
+	dns   *dnsServer
+	setup *setupPage
+}
+
+// shouldStartAP reports whether to give up on the configured networks for
+// now and start the access point.
+func (w *wifiCtx) shouldStartAP() bool {
+	ap := w.cfg.AP
+	if ap == nil || !w.connecting.IsZero() {
+		return false
+	}
+	if !w.caps.AP {
+		return false
+	}
+	if ap.PSK == "" && len(w.cfg.Networks) > 0 {
+		return false
+	}
+	return len(w.cfg.Networks) == 0 || time.Since(w.lastConnected) >= time.Duration(ap.After)
+}
+
+func (w *wifiCtx) startAP() error {
+	ap := w.cfg.AP
+	if ap.PSK != "" && !w.caps.APPSK {
+		return fmt.Errorf("driver cannot run a WPA2 access point, remove the ap psk")
+	}
+	if len(w.cfg.Networks) == 0 {
+		log.Printf("no networks configured, starting access point %q", ap.SSID)
+	} else {
+		log.Printf("no network joined for %v, starting access point %q", time.Since(w.lastConnected).Round(time.Second), ap.SSID)
+	}
+	w.dhcp.disconnected("starting access point")
+	w.unconfigure()
+	w.status.disconnected()
+	w.network, w.bssid = nil, nil
+
+	// Scan before beaconing, not all drivers can do it afterwards.
+	results, err := w.cl.Scan(w.intf, w.cfg.ssids())
+	if err != nil {
+		log.Printf("scanning for the setup page: %v", err)
+	}
+
+	// Do not try again right away if the access point fails.
+	w.lastConnected = time.Now()
+	if err := w.setType(wifi.InterfaceTypeAP); err != nil {
+		return fmt.Errorf("switching to access point mode: %v", err)
+	}
+	if err := w.cl.StartAP(w.intf, ap.params()); err != nil {
+		w.setType(wifi.InterfaceTypeStation)
+		return fmt.Errorf("starting access point: %v", err)
+	}
+	a := &accessPoint{cfg: ap, since: time.Now()}
+	w.ap = a
+	w.static = ap.static
+	if err := ap.static.apply(w.cs); err != nil {
+		w.stopAP()
+		return err
+	}
+
+	ip, mask := ap.static.ip, ap.static.mask
+	if a.dhcp, err = startDHCPServer(w.intf.Name, ip, mask); err != nil {
+		log.Printf("starting DHCP server: %v", err)
+	}
+	if a.dns, err = startDNSServer(ip); err != nil {
+		log.Printf("starting DNS server: %v", err)
+	}
+	a.setup = startSetupPage(ip, results, w.scanForSetup, w.saveFromSetup)
+	return nil
+}
+
+// stopAP stops the access point and switches back to station mode.
+func (w *wifiCtx) stopAP() error {
+	a := w.ap
+	w.ap = nil
+	if a.setup != nil {
+		a.setup.Close()
+	}
+	if a.dns != nil {
+		a.dns.Close()
+	}
+	if a.dhcp != nil {
+		a.dhcp.Close()
+	}
+	w.unconfigure()
+	if err := w.cl.StopAP(w.intf); err != nil {
+		log.Printf("stopping access point: %v", err)
+	}
+	// Give the configured networks another After.
+	w.lastConnected = time.Now()
+	if err := w.setType(wifi.InterfaceTypeStation); err != nil {
+		return fmt.Errorf("switching to station mode: %v", err)
+	}
+	log.Printf("stopped access point")
+	return nil
+}
+
+// controlAP stops the access point once a network was set up, and pauses
+// it every Retry to try the configured networks.
+func (w *wifiCtx) controlAP() error {
+	select {
+	case <-w.saved:
+		cfg, err := w.loadConfig()
+		if err != nil {
+			return fmt.Errorf("reloading config: %v", err)
+		}
+		w.cfg = cfg
+		log.Printf("setup saved a network, trying to join it")
+		return w.stopAP()
+	default:
+	}
+	if len(w.cfg.Networks) == 0 || time.Since(w.ap.since) < time.Duration(w.ap.cfg.Retry) {
+		return nil
+	}
+	clients, err := w.cl.StationInfo(w.intf)
+	if err == nil && len(clients) > 0 {
+		// Do not pull the access point from under a client that is
+		// setting up the daemon.
+		return nil
+	}
+	log.Printf("pausing access point to try the configured networks")
+	return w.stopAP()
+}
+
+// stationMode switches the interface back to station mode if it is still
+// an access point, e.g. because the process died while running one.
+func (w *wifiCtx) stationMode() error {
+	if w.intf.Type == wifi.InterfaceTypeStation {
+		return nil
+	}
+	log.Printf("%s is in %v mode, switching to station mode", w.intf.Name, w.intf.Type)
+	if w.intf.Type == wifi.InterfaceTypeAP {
+		if err := w.cl.StopAP(w.intf); err != nil {
+			log.Printf("stopping access point: %v", err)
+		}
+	}
+	if err := w.setType(wifi.InterfaceTypeStation); err != nil {
+		return fmt.Errorf("switching to station mode: %v", err)
+	}
+	return nil
+}
+
+// setType switches the interface type, which needs it down.
+func (w *wifiCtx) setType(typ wifi.InterfaceType) error {
+	if err := w.cs.Down(); err != nil {
+		return err
+	}
+	err := w.cl.SetType(w.intf, typ)
+	if err == nil {
+		w.scanMu.Lock()
+		w.intf.Type = typ
+		w.scanMu.Unlock()
+	}
+	if uerr := w.cs.Up(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// scanForSetup scans on behalf of the setup page.
+func (w *wifiCtx) scanForSetup() ([]*scanResult, error) {
+	w.scanMu.Lock()
+	defer w.scanMu.Unlock()
+	intf := *w.intf
+	return w.cl.Scan(&intf, nil)
+}
+
+// saveFromSetup adds the network entered on the setup page to
+// /perm/wifi.json and wakes up the control loop.
+func (w *wifiCtx) saveFromSetup(n network) error {
+	if err := saveNetwork(w.configPaths, n); err != nil {
+		return err
+	}
+	select {
+	case w.saved <- struct{}{}:
+	default:
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultRoamRSSI  = -75
+	defaultRoamAfter = time.Minute
+)
+
+// wifiConfig is read from /perm/wifi.json or /etc/wifi.json:
+//
+//	{
+//	  "networks": [
+//	    {"ssid": "home", "psk": "secret", "priority": 10,
+//	     "static": {"address": "192.168.1.50/24", "gateway": "192.168.1.1", "dns": ["192.168.1.1"]}},
+//	    {"ssid": "campsite", "bssid": "02:11:22:33:44:55", "priority": 5},
+//	    {"ssid": "hotspot", "psk": "secret"}
+//	  ],
+//	  "roam_rssi": -75,
+//	  "roam_after": "1m"
+//	}
+//
+// Instead of the psk, a network can have the pmk that the pmk command
+// derives from it, so that the passphrase is not stored on the card. WPA3-SAE
+// needs the passphrase though, so with a pmk only WPA2 is used.
+//
+// The older form {"ssid": "home", "psk": "secret"} is still accepted and
+// adds one network with priority 0.
+type wifiConfig struct {
+	SSID string `json:"ssid"`
+	PSK  string `json:"psk"`
+	PMK  string `json:"pmk"`
+	// Static belongs to SSID, like PSK.
+	Static *staticConfig `json:"static"`
+	// INTERFACE is the WiFi interface to use, e.g. wlan0. If empty, the
+	// first station interface is used.
+	INTERFACE string `json:"interface"`
+	// Networks are the known networks. Among those in range, the one with
+	// the highest priority wins, then the one with the strongest signal.
+	Networks []*network `json:"networks"`
+	// RoamRSSI is the signal strength in dBm below which the daemon looks
+	// for a better access point, defaults to -75.
+	RoamRSSI int `json:"roam_rssi"`
+	// RoamAfter is how long the signal has to stay below RoamRSSI before
+	// the daemon fails over, defaults to 1m.
+	RoamAfter duration `json:"roam_after"`
+	// AP configures the access point for setup, see apConfig.
+	AP *apConfig `json:"ap"`
+}
+
+// network is a known WiFi network.
+type network struct {
+	SSID string `json:"ssid"`
+	// PSK is the passphrase, empty for open networks.
+	PSK string `json:"psk"`
+	// PMK is the WPA2 pairwise master key in hex, which can be given
+	// instead of PSK.
+	PMK      string `json:"pmk"`
+	Priority int    `json:"priority"`
+	// BSSID pins the network to one access point.
+	BSSID string `json:"bssid"`
+	// Static configures the address of the interface instead of DHCP.
+	Static *staticConfig `json:"static"`
+
+	bssid net.HardwareAddr
+	pmk   []byte
+}
+
+// duration is a time.Duration that is written as "30s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// readConfig reads the first of paths that exists. The caller applies its
+// overrides and calls init.
+func readConfig(paths ...string) (*wifiConfig, error) {
+	var err error
+	for _, path := range paths {
+		var b []byte
+		b, err = os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var cfg wifiConfig
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return &cfg, nil
+	}
+	return nil, err
+}
+
+// saveNetwork adds n to the config in the first of paths, or replaces the
+// network with the same SSID. It starts from the first of paths that exists
+// and keeps all other settings.
+func saveNetwork(paths []string, n network) error {
+	raw := make(map[string]json.RawMessage)
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		break
+	}
+
+	setKey := func(m map[string]json.RawMessage) {
+		delete(m, "psk")
+		delete(m, "pmk")
+		if n.PSK != "" {
+			m["psk"] = jsonString(n.PSK)
+		}
+		if n.PMK != "" {
+			m["pmk"] = jsonString(n.PMK)
+		}
+	}
+	var legacy string
+	if raw["ssid"] != nil {
+		json.Unmarshal(raw["ssid"], &legacy)
+	}
+	if legacy == n.SSID {
+		setKey(raw)
+	} else {
+		var networks []map[string]json.RawMessage
+		if raw["networks"] != nil {
+			if err := json.Unmarshal(raw["networks"], &networks); err != nil {
+				return fmt.Errorf("networks: %v", err)
+			}
+		}
+		found := false
+		for _, m := range networks {
+			var ssid string
+			json.Unmarshal(m["ssid"], &ssid)
+			if ssid == n.SSID {
+				setKey(m)
+				found = true
+			}
+		}
+		if !found {
+			m := map[string]json.RawMessage{"ssid": jsonString(n.SSID)}
+			setKey(m)
+			networks = append(networks, m)
+		}
+		b, err := json.Marshal(networks)
+		if err != nil {
+			return err
+		}
+		raw["networks"] = b
+	}
+
+	b, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := paths[0]
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func jsonString(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// init validates cfg, fills in defaults and sorts the networks by
+// priority.
+func (cfg *wifiConfig) init() error {
+	if cfg.SSID != "" {
+		cfg.Networks = append([]*network{{SSID: cfg.SSID, PSK: cfg.PSK, PMK: cfg.PMK, Static: cfg.Static}}, cfg.Networks...)
+	}
+	if len(cfg.Networks) == 0 && cfg.AP == nil {
+		return fmt.Errorf("no networks configured")
+	}
+	if cfg.AP != nil {
+		if err := cfg.AP.init(); err != nil {
+			return err
+		}
+	}
+	for _, n := range cfg.Networks {
+		if n.SSID == "" {
+			return fmt.Errorf("network without ssid")
+		}
+		if n.BSSID != "" {
+			mac, err := net.ParseMAC(n.BSSID)
+			if err != nil {
+				return fmt.Errorf("network %q: %v", n.SSID, err)
+			}
+			n.bssid = mac
+		}
+		if n.PSK != "" && (len(n.PSK) < 8 || len(n.PSK) > 63) {
+			return fmt.Errorf("network %q: psk must have 8 to 63 characters", n.SSID)
+		}
+		if n.PMK != "" {
+			b, err := hex.DecodeString(n.PMK)
+			if err != nil || len(b) != 32 {
+				return fmt.Errorf("network %q: pmk must have 64 hex digits", n.SSID)
+			}
+			n.pmk = b
+		}
+		if n.Static != nil {
+			if err := n.Static.init(); err != nil {
+				return fmt.Errorf("network %q: %v", n.SSID, err)
+			}
+		}
+	}
+	sort.SliceStable(cfg.Networks, func(i, j int) bool {
+		return cfg.Networks[i].Priority > cfg.Networks[j].Priority
+	})
+	if cfg.RoamRSSI == 0 {
+		cfg.RoamRSSI = defaultRoamRSSI
+	}
+	if cfg.RoamAfter == 0 {
+		cfg.RoamAfter = duration(defaultRoamAfter)
+	}
+	return nil
+}
+
+// ssids returns the SSIDs of the known networks.
+func (cfg *wifiConfig) ssids() []string {
+	var ssids []string
+	for _, n := range cfg.Networks {
+		ssids = append(ssids, n.SSID)
+	}
+	return ssids
+}
+
+// lookup returns the known network bss belongs to, or nil.
+func (cfg *wifiConfig) lookup(ssid string, bssid net.HardwareAddr) *network {
+	for _, n := range cfg.Networks {
+		if n.matches(ssid, bssid) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (n *network) matches(ssid string, bssid net.HardwareAddr) bool {
+	if n.SSID != ssid {
+		return false
+	}
+	return n.bssid == nil || bssid.String() == n.bssid.String()
+}
+
+// key returns the WPA2 pairwise master key of n.
+func (n *network) key() []byte {
+	if n.pmk != nil {
+		return n.pmk
+	}
+	return pmk(n.SSID, n.PSK)
+}
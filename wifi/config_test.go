@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wifi.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigInit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		ap      *apConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "legacy",
+			content: `{"ssid": "home", "psk": "password1"}`,
+			want:    []string{"home"},
+		},
+		{
+			name:    "legacy and networks",
+			content: `{"ssid": "home", "psk": "password1", "networks": [{"ssid": "van", "priority": 1}]}`,
+			want:    []string{"van", "home"},
+		},
+		{
+			name:    "no networks",
+			content: `{}`,
+			wantErr: true,
+		},
+		{
+			name:    "no networks with ap flags",
+			content: `{}`,
+			ap:      &apConfig{SSID: "van-setup"},
+		},
+		{
+			name:    "short psk",
+			content: `{"networks": [{"ssid": "home", "psk": "short"}]}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := readConfig(writeConfig(t, tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.ap != nil {
+				cfg.AP = tc.ap
+			}
+			err = cfg.init()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("init = %v, want error: %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := cfg.ssids(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ssids = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShouldStartAP(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		networks bool
+		psk      string
+		since    time.Duration
+		want     bool
+	}{
+		{name: "first setup", want: true},
+		{name: "first setup with psk", psk: "password1", want: true},
+		{name: "networks in range", networks: true, psk: "password1", since: time.Minute},
+		{name: "networks out of range", networks: true, psk: "password1", since: defaultAPAfter, want: true},
+		// An open access point would let anyone add a network.
+		{name: "open with networks", networks: true, since: time.Hour},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, _, _ := newTestCtx(t)
+			if !tc.networks {
+				w.cfg.Networks = nil
+			}
+			w.cfg.AP = &apConfig{SSID: "van-setup", PSK: tc.psk}
+			if err := w.cfg.init(); err != nil {
+				t.Fatal(err)
+			}
+			w.caps = capabilities{AP: true, APPSK: true}
+			w.lastConnected = time.Now().Add(-tc.since)
+			if got := w.shouldStartAP(); got != tc.want {
+				t.Errorf("shouldStartAP = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/wifi/iface"
+	"github.com/mdlayher/wifi"
+)
+
+// interfacePollInterval is how often waitForInterface looks for the WiFi
+// interface.
+const interfacePollInterval = 2 * time.Second
+
+type wifiCtx struct {
+	// config
+	cl   nl80211
+	intf *wifi.Interface
+	caps capabilities
+	cfg  *wifiConfig
+	cs   iface.Configurer
+
+	// state
+	dhcp *dhcpMachine
+	// static is the static configuration that is applied, if any.
+	static *staticConfig
+	// network and bssid are what the interface is connected or
+	// connecting to; network is nil for networks not in cfg.
+	network *network
+	bssid   net.HardwareAddr
+	// connecting is when the pending connection attempt started.
+	connecting time.Time
+	// weakSince is when the signal dropped below cfg.RoamRSSI.
+	weakSince time.Time
+	lastScan  time.Time
+	// failed holds access points to skip until the given time.
+	failed map[string]time.Time
+	// lastConnected is when the interface was last seen associated.
+	lastConnected time.Time
+
+	// ap is the running access point, if any.
+	ap *accessPoint
+	// configPaths are the config files, the first of which the setup
+	// page writes, and loadConfig reads them again.
+	configPaths []string
+	loadConfig  func() (*wifiConfig, error)
+	// saved receives when the setup page saved a network, wake
+	// additionally runs the control loop right away.
+	saved chan struct{}
+	wake  chan struct{}
+	// scanMu guards the interface type against the setup page.
+	scanMu sync.Mutex
+
+	// status is published to Home Assistant if configured, whose
+	// reconnect button sends on reconnect.
+	status    linkStatus
+	reconnect chan struct{}
+}
+
+// findInterface returns the interface called name, or the first station
+// interface if name is empty.
+func findInterface(cl nl80211, name string) (*wifi.Interface, error) {
+	interfaces, err := cl.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, intf := range interfaces {
+		if name != "" && intf.Name == name {
+			return intf, nil
+		}
+		// An access point interface is one a previous run did not
+		// switch back, see stationMode.
+		if name == "" && (intf.Type == wifi.InterfaceTypeStation || intf.Type == wifi.InterfaceTypeAP) && intf.Name != "" {
+			return intf, nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("WiFi interface %s not found", name)
+	}
+	return nil, fmt.Errorf("no WiFi station or access point interface found")
+}
+
+// waitForInterface waits for findInterface to succeed.
+func waitForInterface(cl nl80211, name string) *wifi.Interface {
+	start := time.Now()
+	lastLog := start
+	for {
+		intf, err := findInterface(cl, name)
+		if err == nil {
+			return intf
+		}
+		if time.Since(lastLog) >= 30*time.Second {
+			log.Printf("still waiting after %v: %v", time.Since(start).Round(time.Second), err)
+			lastLog = time.Now()
+		}
+		time.Sleep(interfacePollInterval)
+	}
+}
+
+func (w *wifiCtx) control1() error {
+	select {
+	case <-w.reconnect:
+		return w.reconnectNow()
+	default:
+	}
+	if w.ap != nil {
+		return w.controlAP()
+	}
+	intf := w.intf
+	stationInfos, err := w.cl.StationInfo(intf)
+	if err != nil && !errors.Is(err, os.ErrNotExist) /* not connected */ {
+		if errors.Is(err, syscall.ENODEV) {
+			// The interface went away, e.g. a USB dongle was replugged.
+			// Wait for it under its name, which the netlink socket and
+			// its link events are bound to.
+			w.dhcp.disconnected("interface went away")
+			found, ferr := findInterface(w.cl, w.intf.Name)
+			if ferr != nil {
+				return ferr
+			}
+			w.intf = found
+			w.dhcp.intf = found.Name
+			w.probeCapabilities()
+			if serr := w.stationMode(); serr != nil {
+				return serr
+			}
+		}
+		return err
+	}
+	for _, sta := range stationInfos {
+		if bytes.Equal(sta.HardwareAddr, net.HardwareAddr{}) {
+			log.Println("empty macaddress")
+			continue
+		}
+		log.Printf("connected to %v for %v, signal %v",
+			sta.HardwareAddr,
+			sta.Connected,
+			sta.Signal)
+		w.lastConnected = time.Now()
+		w.status.station(sta)
+		w.dhcp.station(sta)
+		if !w.connecting.IsZero() || w.bssid.String() != sta.HardwareAddr.String() {
+			w.associated(sta.HardwareAddr)
+		}
+		if err := w.configure(); err != nil {
+			return err
+		}
+		return w.roam(sta.Signal)
+	}
+
+	// disconnected, ensure dhcp client is stopped:
+	w.dhcp.station(nil)
+	w.status.disconnected()
+	if w.connecting.IsZero() && w.network != nil {
+		log.Printf("lost connection to %q (%s)", w.network.SSID, w.bssid)
+	}
+	if w.shouldStartAP() {
+		return w.startAP()
+	}
+	return w.connect()
+}
+
+// probeCapabilities looks up what the driver of the interface supports.
+func (w *wifiCtx) probeCapabilities() {
+	caps, err := w.cl.Capabilities(w.intf)
+	if err != nil {
+		log.Printf("querying %s capabilities: %v", w.intf.Name, err)
+	}
+	w.caps = caps
+	log.Printf("%s supports WPA3-SAE: %v, access point: %v", w.intf.Name, caps.SAE, caps.AP)
+	if w.cfg.AP != nil && !caps.AP {
+		log.Printf("the driver of %s cannot run an access point without hostapd, ap is ignored", w.intf.Name)
+	}
+}
+
+// associated records that the interface joined bssid, which may differ from
+// the access point of the last attempt if the driver roamed by itself.
+func (w *wifiCtx) associated(bssid net.HardwareAddr) {
+	w.connecting = time.Time{}
+	w.weakSince = time.Time{}
+	w.bssid = bssid
+	bss, err := w.cl.BSS(w.intf)
+	if err != nil {
+		log.Printf("looking up BSS: %v", err)
+		return
+	}
+	w.status.joined(bss.SSID, bssid)
+	w.network = w.cfg.lookup(bss.SSID, bssid)
+	if w.network == nil {
+		log.Printf("joined %q (%s), which is not a configured network", bss.SSID, bssid)
+		return
+	}
+	log.Printf("joined %q (%s)", bss.SSID, bssid)
+}
+
+// configure applies the static configuration of the current network, or
+// runs the DHCP client if it has none.
+func (w *wifiCtx) configure() error {
+	var static *staticConfig
+	if w.network != nil {
+		static = w.network.Static
+	}
+	if static == w.static {
+		if static == nil {
+			w.dhcp.ensure()
+		}
+		return nil
+	}
+	w.unconfigure()
+	if static == nil {
+		w.dhcp.ensure()
+		return nil
+	}
+	w.dhcp.stop()
+	if err := static.apply(w.cs); err != nil {
+		return fmt.Errorf("static configuration: %v", err)
+	}
+	w.static = static
+	w.status.configured(static.Address, time.Time{})
+	return nil
+}
+
+// unconfigure removes the static configuration, if any.
+func (w *wifiCtx) unconfigure() {
+	if w.static == nil {
+		return
+	}
+	if err := w.static.clear(w.cs); err != nil {
+		log.Printf("removing static address: %v", err)
+	}
+	w.static = nil
+	w.status.configured("", time.Time{})
+}
+
+// requestReconnect makes the control loop leave the current network and
+// scan again, or stop the access point to try the configured networks.
+func (w *wifiCtx) requestReconnect() {
+	select {
+	case w.reconnect <- struct{}{}:
+	default:
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *wifiCtx) reconnectNow() error {
+	if w.ap != nil {
+		log.Printf("reconnect requested, stopping access point")
+		return w.stopAP()
+	}
+	log.Printf("reconnect requested")
+	w.dhcp.disconnected("reconnect requested")
+	w.unconfigure()
+	if w.bssid != nil {
+		if err := w.cl.Disconnect(w.intf); err != nil {
+			log.Printf("disconnecting: %v", err)
+		}
+	}
+	w.status.disconnected()
+	w.network, w.bssid = nil, nil
+	w.connecting = time.Time{}
+	// Give access points that failed before another chance.
+	w.failed = make(map[string]time.Time)
+	return w.connect()
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/wifi"
+)
+
+// fakeNL is an nl80211 with one interface, whose access points are the
+// scan results. Connect associates right away unless noAssociate is set.
+type fakeNL struct {
+	intf        *wifi.Interface
+	results     []*scanResult
+	noAssociate bool
+
+	// station is the access point the interface is associated with, if
+	// any.
+	station *wifi.StationInfo
+	bss     *wifi.BSS
+
+	connects    []connectParams
+	disconnects int
+	scans       int
+}
+
+var _ nl80211 = (*fakeNL)(nil)
+
+func (f *fakeNL) Interfaces() ([]*wifi.Interface, error) {
+	if f.intf == nil {
+		return nil, nil
+	}
+	intf := *f.intf
+	return []*wifi.Interface{&intf}, nil
+}
+
+// check returns ENODEV for interfaces that went away.
+func (f *fakeNL) check(ifi *wifi.Interface) error {
+	if f.intf == nil || ifi.Index != f.intf.Index {
+		return syscall.ENODEV
+	}
+	return nil
+}
+
+func (f *fakeNL) StationInfo(ifi *wifi.Interface) ([]*wifi.StationInfo, error) {
+	if err := f.check(ifi); err != nil {
+		return nil, err
+	}
+	if f.station == nil {
+		return nil, os.ErrNotExist
+	}
+	sta := *f.station
+	return []*wifi.StationInfo{&sta}, nil
+}
+
+func (f *fakeNL) BSS(ifi *wifi.Interface) (*wifi.BSS, error) {
+	if err := f.check(ifi); err != nil {
+		return nil, err
+	}
+	if f.bss == nil {
+		return nil, os.ErrNotExist
+	}
+	return f.bss, nil
+}
+
+func (f *fakeNL) Scan(ifi *wifi.Interface, ssids []string) ([]*scanResult, error) {
+	if err := f.check(ifi); err != nil {
+		return nil, err
+	}
+	f.scans++
+	return f.results, nil
+}
+
+func (f *fakeNL) Capabilities(ifi *wifi.Interface) (capabilities, error) {
+	return capabilities{}, f.check(ifi)
+}
+
+func (f *fakeNL) Connect(ifi *wifi.Interface, p connectParams) error {
+	if err := f.check(ifi); err != nil {
+		return err
+	}
+	f.connects = append(f.connects, p)
+	if !f.noAssociate {
+		f.associate(p.SSID, p.BSSID, 0)
+	}
+	return nil
+}
+
+// associate makes the interface associated with bssid for connected.
+func (f *fakeNL) associate(ssid string, bssid net.HardwareAddr, connected time.Duration) {
+	f.station = &wifi.StationInfo{HardwareAddr: bssid, Connected: connected, Signal: -60}
+	f.bss = &wifi.BSS{SSID: ssid, BSSID: bssid}
+}
+
+func (f *fakeNL) Disconnect(ifi *wifi.Interface) error {
+	f.disconnects++
+	f.station, f.bss = nil, nil
+	return f.check(ifi)
+}
+
+func (f *fakeNL) SetType(ifi *wifi.Interface, typ wifi.InterfaceType) error {
+	if err := f.check(ifi); err != nil {
+		return err
+	}
+	f.intf.Type = typ
+	return nil
+}
+
+func (f *fakeNL) StartAP(ifi *wifi.Interface, p apParams) error { return f.check(ifi) }
+func (f *fakeNL) StopAP(ifi *wifi.Interface) error              { return f.check(ifi) }
+func (f *fakeNL) Close() error                                  { return nil }
+
+// fakeRunner records DHCP clients instead of running /gokrazy/dhcp.
+type fakeRunner struct {
+	mu    sync.Mutex
+	procs []*fakeProcess
+	err   error
+}
+
+func (r *fakeRunner) start(name string, out io.Writer) (dhcpProcess, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	p := &fakeProcess{out: out, done: make(chan error, 1), gone: make(chan struct{})}
+	r.procs = append(r.procs, p)
+	return p, nil
+}
+
+func (r *fakeRunner) started() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.procs)
+}
+
+// last returns the DHCP client started last.
+func (r *fakeRunner) last() *fakeProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.procs[len(r.procs)-1]
+}
+
+type fakeProcess struct {
+	out  io.Writer
+	done chan error
+	// gone is closed once the client exited.
+	gone chan struct{}
+	once sync.Once
+}
+
+func (p *fakeProcess) kill() { p.exit(errors.New("signal: killed")) }
+
+func (p *fakeProcess) wait() error { return <-p.done }
+
+// exit makes the client exit with err, unless it exited already.
+func (p *fakeProcess) exit(err error) {
+	p.once.Do(func() {
+		close(p.gone)
+		p.done <- err
+	})
+}
+
+func (p *fakeProcess) exited() bool {
+	select {
+	case <-p.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+// ack makes the client log an acknowledgement of address.
+func (p *fakeProcess) ack(address string) {
+	io.WriteString(p.out, "2023/01/01 00:00:00 DHCPACK: IP "+address+", router 192.168.1.1\n")
+}
+
+var (
+	ap1 = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	ap2 = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// newTestCtx returns a wifiCtx for the network "home" whose access points
+// ap1 and ap2 are in range.
+func newTestCtx(t *testing.T) (*wifiCtx, *fakeNL, *fakeRunner) {
+	t.Helper()
+	cfg := &wifiConfig{Networks: []*network{{SSID: "home", PSK: "password1"}}}
+	if err := cfg.init(); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNL{
+		intf: &wifi.Interface{Index: 3, Name: "wlan0", Type: wifi.InterfaceTypeStation},
+		results: []*scanResult{
+			{SSID: "home", BSSID: ap1, Signal: -60, AKMs: []uint32{akmPSK}},
+			{SSID: "home", BSSID: ap2, Signal: -70, AKMs: []uint32{akmPSK}},
+			{SSID: "cafe", BSSID: net.HardwareAddr{0x02, 0, 0, 0, 0, 9}, Signal: -40},
+		},
+	}
+	r := &fakeRunner{}
+	intf, err := findInterface(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &wifiCtx{
+		cl:            f,
+		intf:          intf,
+		cfg:           cfg,
+		cs:            &fakeConfigurer{},
+		dhcp:          newDHCPMachine(intf.Name, r),
+		failed:        make(map[string]time.Time),
+		lastConnected: time.Now(),
+		saved:         make(chan struct{}, 1),
+		wake:          make(chan struct{}, 1),
+		reconnect:     make(chan struct{}, 1),
+	}
+	return w, f, r
+}
+
+func control(t *testing.T, w *wifiCtx) {
+	t.Helper()
+	if err := w.control1(); err != nil {
+		t.Fatalf("control1: %v", err)
+	}
+}
+
+func dhcpState(w *wifiCtx) linkState {
+	w.dhcp.mu.Lock()
+	defer w.dhcp.mu.Unlock()
+	return w.dhcp.state
+}
+
+func TestControlAssociate(t *testing.T) {
+	w, f, r := newTestCtx(t)
+
+	// Not associated: scan and connect to the strongest access point.
+	control(t, w)
+	if len(f.connects) != 1 {
+		t.Fatalf("got %d connection attempts, want 1", len(f.connects))
+	}
+	p := f.connects[0]
+	if p.SSID != "home" || !bytes.Equal(p.BSSID, ap1) || p.Security != securityPSK || p.AKM != akmPSK || !bytes.Equal(p.PMK, pmk("home", "password1")) {
+		t.Errorf("connected with %+v, want home at %s with the PMK of its psk", p, ap1)
+	}
+	if got := dhcpState(w); got != linkAssociating {
+		t.Errorf("link state = %v, want %v", got, linkAssociating)
+	}
+
+	// Associated: start the DHCP client and record the network.
+	control(t, w)
+	if w.network == nil || w.network.SSID != "home" || !bytes.Equal(w.bssid, ap1) || !w.connecting.IsZero() {
+		t.Errorf("after association: network %v, bssid %s, connecting %v", w.network, w.bssid, w.connecting)
+	}
+	if got := dhcpState(w); got != linkAssociated {
+		t.Errorf("link state = %v, want %v", got, linkAssociated)
+	}
+	if r.started() != 1 {
+		t.Fatalf("started %d DHCP clients, want 1", r.started())
+	}
+	r.last().ack("192.168.1.5/24")
+	if got := dhcpState(w); got != linkLeased {
+		t.Errorf("link state = %v, want %v", got, linkLeased)
+	}
+
+	// Staying associated neither reconnects nor restarts the client.
+	f.station.Connected = 15 * time.Second
+	control(t, w)
+	if len(f.connects) != 1 || r.started() != 1 || f.scans != 1 {
+		t.Errorf("steady state: %d connects, %d DHCP clients, %d scans, want 1 each", len(f.connects), r.started(), f.scans)
+	}
+	if got := dhcpState(w); got != linkLeased {
+		t.Errorf("link state = %v, want %v", got, linkLeased)
+	}
+}
+
+func TestControlDriverRoamed(t *testing.T) {
+	w, f, r := newTestCtx(t)
+	f.noAssociate = true
+	control(t, w)
+
+	// The driver associated with another access point than requested.
+	f.associate("home", ap2, time.Second)
+	control(t, w)
+	if !bytes.Equal(w.bssid, ap2) || w.network == nil {
+		t.Errorf("bssid = %s, network %v, want %s of home", w.bssid, w.network, ap2)
+	}
+	if r.started() != 1 {
+		t.Errorf("started %d DHCP clients, want 1", r.started())
+	}
+}
+
+func TestControlReconnect(t *testing.T) {
+	w, f, r := newTestCtx(t)
+	control(t, w)
+	control(t, w)
+	r.last().ack("192.168.1.5/24")
+	first := r.last()
+
+	// Losing the association stops the DHCP client and connects again.
+	f.station, f.bss = nil, nil
+	f.noAssociate = true
+	w.lastScan = time.Time{}
+	control(t, w)
+	if got := dhcpState(w); got != linkAssociating {
+		t.Errorf("link state = %v, want %v", got, linkAssociating)
+	}
+	if len(f.connects) != 2 {
+		t.Errorf("got %d connection attempts, want 2", len(f.connects))
+	}
+	if !first.exited() {
+		t.Errorf("DHCP client still running after the association was lost")
+	}
+
+	f.associate("home", ap1, time.Second)
+	control(t, w)
+	if got := dhcpState(w); got != linkAssociated {
+		t.Errorf("link state = %v, want %v", got, linkAssociated)
+	}
+	if r.started() != 2 {
+		t.Errorf("started %d DHCP clients, want 2", r.started())
+	}
+
+	// A connection younger than the last station info means the driver
+	// reconnected in between, so the lease may be stale.
+	r.last().ack("192.168.1.5/24")
+	f.station.Connected = 10 * time.Minute
+	control(t, w)
+	f.station.Connected = time.Second
+	control(t, w)
+	if r.started() != 3 || dhcpState(w) != linkAssociated {
+		t.Errorf("after reconnect: %d DHCP clients in state %v, want 3 in %v", r.started(), dhcpState(w), linkAssociated)
+	}
+}
+
+func TestControlInterfaceGone(t *testing.T) {
+	w, f, r := newTestCtx(t)
+	control(t, w)
+	control(t, w)
+
+	// The dongle was replugged and its interface has a new index, still
+	// in access point mode.
+	f.intf = &wifi.Interface{Index: 7, Name: "wlan0", Type: wifi.InterfaceTypeAP}
+	f.station, f.bss = nil, nil
+	if err := w.control1(); !errors.Is(err, syscall.ENODEV) {
+		t.Fatalf("control1 = %v, want ENODEV", err)
+	}
+	if w.intf.Index != 7 {
+		t.Errorf("interface index = %d, want 7", w.intf.Index)
+	}
+	if got := dhcpState(w); got != linkDisconnected {
+		t.Errorf("link state = %v, want %v", got, linkDisconnected)
+	}
+
+	// The next run uses the new interface.
+	if w.intf.Type != wifi.InterfaceTypeStation {
+		t.Errorf("interface type = %v, want station", w.intf.Type)
+	}
+	w.lastScan = time.Time{}
+	control(t, w)
+	control(t, w)
+	if len(f.connects) != 2 || r.started() != 2 {
+		t.Errorf("got %d connects and %d DHCP clients, want 2 each", len(f.connects), r.started())
+	}
+
+	// Under another name, it is not used.
+	f.intf = &wifi.Interface{Index: 8, Name: "wlan1", Type: wifi.InterfaceTypeStation}
+	if err := w.control1(); err == nil || errors.Is(err, syscall.ENODEV) {
+		t.Errorf("control1 = %v, want an error about wlan0", err)
+	}
+	if w.intf.Index != 7 || w.intf.Name != "wlan0" {
+		t.Errorf("interface = %d %s, want 7 wlan0", w.intf.Index, w.intf.Name)
+	}
+
+	// Without any interface, the error says so.
+	f.intf = nil
+	if err := w.control1(); err == nil {
+		t.Errorf("control1 without interface succeeded")
+	}
+}
+
+func TestControlNoNetworks(t *testing.T) {
+	w, f, r := newTestCtx(t)
+	w.cfg.Networks = nil
+
+	// Associated with a network that is not configured, e.g. after the
+	// last network was removed on the setup page.
+	f.associate("cafe", ap1, time.Second)
+	control(t, w)
+	if w.network != nil || !bytes.Equal(w.bssid, ap1) {
+		t.Errorf("network %v, bssid %s, want no network at %s", w.network, w.bssid, ap1)
+	}
+	if r.started() != 1 || f.scans != 0 {
+		t.Errorf("got %d DHCP clients and %d scans, want 1 and 0", r.started(), f.scans)
+	}
+}
+
+func TestControlScanInterval(t *testing.T) {
+	w, f, _ := newTestCtx(t)
+	f.results = nil
+
+	// Link events can run the control loop back to back.
+	for i := 0; i < 5; i++ {
+		control(t, w)
+	}
+	if f.scans != 1 {
+		t.Errorf("got %d scans, want 1", f.scans)
+	}
+	w.lastScan = w.lastScan.Add(-connectScanInterval)
+	control(t, w)
+	if f.scans != 2 {
+		t.Errorf("got %d scans after %v, want 2", f.scans, connectScanInterval)
+	}
+}
+
+func TestControlPSKSHA256(t *testing.T) {
+	w, f, _ := newTestCtx(t)
+	f.results = []*scanResult{
+		{SSID: "home", BSSID: ap1, Signal: -60, AKMs: []uint32{akmPSKSHA256}},
+		{SSID: "home", BSSID: ap2, Signal: -70, AKMs: []uint32{akmPSK, akmPSKSHA256}},
+	}
+	control(t, w)
+	if len(f.connects) != 1 || f.connects[0].AKM != akmPSKSHA256 {
+		t.Fatalf("connected with %+v, want PSK-SHA256", f.connects)
+	}
+
+	// With both, plain PSK is used.
+	f.results = f.results[1:]
+	f.station, f.bss = nil, nil
+	w.connecting, w.lastScan = time.Time{}, time.Time{}
+	control(t, w)
+	if len(f.connects) != 2 || f.connects[1].AKM != akmPSK {
+		t.Errorf("connected with %+v, want PSK", f.connects[1:])
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/wifi"
+)
+
+const (
+	// dhcpAckTimeout is how long the DHCP client may take for the first
+	// acknowledgement before it is restarted.
+	dhcpAckTimeout = 30 * time.Second
+	// dhcpBackoffMin and dhcpBackoffMax bound how long to wait before
+	// restarting a DHCP client that failed. The wait doubles with every
+	// failure in a row.
+	dhcpBackoffMin = 5 * time.Second
+	dhcpBackoffMax = 5 * time.Minute
+	// dhcpRenewSlack is added to twice the renewal interval before a
+	// lease counts as not renewed.
+	dhcpRenewSlack = time.Minute
+)
+
+// linkState is the state of the link as far as DHCP is concerned.
+type linkState int
+
+const (
+	// linkDisconnected means no access point and no DHCP client.
+	linkDisconnected linkState = iota
+	// linkAssociating means a connection attempt is pending.
+	linkAssociating
+	// linkAssociated means the interface is associated and the DHCP
+	// client is running or waiting for its backoff, unless the network
+	// is configured statically.
+	linkAssociated
+	// linkLeased means the DHCP client got an address.
+	linkLeased
+)
+
+func (s linkState) String() string {
+	switch s {
+	case linkDisconnected:
+		return "disconnected"
+	case linkAssociating:
+		return "associating"
+	case linkAssociated:
+		return "associated"
+	case linkLeased:
+		return "leased"
+	}
+	return fmt.Sprintf("linkState(%d)", int(s))
+}
+
+// dhcpRunner starts DHCP client processes.
+type dhcpRunner interface {
+	// start runs the DHCP client on interface name, writing its log
+	// output to out.
+	start(name string, out io.Writer) (dhcpProcess, error)
+}
+
+// dhcpProcess is a started DHCP client.
+type dhcpProcess interface {
+	kill()
+	// wait blocks until the process exited.
+	wait() error
+}
+
+// execRunner runs the gokrazy DHCP client.
+type execRunner struct{}
+
+func (execRunner) start(name string, out io.Writer) (dhcpProcess, error) {
+	// A Cmd cannot be started twice, so every start gets its own.
+	cmd := exec.Command("/gokrazy/dhcp", "-interface="+name)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// When the wifi process dies, make the kernel send a SIGTERM to
+		// the dhcp process, too. The bake CI test runner uses
+		// exec.CommandContext("wifi") which sends SIGKILL, so trying to
+		// clean up the dhcp process from within wifi is fruitless.
+		Pdeathsig: syscall.SIGTERM,
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = out
+	log.Printf("starting %v", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return execProcess{cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p execProcess) kill()       { p.cmd.Process.Kill() }
+func (p execProcess) wait() error { return p.cmd.Wait() }
+
+// dhcpMachine supervises the DHCP client through the link states
+//
+//	disconnected → associating → associated → leased
+//
+// control1 reports connection attempts and station info, and the DHCP
+// client reports acknowledgements and its exit, from its own goroutine.
+// Only associated and leased run the DHCP client. A client that exits or
+// gets no acknowledgement within dhcpAckTimeout is restarted after a
+// backoff, and so is one that does not renew its lease in time.
+type dhcpMachine struct {
+	intf string
+	run  dhcpRunner
+	now  func() time.Time
+	// changed and leased are called with the new state, and with the
+	// address and time of every acknowledgement.
+	changed func(linkState)
+	leased  func(address string, at time.Time)
+
+	mu    sync.Mutex
+	state linkState
+	// bssid and connected are from the last station info, a connection
+	// that is younger or to another access point is a reconnect.
+	bssid     string
+	connected time.Duration
+
+	proc dhcpProcess
+	// out is the log of proc, to tell its acknowledgements from those
+	// of clients that were stopped.
+	out     *dhcpLog
+	started time.Time
+	// failures counts DHCP client failures in a row, retry is when the
+	// client may be started again.
+	failures int
+	retry    time.Time
+	// lastAck is the time of the last acknowledgement, interval the time
+	// between the last two, which is the renewal interval of the lease.
+	lastAck  time.Time
+	interval time.Duration
+	renewals int
+}
+
+func newDHCPMachine(intf string, run dhcpRunner) *dhcpMachine {
+	return &dhcpMachine{
+		intf:    intf,
+		run:     run,
+		now:     time.Now,
+		changed: func(linkState) {},
+		leased:  func(string, time.Time) {},
+	}
+}
+
+// transition moves to state to. Leaving associated and leased for an
+// earlier state stops the DHCP client and forgets the lease.
+func (m *dhcpMachine) transition(to linkState, reason string) {
+	if to == m.state {
+		return
+	}
+	log.Printf("link %v → %v: %s", m.state, to, reason)
+	if to < linkAssociated {
+		m.stopLocked()
+		m.failures, m.retry = 0, time.Time{}
+		m.bssid, m.connected = "", 0
+	}
+	if to < linkLeased {
+		m.lastAck, m.interval, m.renewals = time.Time{}, 0, 0
+	}
+	m.state = to
+	m.changed(to)
+}
+
+// associating records that a connection attempt started.
+func (m *dhcpMachine) associating() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transition(linkDisconnected, "leaving for a new access point")
+	m.transition(linkAssociating, "connection attempt")
+}
+
+// disconnected records that the interface is not associated and no
+// connection attempt is pending.
+func (m *dhcpMachine) disconnected(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transition(linkDisconnected, reason)
+}
+
+// station records the station info of the access point, or its absence if
+// sta is nil. A pending connection attempt is not given up on here.
+func (m *dhcpMachine) station(sta *wifi.StationInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sta == nil {
+		if m.state >= linkAssociated {
+			m.transition(linkDisconnected, "association lost")
+		}
+		return
+	}
+	bssid := sta.HardwareAddr.String()
+	if m.state >= linkAssociated && (bssid != m.bssid || sta.Connected < m.connected) {
+		// The lease may belong to a different network now.
+		m.transition(linkDisconnected, "reconnected to "+bssid)
+	}
+	if m.state < linkAssociated {
+		m.transition(linkAssociated, "associated with "+bssid)
+	}
+	m.bssid, m.connected = bssid, sta.Connected
+}
+
+// ensure starts the DHCP client if the link is associated and the backoff
+// has passed, and restarts it if it is stuck. It is called on every run of
+// the control loop of a network without static configuration.
+func (m *dhcpMachine) ensure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state < linkAssociated {
+		return
+	}
+	now := m.now()
+	switch {
+	case m.proc == nil:
+		if now.Before(m.retry) {
+			return
+		}
+		// acked waits for mu, so m.out is set by the time it compares.
+		out := &dhcpLog{}
+		out.ack = func(address string) { m.acked(out, address) }
+		p, err := m.run.start(m.intf, out)
+		if err != nil {
+			m.failLocked(fmt.Sprintf("starting: %v", err))
+			return
+		}
+		m.proc, m.out, m.started = p, out, now
+		go func() {
+			m.exited(p, p.wait())
+		}()
+
+	case m.state == linkAssociated && now.Sub(m.started) >= dhcpAckTimeout:
+		m.failLocked(fmt.Sprintf("no DHCP acknowledgement within %v", dhcpAckTimeout))
+
+	case m.state == linkLeased && m.interval > 0 && now.Sub(m.lastAck) > 2*m.interval+dhcpRenewSlack:
+		m.failLocked(fmt.Sprintf("lease not renewed for %v", now.Sub(m.lastAck).Round(time.Second)))
+	}
+}
+
+// stop stops the DHCP client, e.g. for a static configuration.
+func (m *dhcpMachine) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopLocked()
+	if m.state == linkLeased {
+		m.transition(linkAssociated, "DHCP client stopped")
+	}
+}
+
+func (m *dhcpMachine) stopLocked() {
+	if m.proc != nil {
+		m.proc.kill()
+		m.proc, m.out = nil, nil
+	}
+}
+
+// failLocked stops the DHCP client and schedules its restart.
+func (m *dhcpMachine) failLocked(reason string) {
+	m.stopLocked()
+	m.failures++
+	backoff := dhcpBackoffMax
+	if m.failures <= 16 && dhcpBackoffMin<<(m.failures-1) < dhcpBackoffMax {
+		backoff = dhcpBackoffMin << (m.failures - 1)
+	}
+	m.retry = m.now().Add(backoff)
+	log.Printf("dhcp: %s, restarting in %v", reason, backoff)
+	m.transition(linkAssociated, "DHCP client failed")
+}
+
+// acked records an acknowledgement logged to out.
+func (m *dhcpMachine) acked(out *dhcpLog, address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if out != m.out {
+		return
+	}
+	now := m.now()
+	if !m.lastAck.IsZero() {
+		m.interval = now.Sub(m.lastAck)
+		m.renewals++
+	}
+	m.lastAck = now
+	m.failures = 0
+	m.transition(linkLeased, "leased "+address)
+	m.leased(address, now)
+}
+
+// exited records that DHCP client p exited, which it only does on errors.
+func (m *dhcpMachine) exited(p dhcpProcess, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p != m.proc {
+		return // stopped on purpose
+	}
+	m.proc, m.out = nil, nil
+	m.failLocked(fmt.Sprintf("client exited: %v", err))
+}
+
+// dhcpAckPrefix starts what the gokrazy DHCP client logs for every
+// acknowledgement, followed by "IP <address>/<prefix>" and the other
+// options.
+const dhcpAckPrefix = "DHCPACK: "
+
+// dhcpLog passes the output of the DHCP client through and calls ack with
+// the address of every acknowledgement.
+type dhcpLog struct {
+	ack func(address string)
+	buf []byte
+}
+
+func (l *dhcpLog) Write(b []byte) (int, error) {
+	os.Stderr.Write(b)
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.line(string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (l *dhcpLog) line(line string) {
+	i := strings.Index(line, dhcpAckPrefix)
+	if i < 0 || l.ack == nil {
+		return
+	}
+	details := strings.Split(line[i+len(dhcpAckPrefix):], ", ")
+	address, ok := strings.CutPrefix(details[0], "IP ")
+	if !ok {
+		return
+	}
+	l.ack(address)
+}
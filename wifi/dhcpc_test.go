@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/wifi"
+)
+
+// fakeClock is the clock of a dhcpMachine, which only moves on advance.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// newTestMachine returns a dhcpMachine that runs fake clients on a fake
+// clock, and the states it changed to.
+func newTestMachine() (*dhcpMachine, *fakeRunner, *fakeClock, *[]linkState) {
+	r := &fakeRunner{}
+	c := &fakeClock{t: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var states []linkState
+	m := newDHCPMachine("wlan0", r)
+	m.now = c.now
+	m.changed = func(s linkState) { states = append(states, s) }
+	return m, r, c, &states
+}
+
+func sta(bssid net.HardwareAddr, connected time.Duration) *wifi.StationInfo {
+	return &wifi.StationInfo{HardwareAddr: bssid, Connected: connected}
+}
+
+func machineState(m *dhcpMachine) linkState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// leased brings m to linkLeased with ap1 and returns the DHCP client.
+func leased(t *testing.T, m *dhcpMachine, r *fakeRunner) *fakeProcess {
+	t.Helper()
+	m.associating()
+	m.station(sta(ap1, time.Second))
+	m.ensure()
+	if r.started() != 1 {
+		t.Fatalf("started %d DHCP clients, want 1", r.started())
+	}
+	p := r.last()
+	p.ack("192.168.1.5/24")
+	if got := machineState(m); got != linkLeased {
+		t.Fatalf("link state = %v, want %v", got, linkLeased)
+	}
+	return p
+}
+
+func TestDHCPTransitions(t *testing.T) {
+	m, r, c, states := newTestMachine()
+	var address string
+	var at time.Time
+	m.leased = func(a string, t time.Time) { address, at = a, t }
+
+	// Not associated yet: no client.
+	m.ensure()
+	m.associating()
+	m.ensure()
+	if r.started() != 0 {
+		t.Errorf("started %d DHCP clients before association, want 0", r.started())
+	}
+	m.station(sta(ap1, time.Second))
+	m.ensure()
+	if r.started() != 1 {
+		t.Fatalf("started %d DHCP clients, want 1", r.started())
+	}
+	r.last().ack("192.168.1.5/24")
+	if address != "192.168.1.5/24" || !at.Equal(c.now()) {
+		t.Errorf("leased %q at %v, want 192.168.1.5/24 at %v", address, at, c.now())
+	}
+
+	m.station(nil)
+	if !r.last().exited() {
+		t.Errorf("DHCP client still running after the association was lost")
+	}
+	want := []linkState{linkAssociating, linkAssociated, linkLeased, linkDisconnected}
+	if !reflect.DeepEqual(*states, want) {
+		t.Errorf("states = %v, want %v", *states, want)
+	}
+}
+
+func TestDHCPAckTimeout(t *testing.T) {
+	m, r, c, _ := newTestMachine()
+	m.associating()
+	m.station(sta(ap1, time.Second))
+	m.ensure()
+	first := r.last()
+
+	c.advance(dhcpAckTimeout - time.Second)
+	m.ensure()
+	if first.exited() {
+		t.Fatalf("DHCP client stopped before %v", dhcpAckTimeout)
+	}
+	c.advance(time.Second)
+	m.ensure()
+	if !first.exited() {
+		t.Fatalf("DHCP client still running after %v without acknowledgement", dhcpAckTimeout)
+	}
+	if got := machineState(m); got != linkAssociated {
+		t.Errorf("link state = %v, want %v", got, linkAssociated)
+	}
+
+	// The restart waits for the backoff.
+	c.advance(dhcpBackoffMin - time.Second)
+	m.ensure()
+	if r.started() != 1 {
+		t.Errorf("restarted the DHCP client within the backoff")
+	}
+	c.advance(time.Second)
+	m.ensure()
+	if r.started() != 2 {
+		t.Errorf("started %d DHCP clients after the backoff, want 2", r.started())
+	}
+}
+
+func TestDHCPBackoff(t *testing.T) {
+	m, r, c, _ := newTestMachine()
+	r.err = errors.New("exec: no such file")
+	m.associating()
+	m.station(sta(ap1, time.Second))
+
+	var got []time.Duration
+	for i := 0; i < 9; i++ {
+		m.ensure()
+		backoff := m.retry.Sub(c.now())
+		got = append(got, backoff)
+		c.advance(backoff)
+	}
+	want := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		80 * time.Second,
+		160 * time.Second,
+		dhcpBackoffMax,
+		dhcpBackoffMax,
+		dhcpBackoffMax,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backoffs = %v, want %v", got, want)
+	}
+
+	// An acknowledgement resets the backoff.
+	r.err = nil
+	m.ensure()
+	r.last().ack("192.168.1.5/24")
+	r.last().exit(errors.New("exit status 1"))
+	waitFor(t, m, func() bool { return m.proc == nil })
+	m.mu.Lock()
+	backoff := m.retry.Sub(c.now())
+	m.mu.Unlock()
+	if backoff != dhcpBackoffMin {
+		t.Errorf("backoff after a lease = %v, want %v", backoff, dhcpBackoffMin)
+	}
+}
+
+// waitFor waits for cond, which is called with m locked, to become true,
+// e.g. once the goroutine waiting for a client handled its exit.
+func waitFor(t *testing.T, m *dhcpMachine, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		m.mu.Lock()
+		ok := cond()
+		m.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("condition not met within 5s")
+}
+
+func TestDHCPRenewal(t *testing.T) {
+	m, r, c, _ := newTestMachine()
+	p := leased(t, m, r)
+
+	// The second acknowledgement tells the renewal interval.
+	const interval = time.Hour
+	c.advance(interval)
+	p.ack("192.168.1.5/24")
+	if m.interval != interval || m.renewals != 1 {
+		t.Fatalf("interval %v after %d renewals, want %v after 1", m.interval, m.renewals, interval)
+	}
+
+	c.advance(2*interval + dhcpRenewSlack)
+	m.ensure()
+	if p.exited() {
+		t.Fatalf("DHCP client stopped at 2×interval plus slack")
+	}
+	c.advance(time.Second)
+	m.ensure()
+	if !p.exited() {
+		t.Fatalf("DHCP client still running after missing its renewals")
+	}
+	if got := machineState(m); got != linkAssociated {
+		t.Errorf("link state = %v, want %v", got, linkAssociated)
+	}
+}
+
+func TestDHCPReconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sta  *wifi.StationInfo
+		// restart is whether the lease may be stale.
+		restart bool
+	}{
+		{name: "same connection", sta: sta(ap1, time.Minute)},
+		{name: "other access point", sta: sta(ap2, time.Minute), restart: true},
+		{name: "younger connection", sta: sta(ap1, 0), restart: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, r, _, states := newTestMachine()
+			first := leased(t, m, r)
+			*states = nil
+
+			m.station(tc.sta)
+			m.ensure()
+			if first.exited() != tc.restart {
+				t.Errorf("DHCP client stopped: %v, want %v", first.exited(), tc.restart)
+			}
+			if tc.restart {
+				want := []linkState{linkDisconnected, linkAssociated}
+				if !reflect.DeepEqual(*states, want) || r.started() != 2 {
+					t.Errorf("states %v with %d DHCP clients, want %v with 2", *states, r.started(), want)
+				}
+			} else if len(*states) != 0 || r.started() != 1 {
+				t.Errorf("states %v with %d DHCP clients, want none with 1", *states, r.started())
+			}
+		})
+	}
+}
+
+func TestDHCPStaleAck(t *testing.T) {
+	m, r, _, _ := newTestMachine()
+	first := leased(t, m, r)
+
+	m.station(sta(ap2, time.Second))
+	m.ensure()
+	if r.started() != 2 {
+		t.Fatalf("started %d DHCP clients, want 2", r.started())
+	}
+
+	// The killed client's last words are not a lease on the new network.
+	first.ack("192.168.1.5/24")
+	if got := machineState(m); got != linkAssociated {
+		t.Errorf("link state after a stale acknowledgement = %v, want %v", got, linkAssociated)
+	}
+	r.last().ack("10.0.0.5/24")
+	if got := machineState(m); got != linkLeased {
+		t.Errorf("link state = %v, want %v", got, linkLeased)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	dhcpLeaseTime = 10 * time.Minute
+	// dhcpMaxLeases caps the pool, the access point is only for setup.
+	dhcpMaxLeases = 32
+)
+
+// DHCP message types and options, from RFC 2131 and RFC 2132.
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+
+	optSubnetMask  = 1
+	optRouter      = 3
+	optDNS         = 6
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMessageType = 53
+	optServerID    = 54
+	optEnd         = 255
+)
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+// dhcpServer hands out addresses to the clients of the access point. It
+// offers itself as router and DNS server so that clients open the setup
+// page.
+type dhcpServer struct {
+	conn net.PacketConn
+	ip   net.IP
+	mask net.IPMask
+
+	mu     sync.Mutex
+	leases map[string]*dhcpLease // by hardware address
+}
+
+type dhcpLease struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// startDHCPServer serves DHCP on interface intf, whose address is ip.
+func startDHCPServer(intf string, ip net.IP, mask net.IPMask) (*dhcpServer, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				// Requests are broadcast, so bind to the interface
+				// instead of the address.
+				if serr = syscall.BindToDevice(int(fd), intf); serr != nil {
+					return
+				}
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":67")
+	if err != nil {
+		return nil, err
+	}
+	s := &dhcpServer{
+		conn:   conn,
+		ip:     ip.To4(),
+		mask:   mask,
+		leases: make(map[string]*dhcpLease),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *dhcpServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *dhcpServer) serve() {
+	buf := make([]byte, 1500)
+	broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		reply, err := s.handle(buf[:n])
+		if err != nil {
+			log.Printf("dhcp: %v", err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		// Clients without an address only get broadcasts.
+		if _, err := s.conn.WriteTo(reply, broadcast); err != nil {
+			log.Printf("dhcp: %v", err)
+		}
+	}
+}
+
+// handle returns the reply to the request in b, if any.
+func (s *dhcpServer) handle(b []byte) ([]byte, error) {
+	if len(b) < 240 || b[0] != 1 /* BOOTREQUEST */ || !bytes.Equal(b[236:240], dhcpMagic) {
+		return nil, nil
+	}
+	if b[1] != 1 || b[2] != 6 {
+		return nil, fmt.Errorf("unsupported hardware type %d", b[1])
+	}
+	mac := net.HardwareAddr(b[28:34])
+	opts := parseDHCPOptions(b[240:])
+	msgType := opts[optMessageType]
+	if len(msgType) != 1 {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch msgType[0] {
+	case dhcpDiscover:
+		ip := s.allocate(mac)
+		if ip == nil {
+			return nil, fmt.Errorf("no address left for %s", mac)
+		}
+		return s.reply(b, dhcpOffer, ip), nil
+
+	case dhcpRequest:
+		if id := opts[optServerID]; id != nil && !net.IP(id).Equal(s.ip) {
+			// The client chose another server.
+			delete(s.leases, mac.String())
+			return nil, nil
+		}
+		requested := net.IP(opts[optRequestedIP])
+		if requested == nil {
+			requested = net.IP(b[12:16]) // ciaddr, when renewing
+		}
+		l := s.leases[mac.String()]
+		if l == nil || !l.ip.Equal(requested) {
+			return s.reply(b, dhcpNak, nil), nil
+		}
+		l.expires = time.Now().Add(dhcpLeaseTime)
+		log.Printf("dhcp: leased %s to %s", l.ip, mac)
+		return s.reply(b, dhcpAck, l.ip), nil
+
+	case dhcpRelease:
+		delete(s.leases, mac.String())
+	}
+	return nil, nil
+}
+
+// allocate returns the address of mac, picking a free one for new clients.
+func (s *dhcpServer) allocate(mac net.HardwareAddr) net.IP {
+	now := time.Now()
+	if l := s.leases[mac.String()]; l != nil {
+		l.expires = now.Add(dhcpLeaseTime)
+		return l.ip
+	}
+	inUse := make(map[string]bool)
+	for key, l := range s.leases {
+		if now.After(l.expires) {
+			delete(s.leases, key)
+			continue
+		}
+		inUse[l.ip.String()] = true
+	}
+	network := s.ip.Mask(s.mask)
+	ones, bits := s.mask.Size()
+	hosts := 1<<(bits-ones) - 2
+	for i := 1; i <= hosts && i <= dhcpMaxLeases+1; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(network)+uint32(i))
+		if ip.Equal(s.ip) || inUse[ip.String()] {
+			continue
+		}
+		// Offers are held for a minute; REQUEST extends them.
+		s.leases[mac.String()] = &dhcpLease{ip: ip, expires: now.Add(time.Minute)}
+		return ip
+	}
+	return nil
+}
+
+// reply builds a BOOTREPLY to req.
+func (s *dhcpServer) reply(req []byte, msgType byte, yiaddr net.IP) []byte {
+	b := make([]byte, 240, 300)
+	b[0] = 2 // BOOTREPLY
+	copy(b[1:3], req[1:3])
+	copy(b[4:8], req[4:8])     // xid
+	copy(b[10:12], req[10:12]) // flags
+	if yiaddr != nil {
+		copy(b[16:20], yiaddr)
+	}
+	copy(b[20:24], s.ip)       // siaddr
+	copy(b[24:28], req[24:28]) // giaddr
+	copy(b[28:44], req[28:44]) // chaddr
+	copy(b[236:240], dhcpMagic)
+	b = append(b, optMessageType, 1, msgType)
+	b = append(b, optServerID, 4)
+	b = append(b, s.ip...)
+	if msgType != dhcpNak {
+		b = append(b, optLeaseTime, 4)
+		b = binary.BigEndian.AppendUint32(b, uint32(dhcpLeaseTime/time.Second))
+		b = append(b, optSubnetMask, 4)
+		b = append(b, s.mask...)
+		b = append(b, optRouter, 4)
+		b = append(b, s.ip...)
+		b = append(b, optDNS, 4)
+		b = append(b, s.ip...)
+	}
+	return append(b, optEnd)
+}
+
+func parseDHCPOptions(b []byte) map[byte][]byte {
+	opts := make(map[byte][]byte)
+	for len(b) > 0 {
+		code := b[0]
+		if code == optEnd {
+			break
+		}
+		if code == 0 { // pad
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			break
+		}
+		opts[code] = b[2 : 2+int(b[1])]
+		b = b[2+int(b[1]):]
+	}
+	return opts
+}
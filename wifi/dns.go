@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// dnsServer answers every A query with the address of the access point, so
+// that clients detect a captive portal and open the setup page.
+type dnsServer struct {
+	conn net.PacketConn
+	ip   net.IP
+}
+
+func startDNSServer(ip net.IP) (*dnsServer, error) {
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort(ip.String(), "53"))
+	if err != nil {
+		return nil, err
+	}
+	s := &dnsServer{conn: conn, ip: ip.To4()}
+	go s.serve()
+	return s, nil
+}
+
+func (s *dnsServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := s.answer(buf[:n]); reply != nil {
+			s.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// answer returns the response to the query in b, or nil for anything but a
+// single question.
+func (s *dnsServer) answer(b []byte) []byte {
+	const headerLen = 12
+	if len(b) < headerLen || b[2]&0x80 != 0 /* response */ || binary.BigEndian.Uint16(b[4:6]) != 1 {
+		return nil
+	}
+	// Find the end of the question: the name, type and class.
+	i := headerLen
+	for i < len(b) && b[i] != 0 {
+		if b[i]&0xc0 != 0 {
+			return nil // no compression in questions
+		}
+		i += 1 + int(b[i])
+	}
+	i++
+	if i+4 > len(b) {
+		return nil
+	}
+	qtype, qclass := binary.BigEndian.Uint16(b[i:]), binary.BigEndian.Uint16(b[i+2:])
+	question := b[headerLen : i+4]
+
+	reply := make([]byte, headerLen, headerLen+len(question)+16)
+	copy(reply, b[:2])                       // ID
+	reply[2] = 0x84 | b[2]&0x01              // response, authoritative, RD copied
+	reply[3] = 0x80                          // recursion available, no error
+	binary.BigEndian.PutUint16(reply[4:], 1) // questions
+	reply = append(reply, question...)
+	if qtype != 1 /* A */ || qclass != 1 /* IN */ {
+		// No AAAA and the like, so clients fall back to IPv4.
+		return reply
+	}
+	binary.BigEndian.PutUint16(reply[6:], 1) // answers
+	reply = append(reply, 0xc0, headerLen)   // pointer to the question name
+	reply = append(reply, 0, 1, 0, 1)        // A, IN
+	reply = binary.BigEndian.AppendUint32(reply, 60)
+	reply = append(reply, 0, 4)
+	return append(reply, s.ip...)
+}
@@ -1,21 +1,37 @@
 module github.com/alf632/gokrazy-ha/wifi
 
-go 1.18
+go 1.21.1
 
 require (
 	github.com/gokrazy/gokrazy v0.0.0-20200525165608-c2116a79ed31
-	github.com/gokrazy/internal v0.0.0-20231010202000-a93c67aeb340
+	github.com/gokrazy/internal v0.0.0-20231010202000-a93c67aeb340 // indirect
 	github.com/mdlayher/wifi v0.0.0-20220330172155-a44c70b6d3c8
-	golang.org/x/sys v0.1.0
+	golang.org/x/sys v0.7.0
 )
 
 require (
+	dario.cat/mergo v1.0.0 // indirect
+	github.com/W-Floyd/ha-mqtt-iot v0.0.0-20230406181311-8b8c6bf30434 // indirect
+	github.com/denisbrodbeck/machineid v1.0.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.2 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/iancoleman/strcase v0.2.0 // indirect
 	github.com/josharian/native v1.0.0 // indirect
-	github.com/mdlayher/genetlink v1.2.0 // indirect
-	github.com/mdlayher/netlink v1.6.0 // indirect
 	github.com/mdlayher/socket v0.2.3 // indirect
-	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd // indirect
-	golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 )
+
+require (
+	github.com/alf632/gokrazy-ha/kmodComponent v0.0.0-00010101000000-000000000000
+	github.com/mdlayher/genetlink v1.2.0
+	github.com/mdlayher/netlink v1.6.0
+	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd
+)
+
+replace github.com/alf632/gokrazy-ha/kmodComponent => ../kmodComponent
+
+require github.com/alf632/gokrazy-ha/mqttComponent v0.0.0-00010101000000-000000000000
+
+replace github.com/alf632/gokrazy-ha/mqttComponent => ../mqttComponent
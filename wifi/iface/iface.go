@@ -20,16 +20,65 @@ type ifreqFlags struct {
 	pad   [22]byte
 }
 
-// as per http://lxr.free-electrons.com/source/include/uapi/linux/route.h#L30
+// as per https://manpages.debian.org/jessie/manpages/netdevice.7.en.html
+type ifreqMTU struct {
+	name [16]byte
+	mtu  int32
+	pad  [20]byte
+}
+
+// as per https://elixir.bootlin.com/linux/latest/source/include/uapi/linux/route.h#L31
 type rtentry struct {
-	pad1    uint64
+	pad1    uintptr
 	dst     syscall.RawSockaddrInet4
 	gateway syscall.RawSockaddrInet4
 	genmask syscall.RawSockaddrInet4
 	flags   uint16
-	pad     [512]byte
+	pad2    int16
+	pad3    uintptr
+	pad4    uintptr
+	// metric is one more than the route priority.
+	metric int16
+	dev    *byte
+	mtu    uintptr
+	window uintptr
+	irtt   uint16
+}
+
+// Configurer is the API that Configsocket and Netlinksocket share.
+type Configurer interface {
+	SetAddress(addr net.IP) error
+	SetNetmask(addr net.IPMask) error
+	SetBroadcast(addr net.IP) error
+	Address() (net.IP, error)
+	Netmask() (net.IPMask, error)
+	Flags() (uint16, error)
+	MTU() (int, error)
+	Up() error
+	Down() error
+	Carrier() (bool, error)
+	AddRoute(dst, gateway net.IP, genmask net.IPMask) error
+	DelRoute(dst, gateway net.IP, genmask net.IPMask) error
+	AddRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error
+	DelRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error
+	Close() error
+}
+
+// Addresser is implemented by Configurers that manage addresses besides
+// the primary IPv4 address, such as IPv6 addresses.
+type Addresser interface {
+	AddAddress(addr *net.IPNet) error
+	DelAddress(addr *net.IPNet) error
 }
 
+var (
+	_ Configurer = Configsocket{}
+	_ Configurer = (*Netlinksocket)(nil)
+	_ Addresser  = (*Netlinksocket)(nil)
+)
+
+// Configsocket configures an interface with the legacy ioctls, which only
+// support IPv4.
 type Configsocket struct {
 	fd   int
 	name [16]byte
@@ -59,7 +108,7 @@ func (cs Configsocket) ifreqAddr(request uintptr, addr net.IP) error {
 			Family: syscall.AF_INET,
 		},
 	}
-	copy(req.addr.Addr[:], addr)
+	copy(req.addr.Addr[:], to4(addr))
 
 	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), request, uintptr(unsafe.Pointer(&req))); errno != 0 {
 		return errno
@@ -67,6 +116,51 @@ func (cs Configsocket) ifreqAddr(request uintptr, addr net.IP) error {
 	return nil
 }
 
+func (cs Configsocket) getAddr(request uintptr) (net.IP, error) {
+	req := ifreqAddr{name: cs.name}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), request, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return nil, errno
+	}
+	return net.IPv4(req.addr.Addr[0], req.addr.Addr[1], req.addr.Addr[2], req.addr.Addr[3]).To4(), nil
+}
+
+// to4 returns the 4-byte form of IPv4 addresses, which may be stored in 16
+// bytes.
+func to4(addr net.IP) net.IP {
+	if ip := addr.To4(); ip != nil {
+		return ip
+	}
+	return addr
+}
+
+// Address returns the primary IPv4 address. It fails with EADDRNOTAVAIL if
+// the interface has none.
+func (cs Configsocket) Address() (net.IP, error) {
+	return cs.getAddr(syscall.SIOCGIFADDR)
+}
+
+func (cs Configsocket) Netmask() (net.IPMask, error) {
+	mask, err := cs.getAddr(syscall.SIOCGIFNETMASK)
+	return net.IPMask(mask), err
+}
+
+// Flags returns the interface flags, see the syscall.IFF_* constants.
+func (cs Configsocket) Flags() (uint16, error) {
+	req := ifreqFlags{name: cs.name}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return 0, errno
+	}
+	return req.flags, nil
+}
+
+func (cs Configsocket) MTU() (int, error) {
+	req := ifreqMTU{name: cs.name}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCGIFMTU, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return 0, errno
+	}
+	return int(req.mtu), nil
+}
+
 func (cs Configsocket) SetAddress(addr net.IP) error {
 	return cs.ifreqAddr(syscall.SIOCSIFADDR, addr)
 }
@@ -79,14 +173,14 @@ func (cs Configsocket) SetBroadcast(addr net.IP) error {
 	return cs.ifreqAddr(syscall.SIOCSIFBRDADDR, addr)
 }
 
-func (cs Configsocket) Up() error {
+func (cs Configsocket) setFlags(set, clear uint16) error {
 	req := ifreqFlags{name: cs.name}
 	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
 		return errno
 	}
 
-	req.flags |= syscall.IFF_UP
-	req.flags |= syscall.IFF_RUNNING
+	req.flags |= set
+	req.flags &^= clear
 
 	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
 		return errno
@@ -95,30 +189,55 @@ func (cs Configsocket) Up() error {
 	return nil
 }
 
-func (cs Configsocket) AddRoute(dst, gateway net.IP, genmask net.IPMask) syscall.Errno {
-	req := rtentry{
-		dst:     syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		gateway: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		genmask: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		flags:   syscall.RTF_UP | syscall.RTF_GATEWAY,
-	}
-	copy(req.dst.Addr[:], dst)
-	copy(req.gateway.Addr[:], gateway)
-	copy(req.genmask.Addr[:], genmask)
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCADDRT, uintptr(unsafe.Pointer(&req)))
-	return errno
+func (cs Configsocket) Up() error {
+	return cs.setFlags(syscall.IFF_UP|syscall.IFF_RUNNING, 0)
+}
+
+func (cs Configsocket) Down() error {
+	return cs.setFlags(0, syscall.IFF_UP)
+}
+
+// Carrier reports whether the link is operational, which for WiFi means
+// associated.
+func (cs Configsocket) Carrier() (bool, error) {
+	flags, err := cs.Flags()
+	return flags&syscall.IFF_RUNNING != 0, err
 }
 
-func (cs Configsocket) DelRoute(dst, gateway net.IP, genmask net.IPMask) syscall.Errno {
+func (cs Configsocket) route(request uintptr, dst, gateway net.IP, genmask net.IPMask, metric int) error {
 	req := rtentry{
 		dst:     syscall.RawSockaddrInet4{Family: syscall.AF_INET},
 		gateway: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
 		genmask: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		flags:   syscall.RTF_UP | syscall.RTF_GATEWAY,
+		flags:   syscall.RTF_UP,
+		metric:  int16(metric + 1),
+		dev:     &cs.name[0],
 	}
-	copy(req.dst.Addr[:], dst)
-	copy(req.gateway.Addr[:], gateway)
+	if gateway != nil && !gateway.IsUnspecified() {
+		req.flags |= syscall.RTF_GATEWAY
+	}
+	copy(req.dst.Addr[:], to4(dst))
+	copy(req.gateway.Addr[:], to4(gateway))
 	copy(req.genmask.Addr[:], genmask)
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCDELRT, uintptr(unsafe.Pointer(&req)))
-	return errno
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), request, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (cs Configsocket) AddRoute(dst, gateway net.IP, genmask net.IPMask) error {
+	return cs.route(syscall.SIOCADDRT, dst, gateway, genmask, 0)
+}
+
+func (cs Configsocket) DelRoute(dst, gateway net.IP, genmask net.IPMask) error {
+	return cs.route(syscall.SIOCDELRT, dst, gateway, genmask, 0)
+}
+
+// AddRouteMetric adds a route with the given metric; lower metrics win.
+func (cs Configsocket) AddRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	return cs.route(syscall.SIOCADDRT, dst, gateway, genmask, metric)
+}
+
+func (cs Configsocket) DelRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	return cs.route(syscall.SIOCDELRT, dst, gateway, genmask, metric)
 }
@@ -0,0 +1,547 @@
+package iface
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netlinksocket configures an interface over rtnetlink. Besides the API of
+// Configsocket, it manages IPv6 addresses and routes and reports link and
+// address changes.
+//
+// SetAddress, SetNetmask and SetBroadcast manage the primary IPv4 address
+// like the ioctls do. AddAddress and DelAddress manage addresses of both
+// families.
+type Netlinksocket struct {
+	c    *netlink.Conn
+	name string
+	// events is the connection of Subscribe, if any.
+	events *netlink.Conn
+}
+
+func NewNetlinkSocket(iface string) (*Netlinksocket, error) {
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Netlinksocket{c: c, name: iface}, nil
+}
+
+func (ns *Netlinksocket) Close() error {
+	if ns.events != nil {
+		ns.events.Close()
+	}
+	return ns.c.Close()
+}
+
+// index looks up the interface index every time, as it changes when a USB
+// device is plugged in again.
+func (ns *Netlinksocket) index() (int, error) {
+	intf, err := net.InterfaceByName(ns.name)
+	if err != nil {
+		return 0, err
+	}
+	return intf.Index, nil
+}
+
+func (ns *Netlinksocket) execute(typ netlink.HeaderType, flags netlink.HeaderFlags, data []byte) ([]netlink.Message, error) {
+	return ns.c.Execute(netlink.Message{
+		Header: netlink.Header{Type: typ, Flags: netlink.Request | flags},
+		Data:   data,
+	})
+}
+
+// bytesOf returns the memory of the fixed-size rtnetlink header v.
+func bytesOf[T unix.IfInfomsg | unix.IfAddrmsg | unix.RtMsg](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
+
+// parseHeader copies the fixed-size header at the start of b into v and
+// returns the attributes that follow.
+func parseHeader[T unix.IfInfomsg | unix.IfAddrmsg | unix.RtMsg](b []byte, v *T) ([]byte, error) {
+	n := int(unsafe.Sizeof(*v))
+	if len(b) < n {
+		return nil, fmt.Errorf("short rtnetlink message")
+	}
+	copy(bytesOf(v), b)
+	return b[n:], nil
+}
+
+// link is the state of the interface.
+type link struct {
+	flags   uint32
+	mtu     int
+	carrier bool
+}
+
+func (ns *Netlinksocket) link() (*link, error) {
+	index, err := ns.index()
+	if err != nil {
+		return nil, err
+	}
+	msg := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(index)}
+	msgs, err := ns.execute(unix.RTM_GETLINK, 0, bytesOf(&msg))
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expected 1 link message, got %d", len(msgs))
+	}
+	return parseLink(msgs[0].Data)
+}
+
+func parseLink(b []byte) (*link, error) {
+	var msg unix.IfInfomsg
+	attrs, err := parseHeader(b, &msg)
+	if err != nil {
+		return nil, err
+	}
+	l := &link{flags: msg.Flags}
+	ad, err := netlink.NewAttributeDecoder(attrs)
+	if err != nil {
+		return nil, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.IFLA_MTU:
+			l.mtu = int(ad.Uint32())
+		case unix.IFLA_CARRIER:
+			l.carrier = ad.Uint8() != 0
+		}
+	}
+	return l, ad.Err()
+}
+
+func (ns *Netlinksocket) setFlags(flags uint32) error {
+	index, err := ns.index()
+	if err != nil {
+		return err
+	}
+	msg := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(index),
+		Flags:  flags,
+		Change: unix.IFF_UP,
+	}
+	_, err = ns.execute(unix.RTM_NEWLINK, netlink.Acknowledge, bytesOf(&msg))
+	return err
+}
+
+func (ns *Netlinksocket) Up() error {
+	return ns.setFlags(unix.IFF_UP)
+}
+
+func (ns *Netlinksocket) Down() error {
+	return ns.setFlags(0)
+}
+
+// Flags returns the interface flags, see the syscall.IFF_* constants.
+func (ns *Netlinksocket) Flags() (uint16, error) {
+	l, err := ns.link()
+	if err != nil {
+		return 0, err
+	}
+	return uint16(l.flags), nil
+}
+
+func (ns *Netlinksocket) MTU() (int, error) {
+	l, err := ns.link()
+	if err != nil {
+		return 0, err
+	}
+	return l.mtu, nil
+}
+
+// Carrier reports whether the link is operational, which for WiFi means
+// associated.
+func (ns *Netlinksocket) Carrier() (bool, error) {
+	l, err := ns.link()
+	if err != nil {
+		return false, err
+	}
+	return l.carrier, nil
+}
+
+// address is an address of the interface.
+type address struct {
+	net.IPNet
+	broadcast net.IP
+	secondary bool
+}
+
+func (ns *Netlinksocket) addresses(family int) ([]*address, error) {
+	index, err := ns.index()
+	if err != nil {
+		return nil, err
+	}
+	msg := unix.IfAddrmsg{Family: uint8(family)}
+	msgs, err := ns.execute(unix.RTM_GETADDR, netlink.Dump, bytesOf(&msg))
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*address
+	for _, m := range msgs {
+		a, addrIndex, err := parseAddress(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		if addrIndex == index {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+func parseAddress(b []byte) (*address, int, error) {
+	var msg unix.IfAddrmsg
+	attrs, err := parseHeader(b, &msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	bits := 8 * net.IPv4len
+	if msg.Family == unix.AF_INET6 {
+		bits = 8 * net.IPv6len
+	}
+	a := &address{secondary: msg.Flags&unix.IFA_F_SECONDARY != 0}
+	a.Mask = net.CIDRMask(int(msg.Prefixlen), bits)
+	ad, err := netlink.NewAttributeDecoder(attrs)
+	if err != nil {
+		return nil, 0, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.IFA_ADDRESS:
+			// The peer address on point-to-point links, otherwise
+			// the same as IFA_LOCAL, which IPv6 does not send.
+			if a.IP == nil {
+				a.IP = net.IP(ad.Bytes())
+			}
+		case unix.IFA_LOCAL:
+			a.IP = net.IP(ad.Bytes())
+		case unix.IFA_BROADCAST:
+			a.broadcast = net.IP(ad.Bytes())
+		}
+	}
+	return a, int(msg.Index), ad.Err()
+}
+
+// Addresses returns the IPv4 and IPv6 addresses of the interface.
+func (ns *Netlinksocket) Addresses() ([]*net.IPNet, error) {
+	addrs, err := ns.addresses(unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		ipnet := a.IPNet
+		nets = append(nets, &ipnet)
+	}
+	return nets, nil
+}
+
+func (ns *Netlinksocket) address(typ netlink.HeaderType, flags netlink.HeaderFlags, addr *net.IPNet, broadcast net.IP) error {
+	index, err := ns.index()
+	if err != nil {
+		return err
+	}
+	family, ip := unix.AF_INET6, addr.IP.To16()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family, ip = unix.AF_INET, ip4
+	}
+	ones, _ := addr.Mask.Size()
+	msg := unix.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(ones),
+		Index:     uint32(index),
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.IFA_LOCAL, ip)
+	ae.Bytes(unix.IFA_ADDRESS, ip)
+	if broadcast != nil && family == unix.AF_INET {
+		ae.Bytes(unix.IFA_BROADCAST, broadcast.To4())
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = ns.execute(typ, netlink.Acknowledge|flags, append(bytesOf(&msg), attrs...))
+	return err
+}
+
+// AddAddress adds addr, or updates it if it exists. IPv4 addresses get the
+// broadcast address of their subnet.
+func (ns *Netlinksocket) AddAddress(addr *net.IPNet) error {
+	var broadcast net.IP
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		if ones, _ := addr.Mask.Size(); ones < 31 {
+			broadcast = make(net.IP, net.IPv4len)
+			mask := net.IP(addr.Mask).To4()
+			for i := range broadcast {
+				broadcast[i] = ip4[i] | ^mask[i]
+			}
+		}
+	}
+	return ns.address(unix.RTM_NEWADDR, netlink.Create|netlink.Replace, addr, broadcast)
+}
+
+func (ns *Netlinksocket) DelAddress(addr *net.IPNet) error {
+	return ns.address(unix.RTM_DELADDR, 0, addr, nil)
+}
+
+// primary returns the primary IPv4 address, or EADDRNOTAVAIL like the
+// ioctls.
+func (ns *Netlinksocket) primary() (*address, error) {
+	addrs, err := ns.addresses(unix.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if !a.secondary {
+			return a, nil
+		}
+	}
+	return nil, syscall.EADDRNOTAVAIL
+}
+
+// SetAddress replaces the primary IPv4 address, keeping its prefix length.
+// The unspecified address removes it.
+func (ns *Netlinksocket) SetAddress(addr net.IP) error {
+	ip := addr.To4()
+	if ip == nil {
+		return fmt.Errorf("SetAddress only handles IPv4, use AddAddress for %s", addr)
+	}
+	mask := net.CIDRMask(32, 32)
+	old, err := ns.primary()
+	if err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return err
+	}
+	if old != nil {
+		if old.IP.Equal(ip) {
+			return nil
+		}
+		if err := ns.DelAddress(&old.IPNet); err != nil {
+			return err
+		}
+		mask = old.Mask
+	}
+	if ip.IsUnspecified() {
+		return nil
+	}
+	return ns.AddAddress(&net.IPNet{IP: ip, Mask: mask})
+}
+
+func (ns *Netlinksocket) SetNetmask(mask net.IPMask) error {
+	old, err := ns.primary()
+	if err != nil {
+		return err
+	}
+	if old.Mask.String() == mask.String() {
+		return nil
+	}
+	if err := ns.DelAddress(&old.IPNet); err != nil {
+		return err
+	}
+	return ns.AddAddress(&net.IPNet{IP: old.IP, Mask: mask})
+}
+
+func (ns *Netlinksocket) SetBroadcast(addr net.IP) error {
+	old, err := ns.primary()
+	if err != nil {
+		return err
+	}
+	return ns.address(unix.RTM_NEWADDR, netlink.Create|netlink.Replace, &old.IPNet, addr)
+}
+
+func (ns *Netlinksocket) Address() (net.IP, error) {
+	a, err := ns.primary()
+	if err != nil {
+		return nil, err
+	}
+	return a.IP, nil
+}
+
+func (ns *Netlinksocket) Netmask() (net.IPMask, error) {
+	a, err := ns.primary()
+	if err != nil {
+		return nil, err
+	}
+	return a.Mask, nil
+}
+
+func (ns *Netlinksocket) route(typ netlink.HeaderType, flags netlink.HeaderFlags, dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	index, err := ns.index()
+	if err != nil {
+		return err
+	}
+	family := unix.AF_INET6
+	if dst.To4() != nil {
+		family, dst, gateway = unix.AF_INET, dst.To4(), gateway.To4()
+	}
+	ones, _ := genmask.Size()
+	msg := unix.RtMsg{
+		Family:   uint8(family),
+		Dst_len:  uint8(ones),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+	ae := netlink.NewAttributeEncoder()
+	if ones > 0 {
+		ae.Bytes(unix.RTA_DST, dst)
+	}
+	if gateway != nil && !gateway.IsUnspecified() {
+		msg.Scope = unix.RT_SCOPE_UNIVERSE
+		ae.Bytes(unix.RTA_GATEWAY, gateway)
+	}
+	ae.Uint32(unix.RTA_OIF, uint32(index))
+	ae.Uint32(unix.RTA_PRIORITY, uint32(metric))
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = ns.execute(typ, netlink.Acknowledge|flags, append(bytesOf(&msg), attrs...))
+	return err
+}
+
+// AddRoute adds a route via the interface. IPv6 routes need a 16-byte
+// genmask. It fails with EEXIST if the route exists.
+func (ns *Netlinksocket) AddRoute(dst, gateway net.IP, genmask net.IPMask) error {
+	return ns.AddRouteMetric(dst, gateway, genmask, 0)
+}
+
+func (ns *Netlinksocket) DelRoute(dst, gateway net.IP, genmask net.IPMask) error {
+	return ns.DelRouteMetric(dst, gateway, genmask, 0)
+}
+
+// AddRouteMetric adds a route with the given metric; lower metrics win.
+func (ns *Netlinksocket) AddRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	return ns.route(unix.RTM_NEWROUTE, netlink.Create|netlink.Excl, dst, gateway, genmask, metric)
+}
+
+func (ns *Netlinksocket) DelRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	return ns.route(unix.RTM_DELROUTE, 0, dst, gateway, genmask, metric)
+}
+
+// EventType is the kind of change an Event reports.
+type EventType int
+
+const (
+	// LinkChanged is sent when the flags or the carrier change, e.g.
+	// when WiFi associates or disassociates.
+	LinkChanged EventType = iota
+	AddressAdded
+	AddressRemoved
+)
+
+// Event is a change of the interface.
+type Event struct {
+	Type EventType
+	// Up and Carrier are set for LinkChanged.
+	Up      bool
+	Carrier bool
+	// Address is set for AddressAdded and AddressRemoved.
+	Address *net.IPNet
+}
+
+// Subscribe returns a channel of the link and address changes of the
+// interface. The channel is closed when ns is closed or on receive errors.
+// It can only be called once. RTM_NEWLINK messages that change neither Up
+// nor Carrier, like the wireless extension events of cfg80211, are dropped.
+func (ns *Netlinksocket) Subscribe() (<-chan Event, error) {
+	if ns.events != nil {
+		return nil, fmt.Errorf("already subscribed")
+	}
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{
+		Groups: 1<<(unix.RTNLGRP_LINK-1) |
+			1<<(unix.RTNLGRP_IPV4_IFADDR-1) |
+			1<<(unix.RTNLGRP_IPV6_IFADDR-1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ns.events = c
+	events := make(chan Event, 16)
+	go func() {
+		defer close(events)
+		var last linkFilter
+		for {
+			msgs, err := c.Receive()
+			if errors.Is(err, unix.ENOBUFS) {
+				// Events were dropped, let the receiver look.
+				last = linkFilter{}
+				events <- Event{Type: LinkChanged}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			index, err := ns.index()
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if ev, ok := parseEvent(m, index); ok && last.changed(ev) {
+					events <- ev
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// linkFilter remembers the last LinkChanged event to drop repetitions.
+type linkFilter struct {
+	known       bool
+	up, carrier bool
+}
+
+// changed reports whether ev is not a LinkChanged event, or one whose Up or
+// Carrier differ from the last one.
+func (f *linkFilter) changed(ev Event) bool {
+	if ev.Type != LinkChanged {
+		return true
+	}
+	if f.known && ev.Up == f.up && ev.Carrier == f.carrier {
+		return false
+	}
+	f.known, f.up, f.carrier = true, ev.Up, ev.Carrier
+	return true
+}
+
+func parseEvent(m netlink.Message, index int) (Event, bool) {
+	switch m.Header.Type {
+	case unix.RTM_NEWLINK:
+		var msg unix.IfInfomsg
+		if _, err := parseHeader(m.Data, &msg); err != nil || int(msg.Index) != index {
+			return Event{}, false
+		}
+		l, err := parseLink(m.Data)
+		if err != nil {
+			return Event{}, false
+		}
+		return Event{
+			Type:    LinkChanged,
+			Up:      l.flags&unix.IFF_UP != 0,
+			Carrier: l.carrier || l.flags&unix.IFF_LOWER_UP != 0,
+		}, true
+	case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+		a, addrIndex, err := parseAddress(m.Data)
+		if err != nil || addrIndex != index {
+			return Event{}, false
+		}
+		typ := AddressAdded
+		if m.Header.Type == unix.RTM_DELADDR {
+			typ = AddressRemoved
+		}
+		ipnet := a.IPNet
+		return Event{Type: typ, Address: &ipnet}, true
+	}
+	return Event{}, false
+}
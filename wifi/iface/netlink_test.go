@@ -0,0 +1,30 @@
+package iface
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLinkFilter(t *testing.T) {
+	addr := &net.IPNet{IP: net.IPv4(192, 168, 1, 5), Mask: net.CIDRMask(24, 32)}
+	var f linkFilter
+	for _, tc := range []struct {
+		ev   Event
+		want bool
+	}{
+		{ev: Event{Type: LinkChanged, Up: true}, want: true},
+		// Wireless extension events repeat the link state.
+		{ev: Event{Type: LinkChanged, Up: true}},
+		{ev: Event{Type: LinkChanged, Up: true}},
+		{ev: Event{Type: LinkChanged, Up: true, Carrier: true}, want: true},
+		{ev: Event{Type: AddressAdded, Address: addr}, want: true},
+		{ev: Event{Type: AddressAdded, Address: addr}, want: true},
+		{ev: Event{Type: LinkChanged, Up: true, Carrier: true}},
+		{ev: Event{Type: LinkChanged, Up: true}, want: true},
+		{ev: Event{Type: LinkChanged}, want: true},
+	} {
+		if got := f.changed(tc.ev); got != tc.want {
+			t.Errorf("changed(%+v) = %v, want %v", tc.ev, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/wifi"
+	"golang.org/x/sys/unix"
+)
+
+// scanTimeout bounds how long Scan waits for the driver to finish a scan.
+const scanTimeout = 15 * time.Second
+
+// nl80211 is the part of the nl80211 API the daemon uses. nlClient
+// implements it; the control loop can be driven by a fake instead.
+type nl80211 interface {
+	Interfaces() ([]*wifi.Interface, error)
+	// StationInfo returns os.ErrNotExist if the interface is not
+	// associated.
+	StationInfo(ifi *wifi.Interface) ([]*wifi.StationInfo, error)
+	// BSS returns the BSS the interface is associated with.
+	BSS(ifi *wifi.Interface) (*wifi.BSS, error)
+	// Scan triggers a scan, actively probing for ssids in addition to
+	// the wildcard SSID, and returns the results.
+	Scan(ifi *wifi.Interface, ssids []string) ([]*scanResult, error)
+	// Capabilities returns the features of the driver of ifi.
+	Capabilities(ifi *wifi.Interface) (capabilities, error)
+	Connect(ifi *wifi.Interface, p connectParams) error
+	Disconnect(ifi *wifi.Interface) error
+	// SetType switches ifi between station and access point mode.
+	SetType(ifi *wifi.Interface, typ wifi.InterfaceType) error
+	StartAP(ifi *wifi.Interface, p apParams) error
+	StopAP(ifi *wifi.Interface) error
+	Close() error
+}
+
+// scanResult is a BSS found by a scan.
+type scanResult struct {
+	SSID      string
+	BSSID     net.HardwareAddr
+	Frequency int
+	// Signal is the signal strength in dBm.
+	Signal   int
+	LastSeen time.Duration
+	// Privacy is set if the access point requires encryption.
+	Privacy bool
+	// AKMs are the key management suites of the RSN element, none for
+	// open and WEP networks.
+	AKMs []uint32
+}
+
+// connectParams describes the BSS to connect to.
+type connectParams struct {
+	SSID string
+	// BSSID and Frequency are optional and restrict the connection to
+	// one access point.
+	BSSID     net.HardwareAddr
+	Frequency int
+	Security  security
+	// Passphrase is used for WPA3-SAE, PMK for WPA2-PSK.
+	Passphrase string
+	PMK        []byte
+	// AKM is the key management suite of WPA2-PSK, akmPSK or
+	// akmPSKSHA256, and of WPA3-SAE, akmSAE.
+	AKM uint32
+}
+
+// nlClient implements nl80211 with *wifi.Client and the commands it lacks.
+type nlClient struct {
+	*wifi.Client
+	c      *genetlink.Conn
+	family genetlink.Family
+}
+
+var _ nl80211 = (*nlClient)(nil)
+
+func newNLClient() (*nlClient, error) {
+	cl, err := wifi.New()
+	if err != nil {
+		return nil, err
+	}
+	c, err := genetlink.Dial(nil)
+	if err != nil {
+		cl.Close()
+		return nil, err
+	}
+	family, err := c.GetFamily(unix.NL80211_GENL_NAME)
+	if err != nil {
+		c.Close()
+		cl.Close()
+		return nil, err
+	}
+	return &nlClient{Client: cl, c: c, family: family}, nil
+}
+
+func (c *nlClient) Close() error {
+	c.c.Close()
+	return c.Client.Close()
+}
+
+// execute runs cmd on ifi with the attributes set by params.
+func (c *nlClient) execute(cmd uint8, flags netlink.HeaderFlags, ifi *wifi.Interface, params func(ae *netlink.AttributeEncoder)) ([]genetlink.Message, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(unix.NL80211_ATTR_IFINDEX, uint32(ifi.Index))
+	if params != nil {
+		params(ae)
+	}
+	b, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return c.c.Execute(genetlink.Message{
+		Header: genetlink.Header{Command: cmd, Version: c.family.Version},
+		Data:   b,
+	}, c.family.ID, netlink.Request|flags)
+}
+
+func (c *nlClient) Connect(ifi *wifi.Interface, p connectParams) error {
+	_, err := c.execute(unix.NL80211_CMD_CONNECT, netlink.Acknowledge, ifi, func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(unix.NL80211_ATTR_SSID, []byte(p.SSID))
+		if p.BSSID != nil {
+			ae.Bytes(unix.NL80211_ATTR_MAC, p.BSSID)
+		}
+		if p.Frequency != 0 {
+			ae.Uint32(unix.NL80211_ATTR_WIPHY_FREQ, uint32(p.Frequency))
+		}
+		switch p.Security {
+		case securityOpen:
+			ae.Uint32(unix.NL80211_ATTR_AUTH_TYPE, unix.NL80211_AUTHTYPE_OPEN_SYSTEM)
+		case securityPSK:
+			// The driver does the 4-way handshake.
+			ae.Uint32(unix.NL80211_ATTR_AUTH_TYPE, unix.NL80211_AUTHTYPE_OPEN_SYSTEM)
+			ae.Uint32(unix.NL80211_ATTR_WPA_VERSIONS, unix.NL80211_WPA_VERSION_2)
+			ae.Uint32(unix.NL80211_ATTR_CIPHER_SUITE_GROUP, cipherCCMP)
+			ae.Uint32(unix.NL80211_ATTR_CIPHER_SUITES_PAIRWISE, cipherCCMP)
+			ae.Uint32(unix.NL80211_ATTR_AKM_SUITES, p.AKM)
+			if p.AKM == akmPSKSHA256 {
+				// Access points that only offer PSK-SHA256
+				// require management frame protection.
+				ae.Uint32(unix.NL80211_ATTR_USE_MFP, unix.NL80211_MFP_REQUIRED)
+			}
+			ae.Flag(unix.NL80211_ATTR_WANT_1X_4WAY_HS, true)
+			ae.Bytes(unix.NL80211_ATTR_PMK, p.PMK)
+		case securitySAE:
+			// The driver does the SAE exchange and the 4-way
+			// handshake.
+			ae.Uint32(unix.NL80211_ATTR_AUTH_TYPE, unix.NL80211_AUTHTYPE_SAE)
+			ae.Uint32(unix.NL80211_ATTR_WPA_VERSIONS, unix.NL80211_WPA_VERSION_3)
+			ae.Uint32(unix.NL80211_ATTR_CIPHER_SUITE_GROUP, cipherCCMP)
+			ae.Uint32(unix.NL80211_ATTR_CIPHER_SUITES_PAIRWISE, cipherCCMP)
+			ae.Uint32(unix.NL80211_ATTR_AKM_SUITES, p.AKM)
+			ae.Uint32(unix.NL80211_ATTR_USE_MFP, unix.NL80211_MFP_REQUIRED)
+			ae.Flag(unix.NL80211_ATTR_WANT_1X_4WAY_HS, true)
+			ae.Bytes(unix.NL80211_ATTR_SAE_PASSWORD, []byte(p.Passphrase))
+		}
+	})
+	return err
+}
+
+func (c *nlClient) Capabilities(ifi *wifi.Interface) (capabilities, error) {
+	var caps capabilities
+	// Newer attributes like the extended features are only sent in split
+	// dumps.
+	msgs, err := c.execute(unix.NL80211_CMD_GET_WIPHY, netlink.Dump, ifi, func(ae *netlink.AttributeEncoder) {
+		ae.Flag(unix.NL80211_ATTR_SPLIT_WIPHY_DUMP, true)
+	})
+	if err != nil {
+		return caps, err
+	}
+	for _, m := range msgs {
+		ad, err := netlink.NewAttributeDecoder(m.Data)
+		if err != nil {
+			return caps, err
+		}
+		var phy int
+		var ext []byte
+		var ap, apSME bool
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NL80211_ATTR_WIPHY:
+				phy = int(ad.Uint32())
+			case unix.NL80211_ATTR_EXT_FEATURES:
+				ext = ad.Bytes()
+			case unix.NL80211_ATTR_DEVICE_AP_SME:
+				apSME = true
+			case unix.NL80211_ATTR_SUPPORTED_IFTYPES:
+				ad.Nested(func(nad *netlink.AttributeDecoder) error {
+					for nad.Next() {
+						if nad.Type() == unix.NL80211_IFTYPE_AP {
+							ap = true
+						}
+					}
+					return nil
+				})
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return caps, err
+		}
+		if phy != ifi.PHY {
+			continue
+		}
+		if extFeature(ext, unix.NL80211_EXT_FEATURE_SAE_OFFLOAD) {
+			caps.SAE = true
+		}
+		if extFeature(ext, unix.NL80211_EXT_FEATURE_4WAY_HANDSHAKE_AP_PSK) {
+			caps.APPSK = true
+		}
+		// Without an SME in the driver, authentication and association
+		// of clients need hostapd.
+		if ap && apSME {
+			caps.AP = true
+		}
+	}
+	return caps, nil
+}
+
+func (c *nlClient) SetType(ifi *wifi.Interface, typ wifi.InterfaceType) error {
+	iftype := uint32(unix.NL80211_IFTYPE_STATION)
+	if typ == wifi.InterfaceTypeAP {
+		iftype = unix.NL80211_IFTYPE_AP
+	}
+	_, err := c.execute(unix.NL80211_CMD_SET_INTERFACE, netlink.Acknowledge, ifi, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NL80211_ATTR_IFTYPE, iftype)
+	})
+	return err
+}
+
+func (c *nlClient) StartAP(ifi *wifi.Interface, p apParams) error {
+	head, tail := p.beacon(ifi.HardwareAddr)
+	_, err := c.execute(unix.NL80211_CMD_START_AP, netlink.Acknowledge, ifi, func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(unix.NL80211_ATTR_BEACON_HEAD, head)
+		ae.Bytes(unix.NL80211_ATTR_BEACON_TAIL, tail)
+		ae.Uint32(unix.NL80211_ATTR_BEACON_INTERVAL, beaconInterval)
+		ae.Uint32(unix.NL80211_ATTR_DTIM_PERIOD, 2)
+		ae.Bytes(unix.NL80211_ATTR_SSID, []byte(p.SSID))
+		ae.Uint32(unix.NL80211_ATTR_HIDDEN_SSID, unix.NL80211_HIDDEN_SSID_NOT_IN_USE)
+		ae.Uint32(unix.NL80211_ATTR_WIPHY_FREQ, uint32(p.frequency()))
+		ae.Uint32(unix.NL80211_ATTR_WIPHY_CHANNEL_TYPE, unix.NL80211_CHAN_NO_HT)
+		ae.Uint32(unix.NL80211_ATTR_AUTH_TYPE, unix.NL80211_AUTHTYPE_OPEN_SYSTEM)
+		if p.PMK == nil {
+			return
+		}
+		// The driver does the 4-way handshake with the clients.
+		ae.Flag(unix.NL80211_ATTR_PRIVACY, true)
+		ae.Uint32(unix.NL80211_ATTR_WPA_VERSIONS, unix.NL80211_WPA_VERSION_2)
+		ae.Uint32(unix.NL80211_ATTR_CIPHER_SUITE_GROUP, cipherCCMP)
+		ae.Uint32(unix.NL80211_ATTR_CIPHER_SUITES_PAIRWISE, cipherCCMP)
+		ae.Uint32(unix.NL80211_ATTR_AKM_SUITES, akmPSK)
+		ae.Bytes(unix.NL80211_ATTR_PMK, p.PMK)
+	})
+	return err
+}
+
+func (c *nlClient) StopAP(ifi *wifi.Interface) error {
+	_, err := c.execute(unix.NL80211_CMD_STOP_AP, netlink.Acknowledge, ifi, nil)
+	return err
+}
+
+// extFeature reports whether bit f of the extended features is set.
+func extFeature(ext []byte, f int) bool {
+	return f/8 < len(ext) && ext[f/8]&(1<<(f%8)) != 0
+}
+
+func (c *nlClient) Scan(ifi *wifi.Interface, ssids []string) ([]*scanResult, error) {
+	// Listen for the end of the scan before triggering it.
+	events, err := genetlink.Dial(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+	joined := false
+	for _, g := range c.family.Groups {
+		if g.Name == unix.NL80211_MULTICAST_GROUP_SCAN {
+			if err := events.JoinGroup(g.ID); err != nil {
+				return nil, err
+			}
+			joined = true
+		}
+	}
+	if !joined {
+		return nil, fmt.Errorf("nl80211 has no %s multicast group", unix.NL80211_MULTICAST_GROUP_SCAN)
+	}
+
+	_, err = c.execute(unix.NL80211_CMD_TRIGGER_SCAN, netlink.Acknowledge, ifi, func(ae *netlink.AttributeEncoder) {
+		if ifi.Type == wifi.InterfaceTypeAP {
+			// Scan while beaconing, for the setup page.
+			ae.Uint32(unix.NL80211_ATTR_SCAN_FLAGS, unix.NL80211_SCAN_FLAG_AP)
+		}
+		ae.Nested(unix.NL80211_ATTR_SCAN_SSIDS, func(nae *netlink.AttributeEncoder) error {
+			// The wildcard SSID finds all networks that broadcast
+			// their SSID, the others find hidden networks.
+			nae.Bytes(1, nil)
+			for i, ssid := range ssids {
+				nae.Bytes(uint16(i+2), []byte(ssid))
+			}
+			return nil
+		})
+	})
+	// EBUSY means a scan is running already, whose results are as good.
+	if err != nil && !errors.Is(err, unix.EBUSY) {
+		return nil, fmt.Errorf("triggering scan: %v", err)
+	}
+	if err := waitForScan(events, ifi); err != nil {
+		return nil, err
+	}
+
+	msgs, err := c.execute(unix.NL80211_CMD_GET_SCAN, netlink.Dump, ifi, nil)
+	if err != nil {
+		return nil, err
+	}
+	var results []*scanResult
+	for _, m := range msgs {
+		r, err := parseScanResult(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// waitForScan waits for the scan on ifi to finish.
+func waitForScan(events *genetlink.Conn, ifi *wifi.Interface) error {
+	if err := events.SetReadDeadline(time.Now().Add(scanTimeout)); err != nil {
+		return err
+	}
+	for {
+		msgs, _, err := events.Receive()
+		if err != nil {
+			return fmt.Errorf("waiting for scan results: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Command != unix.NL80211_CMD_NEW_SCAN_RESULTS &&
+				m.Header.Command != unix.NL80211_CMD_SCAN_ABORTED {
+				continue
+			}
+			ad, err := netlink.NewAttributeDecoder(m.Data)
+			if err != nil {
+				return err
+			}
+			index := -1
+			for ad.Next() {
+				if ad.Type() == unix.NL80211_ATTR_IFINDEX {
+					index = int(ad.Uint32())
+				}
+			}
+			if index != ifi.Index {
+				continue
+			}
+			if m.Header.Command == unix.NL80211_CMD_SCAN_ABORTED {
+				return fmt.Errorf("scan on %s aborted", ifi.Name)
+			}
+			return nil
+		}
+	}
+}
+
+// parseScanResult parses one message of a GET_SCAN dump.
+func parseScanResult(b []byte) (*scanResult, error) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+	var r *scanResult
+	for ad.Next() {
+		if ad.Type() != unix.NL80211_ATTR_BSS {
+			continue
+		}
+		r = &scanResult{}
+		ad.Nested(func(nad *netlink.AttributeDecoder) error {
+			for nad.Next() {
+				switch nad.Type() {
+				case unix.NL80211_BSS_BSSID:
+					r.BSSID = net.HardwareAddr(nad.Bytes())
+				case unix.NL80211_BSS_FREQUENCY:
+					r.Frequency = int(nad.Uint32())
+				case unix.NL80211_BSS_SIGNAL_MBM:
+					r.Signal = int(int32(nad.Uint32())) / 100
+				case unix.NL80211_BSS_CAPABILITY:
+					r.Privacy = nad.Uint16()&capabilityPrivacy != 0
+				case unix.NL80211_BSS_SEEN_MS_AGO:
+					r.LastSeen = time.Duration(nad.Uint32()) * time.Millisecond
+				case unix.NL80211_BSS_INFORMATION_ELEMENTS:
+					r.parseIEs(nad.Bytes())
+				}
+			}
+			return nil
+		})
+	}
+	return r, ad.Err()
+}
+
+// Information element IDs.
+const (
+	ieSSID = 0
+	ieRSN  = 48
+)
+
+// capabilityPrivacy is the bit of the BSS capability field that is set if
+// the access point requires encryption.
+const capabilityPrivacy = 1 << 4
+
+// parseIEs picks the fields of r from the information elements of a BSS.
+// Malformed trailing elements are ignored.
+func (r *scanResult) parseIEs(b []byte) {
+	for len(b) >= 2 {
+		id, n := b[0], int(b[1])
+		if len(b) < 2+n {
+			return
+		}
+		data := b[2 : 2+n]
+		b = b[2+n:]
+		switch id {
+		case ieSSID:
+			r.SSID = string(data)
+		case ieRSN:
+			r.parseRSN(data)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// pmk prints the WPA2 pairwise master key of a WiFi network, which the wifi
+// daemon accepts instead of the passphrase.
+//
+// Example:
+//
+//	% go run github.com/alf632/gokrazy-ha/wifi/pmk -ssid home
+//	passphrase: secret
+//	{"ssid": "home", "pmk": "…"}
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func main() {
+	ssid := flag.String("ssid", "", "the ssid of the WiFi network")
+	flag.Parse()
+	if *ssid == "" {
+		log.Fatal("-ssid is required")
+	}
+
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal(err)
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if len(passphrase) < 8 || len(passphrase) > 63 {
+		log.Fatal("the passphrase must have 8 to 63 characters")
+	}
+
+	// The same derivation as IEEE 802.11i and wpa_passphrase.
+	key := pbkdf2.Key([]byte(passphrase), []byte(*ssid), 4096, 32, sha1.New)
+	b, err := json.Marshal(struct {
+		SSID string `json:"ssid"`
+		PMK  string `json:"pmk"`
+	}{*ssid, hex.EncodeToString(key)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
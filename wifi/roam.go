@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// associateTimeout is how long a connection attempt may take before
+	// the access point is given up on.
+	associateTimeout = 30 * time.Second
+	// failBackoff is how long an access point that could not be joined
+	// is skipped.
+	failBackoff = 2 * time.Minute
+	// scanMaxAge drops access points from the scan results that the
+	// driver has not seen recently.
+	scanMaxAge = 30 * time.Second
+	// connectScanInterval is the least time between two scans for a
+	// network to connect to, as link events can run the control loop
+	// much more often than its timer.
+	connectScanInterval = 10 * time.Second
+	// roamScanInterval is how often the daemon scans for a network of
+	// higher priority than the one it is connected to.
+	roamScanInterval = 5 * time.Minute
+	// roamHysteresis is how much stronger in dB another access point of
+	// the same priority has to be to roam to it.
+	roamHysteresis = 8
+)
+
+// candidate is a known network in range.
+type candidate struct {
+	net      *network
+	bss      *scanResult
+	security security
+}
+
+func (c candidate) String() string {
+	return fmt.Sprintf("%q (%s, %d dBm, %v)", c.net.SSID, c.bss.BSSID, c.bss.Signal, c.security)
+}
+
+func (c candidate) params() connectParams {
+	p := connectParams{
+		SSID:      c.net.SSID,
+		BSSID:     c.bss.BSSID,
+		Frequency: c.bss.Frequency,
+		Security:  c.security,
+	}
+	switch c.security {
+	case securityPSK:
+		p.PMK = c.net.key()
+		// Plain PSK works with more drivers, so prefer it.
+		p.AKM = akmPSK
+		if !c.bss.hasAKM(akmPSK) {
+			p.AKM = akmPSKSHA256
+		}
+	case securitySAE:
+		p.Passphrase = c.net.PSK
+		p.AKM = akmSAE
+	}
+	return p
+}
+
+// candidates returns the known networks in results that can be joined
+// with caps, best first: by priority, then by signal strength.
+func (cfg *wifiConfig) candidates(results []*scanResult, caps capabilities) []candidate {
+	var cands []candidate
+	for _, r := range results {
+		if r.LastSeen > scanMaxAge {
+			continue
+		}
+		n := cfg.lookup(r.SSID, r.BSSID)
+		if n == nil {
+			continue
+		}
+		sec, err := n.security(r, caps)
+		if err != nil {
+			log.Printf("skipping %q (%s): %v", r.SSID, r.BSSID, err)
+			continue
+		}
+		cands = append(cands, candidate{net: n, bss: r, security: sec})
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].net.Priority != cands[j].net.Priority {
+			return cands[i].net.Priority > cands[j].net.Priority
+		}
+		return cands[i].bss.Signal > cands[j].bss.Signal
+	})
+	return cands
+}
+
+// scan returns the candidates that did not fail recently.
+func (w *wifiCtx) scan() ([]candidate, error) {
+	results, err := w.cl.Scan(w.intf, w.cfg.ssids())
+	if err != nil {
+		return nil, err
+	}
+	var cands []candidate
+	for _, c := range w.cfg.candidates(results, w.caps) {
+		if time.Now().Before(w.failed[c.bss.BSSID.String()]) {
+			continue
+		}
+		cands = append(cands, c)
+	}
+	return cands, nil
+}
+
+// join starts connecting to c, leaving the current network first if
+// connected.
+func (w *wifiCtx) join(c candidate, connected bool) {
+	w.dhcp.associating()
+	if connected {
+		if err := w.cl.Disconnect(w.intf); err != nil {
+			log.Printf("disconnecting: %v", err)
+		}
+	}
+	log.Printf("connecting to %v", c)
+	w.network, w.bssid = c.net, c.bss.BSSID
+	w.connecting = time.Now()
+	w.weakSince = time.Time{}
+	// -EALREADY means already connected, but misleadingly stringifies to
+	// “operation already in progress”, so the attempt just times out.
+	if err := w.cl.Connect(w.intf, c.params()); err != nil {
+		log.Printf("could not connect: %v", err)
+		w.giveUp()
+	}
+}
+
+// giveUp skips the access point of the current attempt for failBackoff.
+func (w *wifiCtx) giveUp() {
+	w.failed[w.bssid.String()] = time.Now().Add(failBackoff)
+	w.dhcp.disconnected("giving up on " + w.bssid.String())
+	w.network, w.bssid = nil, nil
+	w.connecting = time.Time{}
+}
+
+// connect picks the best network in range and connects to it.
+func (w *wifiCtx) connect() error {
+	if !w.connecting.IsZero() {
+		if time.Since(w.connecting) < associateTimeout {
+			return nil // still associating
+		}
+		log.Printf("could not join %q (%s) within %v", w.network.SSID, w.bssid, associateTimeout)
+		w.giveUp()
+	}
+	w.network, w.bssid = nil, nil
+	if time.Since(w.lastScan) < connectScanInterval {
+		return nil
+	}
+
+	cands, err := w.scan()
+	if err != nil {
+		return fmt.Errorf("scanning: %v", err)
+	}
+	w.lastScan = time.Now()
+	if len(cands) == 0 {
+		log.Printf("no known network in range")
+		return nil
+	}
+	w.join(cands[0], false)
+	return nil
+}
+
+// roam fails over to another access point if the signal has been weaker
+// than cfg.RoamRSSI for cfg.RoamAfter, and moves to a network of higher
+// priority once one comes into range.
+func (w *wifiCtx) roam(signal int) error {
+	if len(w.cfg.Networks) == 0 {
+		// There is nowhere to roam to.
+		return nil
+	}
+	weak := signal < w.cfg.RoamRSSI
+	if !weak {
+		w.weakSince = time.Time{}
+	} else if w.weakSince.IsZero() {
+		log.Printf("signal %d dBm is below %d dBm", signal, w.cfg.RoamRSSI)
+		w.weakSince = time.Now()
+	}
+	weakTooLong := weak && time.Since(w.weakSince) >= time.Duration(w.cfg.RoamAfter)
+	onBest := w.network != nil && w.network.Priority == w.cfg.Networks[0].Priority
+	if !weakTooLong && (onBest || time.Since(w.lastScan) < roamScanInterval) {
+		return nil
+	}
+
+	cands, err := w.scan()
+	if err != nil {
+		return fmt.Errorf("scanning: %v", err)
+	}
+	w.lastScan = time.Now()
+	for _, c := range cands {
+		if c.bss.BSSID.String() == w.bssid.String() || c.bss.Signal < w.cfg.RoamRSSI {
+			continue
+		}
+		better := w.network == nil || c.net.Priority > w.network.Priority
+		if !better && weakTooLong {
+			// Any usable network beats a failing link, but another
+			// access point of the same network has to be clearly
+			// stronger.
+			better = c.net.Priority < w.network.Priority || c.bss.Signal >= signal+roamHysteresis
+		}
+		if better {
+			log.Printf("roaming from %s at %d dBm", w.bssid, signal)
+			w.join(c, true)
+			return nil
+		}
+	}
+	if weakTooLong {
+		log.Printf("no better network in range, staying on %s", w.bssid)
+		w.weakSince = time.Now()
+	}
+	return nil
+}
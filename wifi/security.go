@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// security is how the daemon authenticates to an access point.
+type security int
+
+const (
+	securityOpen security = iota
+	// securityPSK is WPA2-PSK with the 4-way handshake offloaded to the
+	// driver.
+	securityPSK
+	// securitySAE is WPA3-SAE, which the driver has to do by itself as
+	// there is no wpa_supplicant.
+	securitySAE
+)
+
+func (s security) String() string {
+	switch s {
+	case securityOpen:
+		return "open"
+	case securityPSK:
+		return "WPA2-PSK"
+	case securitySAE:
+		return "WPA3-SAE"
+	}
+	return fmt.Sprintf("security(%d)", int(s))
+}
+
+// AKM suites of the RSN element.
+const (
+	akmPSK       = 0x000fac02
+	akmPSKSHA256 = 0x000fac06
+	akmSAE       = 0x000fac08
+	akmOWE       = 0x000fac12
+
+	cipherCCMP = 0x000fac04
+)
+
+// capabilities are the features of the driver that the daemon cares about.
+type capabilities struct {
+	// SAE is set if the driver can do WPA3-SAE authentication itself.
+	SAE bool
+	// AP is set if the driver can run an access point by itself, APPSK
+	// if that access point can use WPA2-PSK.
+	AP    bool
+	APPSK bool
+}
+
+// pmk derives the WPA2 pairwise master key from a passphrase.
+func pmk(ssid, passphrase string) []byte {
+	return pbkdf2.Key([]byte(passphrase), []byte(ssid), 4096, 32, sha1.New)
+}
+
+// security picks how to join bss of n, or explains why it cannot be joined.
+func (n *network) security(bss *scanResult, caps capabilities) (security, error) {
+	if len(bss.AKMs) == 0 {
+		switch {
+		case bss.Privacy:
+			return 0, fmt.Errorf("WEP is not supported")
+		case n.PSK != "" || n.pmk != nil:
+			// Do not send the key to an access point that
+			// impersonates the network.
+			return 0, fmt.Errorf("access point is open but a key is configured")
+		}
+		return securityOpen, nil
+	}
+	if n.PSK == "" && n.pmk == nil {
+		if bss.hasAKM(akmOWE) {
+			// OWE needs a Diffie-Hellman exchange that only
+			// wpa_supplicant implements. Most OWE networks have an
+			// open transition access point, which is used instead.
+			return 0, fmt.Errorf("OWE is not supported")
+		}
+		return 0, fmt.Errorf("access point needs a psk or pmk")
+	}
+	if bss.hasAKM(akmSAE) && n.PSK != "" && caps.SAE {
+		return securitySAE, nil
+	}
+	if bss.hasAKM(akmPSK) || bss.hasAKM(akmPSKSHA256) {
+		return securityPSK, nil
+	}
+	switch {
+	case !bss.hasAKM(akmSAE):
+		return 0, fmt.Errorf("access point uses neither WPA2-PSK nor WPA3-SAE")
+	case n.PSK == "":
+		return 0, fmt.Errorf("WPA3-SAE needs the passphrase, not the pmk")
+	}
+	return 0, fmt.Errorf("driver does not support WPA3-SAE")
+}
+
+func (r *scanResult) hasAKM(akm uint32) bool {
+	for _, a := range r.AKMs {
+		if a == akm {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRSN picks the AKM suites from the body of an RSN element.
+func (r *scanResult) parseRSN(b []byte) {
+	// version, group cipher
+	if len(b) < 2+4+2 {
+		return
+	}
+	b = b[2+4:]
+	n := int(b[0]) | int(b[1])<<8
+	b = b[2:]
+	if len(b) < 4*n+2 {
+		return
+	}
+	b = b[4*n:]
+	n = int(b[0]) | int(b[1])<<8
+	b = b[2:]
+	for i := 0; i < n && len(b) >= 4; i++ {
+		r.AKMs = append(r.AKMs, uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3]))
+		b = b[4:]
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var setupTemplate = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>WiFi setup</title>
+<style>
+body { font-family: sans-serif; max-width: 30em; margin: 1em auto; padding: 0 1em; }
+label { display: block; margin: .4em 0; }
+input[type=text], input[type=password] { width: 100%; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>WiFi setup</h1>
+{{if .Saved}}
+<p>Saved {{.Saved}}. The access point stops now to join it. If that fails, it comes back after a while.</p>
+{{else}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/save">
+{{range .Networks}}
+<label><input type="radio" name="ssid" value="{{.SSID}}"> {{.SSID}} ({{.Signal}} dBm{{if .Secured}}, secured{{end}})</label>
+{{else}}
+<p>No networks found.</p>
+{{end}}
+<label>Other network: <input type="text" name="hidden" placeholder="SSID"></label>
+<label>Passphrase: <input type="password" name="psk"></label>
+<button type="submit">Save</button>
+</form>
+<form method="post" action="/rescan"><button type="submit">Scan again</button></form>
+{{end}}
+</body>
+</html>
+`))
+
+// setupPage serves the page to pick a network in access point mode. Every
+// path leads to it, for captive portal detection.
+type setupPage struct {
+	srv  *http.Server
+	scan func() ([]*scanResult, error)
+	save func(network) error
+
+	mu      sync.Mutex
+	results []*scanResult
+}
+
+type setupNetwork struct {
+	SSID    string
+	Signal  int
+	Secured bool
+}
+
+func startSetupPage(ip net.IP, results []*scanResult, scan func() ([]*scanResult, error), save func(network) error) *setupPage {
+	p := &setupPage{scan: scan, save: save, results: results}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.serveIndex)
+	mux.HandleFunc("/rescan", p.serveRescan)
+	mux.HandleFunc("/save", p.serveSave)
+	p.srv = &http.Server{Handler: mux}
+
+	// Captive portal detection needs port 80, which the gokrazy web
+	// interface may hold already.
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "80"))
+	if err != nil {
+		log.Printf("setup page: %v, using port 8080", err)
+		ln, err = net.Listen("tcp", net.JoinHostPort(ip.String(), "8080"))
+	}
+	if err != nil {
+		log.Printf("setup page: %v", err)
+		return p
+	}
+	log.Printf("serving setup page on http://%s/", ln.Addr())
+	go func() {
+		if err := p.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("setup page: %v", err)
+		}
+	}()
+	return p
+}
+
+func (p *setupPage) Close() error {
+	return p.srv.Close()
+}
+
+// networks returns the networks found by the last scan, strongest first.
+func (p *setupPage) networks() []setupNetwork {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := make(map[string]*scanResult)
+	for _, r := range p.results {
+		if r.SSID == "" {
+			continue
+		}
+		if b, ok := best[r.SSID]; !ok || r.Signal > b.Signal {
+			best[r.SSID] = r
+		}
+	}
+	var networks []setupNetwork
+	for _, r := range best {
+		networks = append(networks, setupNetwork{
+			SSID:    r.SSID,
+			Signal:  r.Signal,
+			Secured: r.Privacy || len(r.AKMs) > 0,
+		})
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].Signal > networks[j].Signal
+	})
+	return networks
+}
+
+func (p *setupPage) render(w http.ResponseWriter, status int, data map[string]any) {
+	data["Networks"] = p.networks()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := setupTemplate.Execute(w, data); err != nil {
+		log.Printf("setup page: %v", err)
+	}
+}
+
+func (p *setupPage) serveIndex(w http.ResponseWriter, r *http.Request) {
+	p.render(w, http.StatusOK, map[string]any{})
+}
+
+func (p *setupPage) serveRescan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	results, err := p.scan()
+	if err != nil {
+		p.render(w, http.StatusOK, map[string]any{"Error": "Scanning failed: " + err.Error()})
+		return
+	}
+	p.mu.Lock()
+	p.results = results
+	p.mu.Unlock()
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (p *setupPage) serveSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	ssid := r.FormValue("hidden")
+	if ssid == "" {
+		ssid = r.FormValue("ssid")
+	}
+	psk := r.FormValue("psk")
+	fail := func(msg string) {
+		p.render(w, http.StatusBadRequest, map[string]any{"Error": msg})
+	}
+	switch {
+	case ssid == "":
+		fail("Pick a network or enter its SSID.")
+		return
+	case len(ssid) > 32:
+		fail("The SSID is longer than 32 bytes.")
+		return
+	case psk != "" && (len(psk) < 8 || len(psk) > 63):
+		fail("The passphrase must have 8 to 63 characters.")
+		return
+	}
+
+	n := network{SSID: ssid}
+	if psk != "" {
+		// Keep the passphrase off the card unless the network needs it
+		// for WPA3-SAE.
+		if p.saeOnly(ssid) {
+			n.PSK = psk
+		} else {
+			n.PMK = hex.EncodeToString(pmk(ssid, psk))
+		}
+	}
+	if err := p.save(n); err != nil {
+		log.Printf("setup page: saving %q: %v", ssid, err)
+		p.render(w, http.StatusInternalServerError, map[string]any{"Error": "Saving failed: " + err.Error()})
+		return
+	}
+	log.Printf("setup page: saved %q", ssid)
+	p.render(w, http.StatusOK, map[string]any{"Saved": ssid})
+}
+
+// saeOnly reports whether the scan found ssid with WPA3-SAE but not WPA2-PSK.
+func (p *setupPage) saeOnly(ssid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sae := false
+	for _, r := range p.results {
+		if r.SSID != ssid {
+			continue
+		}
+		if r.hasAKM(akmPSK) || r.hasAKM(akmPSKSHA256) {
+			return false
+		}
+		sae = sae || r.hasAKM(akmSAE)
+	}
+	return sae
+}
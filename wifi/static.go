@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/alf632/gokrazy-ha/wifi/iface"
+)
+
+// resolvConf is a symlink to /tmp/resolv.conf on gokrazy, which the DHCP
+// client writes as well.
+const resolvConf = "/etc/resolv.conf"
+
+// staticConfig configures the interface instead of DHCP:
+//
+//	"static": {"address": "192.168.1.50/24", "gateway": "192.168.1.1", "dns": ["192.168.1.1"]}
+//
+// address6 and gateway6 add an IPv6 address and default route, e.g.
+// "fd00::50/64" and "fe80::1". metric is the metric of the default routes.
+type staticConfig struct {
+	Address  string   `json:"address"`
+	Gateway  string   `json:"gateway"`
+	Address6 string   `json:"address6"`
+	Gateway6 string   `json:"gateway6"`
+	Metric   int      `json:"metric"`
+	DNS      []string `json:"dns"`
+
+	ip       net.IP
+	mask     net.IPMask
+	gateway  net.IP
+	address6 *net.IPNet
+	gateway6 net.IP
+	dns      []net.IP
+}
+
+func (s *staticConfig) init() error {
+	ip, ipnet, err := net.ParseCIDR(s.Address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("static address %q must be an IPv4 address with prefix length", s.Address)
+	}
+	s.ip, s.mask = ip.To4(), ipnet.Mask
+	if s.Gateway != "" {
+		if s.gateway = net.ParseIP(s.Gateway).To4(); s.gateway == nil {
+			return fmt.Errorf("static gateway %q is not an IPv4 address", s.Gateway)
+		}
+		if !ipnet.Contains(s.gateway) {
+			return fmt.Errorf("static gateway %s is outside of %s", s.Gateway, ipnet)
+		}
+	}
+	if s.Address6 != "" {
+		ip, ipnet, err := net.ParseCIDR(s.Address6)
+		if err != nil || ip.To4() != nil {
+			return fmt.Errorf("static address6 %q must be an IPv6 address with prefix length", s.Address6)
+		}
+		s.address6 = &net.IPNet{IP: ip, Mask: ipnet.Mask}
+	}
+	if s.Gateway6 != "" {
+		if s.gateway6 = net.ParseIP(s.Gateway6); s.gateway6 == nil || s.gateway6.To4() != nil {
+			return fmt.Errorf("static gateway6 %q is not an IPv6 address", s.Gateway6)
+		}
+	}
+	if s.Metric < 0 {
+		return fmt.Errorf("static metric must not be negative")
+	}
+	s.dns = nil
+	for _, d := range s.DNS {
+		ip := net.ParseIP(d)
+		if ip == nil {
+			return fmt.Errorf("invalid DNS server %q", d)
+		}
+		s.dns = append(s.dns, ip)
+	}
+	return nil
+}
+
+// broadcast returns the broadcast address of the subnet.
+func (s *staticConfig) broadcast() net.IP {
+	b := make(net.IP, net.IPv4len)
+	for i := range b {
+		b[i] = s.ip[i] | ^s.mask[i]
+	}
+	return b
+}
+
+// apply configures cs with s, brings the interface up and checks that the
+// address took. IPv6 needs cs to be an iface.Addresser.
+func (s *staticConfig) apply(cs iface.Configurer) error {
+	addresser, ok := cs.(iface.Addresser)
+	if !ok && (s.address6 != nil || s.gateway6 != nil) {
+		return fmt.Errorf("%T does not support IPv6", cs)
+	}
+	if err := cs.SetAddress(s.ip); err != nil {
+		return fmt.Errorf("setting address %s: %v", s.ip, err)
+	}
+	if err := cs.SetNetmask(s.mask); err != nil {
+		return fmt.Errorf("setting netmask %s: %v", net.IP(s.mask), err)
+	}
+	if err := cs.SetBroadcast(s.broadcast()); err != nil {
+		return fmt.Errorf("setting broadcast address %s: %v", s.broadcast(), err)
+	}
+	if err := cs.Up(); err != nil {
+		return fmt.Errorf("setting link up: %v", err)
+	}
+	if s.gateway != nil {
+		err := cs.AddRouteMetric(net.IPv4zero, s.gateway, net.CIDRMask(0, 32), s.Metric)
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("adding default route via %s: %v", s.gateway, err)
+		}
+	}
+	if s.address6 != nil {
+		if err := addresser.AddAddress(s.address6); err != nil {
+			return fmt.Errorf("adding address %s: %v", s.Address6, err)
+		}
+	}
+	if s.gateway6 != nil {
+		err := cs.AddRouteMetric(net.IPv6zero, s.gateway6, net.CIDRMask(0, 128), s.Metric)
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("adding default route via %s: %v", s.gateway6, err)
+		}
+	}
+	if len(s.dns) > 0 {
+		var b bytes.Buffer
+		for _, d := range s.dns {
+			fmt.Fprintf(&b, "nameserver %s\n", d)
+		}
+		if err := os.WriteFile(resolvConf, b.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	addr, err := cs.Address()
+	if err != nil {
+		return fmt.Errorf("reading back address: %v", err)
+	}
+	mask, err := cs.Netmask()
+	if err != nil {
+		return fmt.Errorf("reading back netmask: %v", err)
+	}
+	if !addr.Equal(s.ip) || !bytes.Equal(mask, s.mask) {
+		return fmt.Errorf("address is %s/%s after setting %s", addr, net.IP(mask), s.Address)
+	}
+	flags, err := cs.Flags()
+	if err != nil {
+		return fmt.Errorf("reading back flags: %v", err)
+	}
+	if flags&syscall.IFF_UP == 0 {
+		return fmt.Errorf("interface is down after setting it up")
+	}
+	mtu, err := cs.MTU()
+	if err != nil {
+		return fmt.Errorf("reading back MTU: %v", err)
+	}
+	if s.address6 != nil {
+		log.Printf("configured %s and %s, DNS %v, MTU %d", s.Address, s.Address6, s.DNS, mtu)
+	} else {
+		log.Printf("configured %s, gateway %s, DNS %v, MTU %d", s.Address, s.Gateway, s.DNS, mtu)
+	}
+	return nil
+}
+
+// clear removes the addresses and routes set by apply. Removing the IPv4
+// address also removes the routes via it.
+func (s *staticConfig) clear(cs iface.Configurer) error {
+	addresser, ok := cs.(iface.Addresser)
+	if !ok && (s.address6 != nil || s.gateway6 != nil) {
+		return fmt.Errorf("%T does not support IPv6", cs)
+	}
+	if s.gateway6 != nil {
+		if err := cs.DelRouteMetric(net.IPv6zero, s.gateway6, net.CIDRMask(0, 128), s.Metric); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	if s.address6 != nil {
+		if err := addresser.DelAddress(s.address6); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return err
+		}
+	}
+	return cs.SetAddress(net.IPv4zero)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/alf632/gokrazy-ha/wifi/iface"
+)
+
+// fakeConfigurer is an IPv4-only iface.Configurer, like Configsocket.
+type fakeConfigurer struct {
+	addr      net.IP
+	mask      net.IPMask
+	broadcast net.IP
+	up        bool
+	routes    []string
+}
+
+var _ iface.Configurer = (*fakeConfigurer)(nil)
+
+func (c *fakeConfigurer) SetAddress(addr net.IP) error     { c.addr = addr; return nil }
+func (c *fakeConfigurer) SetNetmask(mask net.IPMask) error { c.mask = mask; return nil }
+func (c *fakeConfigurer) SetBroadcast(addr net.IP) error   { c.broadcast = addr; return nil }
+func (c *fakeConfigurer) Address() (net.IP, error)         { return c.addr, nil }
+func (c *fakeConfigurer) Netmask() (net.IPMask, error)     { return c.mask, nil }
+func (c *fakeConfigurer) MTU() (int, error)                { return 1500, nil }
+func (c *fakeConfigurer) Up() error                        { c.up = true; return nil }
+func (c *fakeConfigurer) Down() error                      { c.up = false; return nil }
+func (c *fakeConfigurer) Carrier() (bool, error)           { return c.up, nil }
+func (c *fakeConfigurer) Close() error                     { return nil }
+
+func (c *fakeConfigurer) Flags() (uint16, error) {
+	if c.up {
+		return syscall.IFF_UP, nil
+	}
+	return 0, nil
+}
+
+func (c *fakeConfigurer) AddRoute(dst, gateway net.IP, genmask net.IPMask) error {
+	return c.AddRouteMetric(dst, gateway, genmask, 0)
+}
+
+func (c *fakeConfigurer) DelRoute(dst, gateway net.IP, genmask net.IPMask) error {
+	return c.DelRouteMetric(dst, gateway, genmask, 0)
+}
+
+func (c *fakeConfigurer) AddRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	c.routes = append(c.routes, (&net.IPNet{IP: dst, Mask: genmask}).String()+" via "+gateway.String())
+	return nil
+}
+
+func (c *fakeConfigurer) DelRouteMetric(dst, gateway net.IP, genmask net.IPMask, metric int) error {
+	return nil
+}
+
+func TestStaticApply(t *testing.T) {
+	s := &staticConfig{Address: "192.168.1.50/24", Gateway: "192.168.1.1"}
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeConfigurer{}
+	if err := s.apply(c); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !c.addr.Equal(net.IPv4(192, 168, 1, 50)) || !c.broadcast.Equal(net.IPv4(192, 168, 1, 255)) || !c.up {
+		t.Errorf("configured %s broadcast %s up %v, want 192.168.1.50 broadcast 192.168.1.255 up", c.addr, c.broadcast, c.up)
+	}
+	if len(c.routes) != 1 || c.routes[0] != "0.0.0.0/0 via 192.168.1.1" {
+		t.Errorf("routes = %q, want the default route via 192.168.1.1", c.routes)
+	}
+	if err := s.clear(c); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if !c.addr.Equal(net.IPv4zero) {
+		t.Errorf("address after clear = %s, want %s", c.addr, net.IPv4zero)
+	}
+}
+
+func TestStaticApplyIPv6Unsupported(t *testing.T) {
+	s := &staticConfig{Address: "192.168.1.50/24", Address6: "fd00::50/64"}
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeConfigurer{}
+	if err := s.apply(c); err == nil {
+		t.Errorf("apply with IPv6 succeeded on an IPv4-only configurer")
+	}
+	if c.addr != nil {
+		t.Errorf("apply configured %s before failing", c.addr)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alf632/gokrazy-ha/mqttComponent"
+	"github.com/mdlayher/wifi"
+)
+
+// statusUpdateInterval is how often the link entities are published, in
+// seconds.
+const statusUpdateInterval = 30
+
+// unknown is the state Home Assistant shows as unknown, e.g. for the signal
+// of a disconnected interface.
+const unknown = "None"
+
+// linkStatus is what control1 knows about the link, for publishing.
+type linkStatus struct {
+	mu sync.Mutex
+	// associated is set while station info reports an access point.
+	associated bool
+	ssid       string
+	bssid      string
+	signal     int
+	txBitrate  int // bits/s
+	rxBitrate  int // bits/s
+	since      time.Time
+	// everAssociated is set once the interface associated, so that the
+	// first association does not count as a reconnect.
+	everAssociated bool
+	reconnects     int
+
+	// address is the configured IPv4 address with prefix, leased is when
+	// the DHCP client last got an acknowledgement.
+	address string
+	leased  time.Time
+	// state is the state of the DHCP state machine.
+	state linkState
+}
+
+// joined records the network the interface associated with.
+func (s *linkStatus) joined(ssid string, bssid net.HardwareAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ssid = ssid
+	s.bssid = bssid.String()
+}
+
+// station records the station info of the access point. A connection
+// younger than the one before counts as reconnect.
+func (s *linkStatus) station(sta *wifi.StationInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since := time.Now().Add(-sta.Connected)
+	// Allow for the time between two control loop runs not matching
+	// the clock exactly.
+	renewed := !s.associated || since.Sub(s.since) > 2*time.Second
+	if renewed && s.everAssociated {
+		s.reconnects++
+	}
+	if renewed {
+		s.since = since
+	}
+	s.associated = true
+	s.everAssociated = true
+	s.bssid = sta.HardwareAddr.String()
+	s.signal = sta.Signal
+	s.txBitrate = sta.TransmitBitrate
+	s.rxBitrate = sta.ReceiveBitrate
+}
+
+func (s *linkStatus) disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.associated = false
+	s.ssid, s.bssid = "", ""
+	s.address = ""
+	s.leased = time.Time{}
+}
+
+// configured records the IPv4 address of the interface, or "" if it has
+// none. leased is the time of the DHCP acknowledgement, if any.
+func (s *linkStatus) configured(address string, leased time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.address = address
+	s.leased = leased
+}
+
+func (s *linkStatus) changed(state linkState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == linkLeased && state < linkLeased {
+		// The address of the lease is about to go, or is gone already.
+		s.address = ""
+		s.leased = time.Time{}
+	}
+	s.state = state
+}
+
+// publish announces the link to Home Assistant. reconnect is called when
+// the reconnect button is pressed.
+func (s *linkStatus) publish(mc *mqttComponent.MqttController, reconnect func()) {
+	sensors := []mqttComponent.Entity{
+		{Name: "wifi link state", ID: "wifi_link_state", Icon: "mdi:wifi-cog", State: s.stateString},
+		{Name: "wifi ssid", ID: "wifi_ssid", Icon: "mdi:wifi", State: s.ssidString},
+		{Name: "wifi bssid", ID: "wifi_bssid", Icon: "mdi:access-point", State: s.bssidString},
+		{Name: "wifi signal", ID: "wifi_signal", DeviceClass: "signal_strength", Unit: "dBm", StateClass: "measurement", State: s.signalString},
+		{Name: "wifi tx bitrate", ID: "wifi_tx_bitrate", DeviceClass: "data_rate", Unit: "Mbit/s", StateClass: "measurement", State: s.txBitrateString},
+		{Name: "wifi rx bitrate", ID: "wifi_rx_bitrate", DeviceClass: "data_rate", Unit: "Mbit/s", StateClass: "measurement", State: s.rxBitrateString},
+		{Name: "wifi link uptime", ID: "wifi_link_uptime", DeviceClass: "duration", Unit: "s", StateClass: "measurement", State: s.uptime},
+		{Name: "wifi address", ID: "wifi_address", Icon: "mdi:ip-network", State: s.addressString},
+		{Name: "wifi dhcp lease", ID: "wifi_dhcp_lease", DeviceClass: "timestamp", State: s.leasedString},
+		{Name: "wifi reconnects", ID: "wifi_reconnects", StateClass: "total_increasing", Icon: "mdi:wifi-refresh", State: s.reconnectCount},
+	}
+	for _, e := range sensors {
+		e.UpdateInterval = statusUpdateInterval
+		mc.AddDevice(e.Sensor())
+	}
+	mc.AddDevice(mqttComponent.Entity{
+		Name:           "wifi connected",
+		ID:             "wifi_connected",
+		DeviceClass:    "connectivity",
+		UpdateInterval: statusUpdateInterval,
+		State:          s.connectivity,
+	}.BinarySensor())
+	mc.AddDevice(mqttComponent.Entity{
+		Name: "wifi reconnect",
+		ID:   "wifi_reconnect",
+		Icon: "mdi:wifi-sync",
+	}.Button(reconnect))
+}
+
+func (s *linkStatus) stateString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.String()
+}
+
+func (s *linkStatus) ssidString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.associated {
+		return "none"
+	}
+	return s.ssid
+}
+
+func (s *linkStatus) bssidString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.associated {
+		return "none"
+	}
+	return s.bssid
+}
+
+func (s *linkStatus) signalString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.associated {
+		return unknown
+	}
+	return strconv.Itoa(s.signal)
+}
+
+func (s *linkStatus) txBitrateString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mbits(s.txBitrate, s.associated)
+}
+
+func (s *linkStatus) rxBitrateString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mbits(s.rxBitrate, s.associated)
+}
+
+func mbits(bitrate int, associated bool) string {
+	if !associated {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(bitrate)/1e6, 'f', 1, 64)
+}
+
+func (s *linkStatus) uptime() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.associated {
+		return "0"
+	}
+	return strconv.Itoa(int(time.Since(s.since).Seconds()))
+}
+
+func (s *linkStatus) addressString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.address == "" {
+		return "none"
+	}
+	return s.address
+}
+
+func (s *linkStatus) leasedString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leased.IsZero() {
+		return unknown
+	}
+	return s.leased.Format(time.RFC3339)
+}
+
+func (s *linkStatus) reconnectCount() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strconv.Itoa(s.reconnects)
+}
+
+func (s *linkStatus) connectivity() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.associated && s.address != "" {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// publishStatus publishes s to Home Assistant if the mqttComponent config
+// and secrets files exist. NewMqttController blocks until the broker is
+// reachable, which may need the WiFi link, so it runs in the background.
+func (w *wifiCtx) publishStatus(config, secrets string) {
+	for _, f := range []string{config, secrets} {
+		if _, err := os.Stat(f); err != nil {
+			log.Printf("not publishing link status: %v", err)
+			return
+		}
+	}
+	go func() {
+		mc := mqttComponent.NewMqttController(mqttComponent.MQTTConfig{
+			ConfigFile:  &config,
+			SecretsFile: &secrets,
+		})
+		w.status.publish(mc, w.requestReconnect)
+	}()
+}
@@ -5,166 +5,50 @@
 //	Create a WiFi configuration file,
 //	either via https://github.com/gokrazy/breakglass,
 //	or by mounting the SD card on the host:
-//	# echo '{"ssid": "I/O Tee"}' > /perm/wifi.json
+//	# echo '{"networks": [{"ssid": "I/O Tee", "priority": 1}, {"ssid": "hotspot", "psk": "secret"}]}' > /perm/wifi.json
 //
 //	Include the wifi package in your gokr-packer command:
 //	% gokr-packer -update=yes \
 //	  github.com/gokrazy/breakglass \
 //	  github.com/gokrazy/wifi
+//
+// If /perm/wifi/mqtt/config.json and secrets.json exist, the SSID, signal,
+// bitrates, address and reconnects of the link are published to Home
+// Assistant, with a button to reconnect. The default broker.json of the mqtt
+// launcher provisions a wifi user for them, with node_id wifi.
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"log"
-	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"sync"
-	"syscall"
 	"time"
 
+	"github.com/alf632/gokrazy-ha/kmodComponent"
 	"github.com/alf632/gokrazy-ha/wifi/iface"
 	"github.com/gokrazy/gokrazy"
-	"github.com/mdlayher/wifi"
-	"golang.org/x/sys/unix"
 )
 
-type wifiConfig struct {
-	SSID      string `json:"ssid"`
-	PSK       string `json:"psk"`
-	INTERFACE string `json:"interface"`
-}
-
-type wifiCtx struct {
-	// config
-	cl         *wifi.Client
-	interfaces []*wifi.Interface
-	cfg        *wifiConfig
-
-	// state
-	dhcpClientMu   sync.Mutex
-	dhcpClient     *exec.Cmd
-	connectedSince time.Duration
-}
-
-func (w *wifiCtx) control1() error {
-Interface:
-	for _, intf := range w.interfaces {
-		log.Println("getting station info for", intf.Name)
-		stationInfos, err := w.cl.StationInfo(intf)
-		if err != nil && !errors.Is(err, os.ErrNotExist) /* not connected */ {
-			log.Println("not connected")
-			return err
-		}
-		for _, sta := range stationInfos {
-			if bytes.Equal(sta.HardwareAddr, net.HardwareAddr{}) {
-				log.Println("empty macaddress")
-				continue
-			}
-			w.dhcpClientMu.Lock()
-			log.Printf("connected to %v for %v, signal %v",
-				sta.HardwareAddr,
-				sta.Connected,
-				sta.Signal)
-			if sta.Connected < w.connectedSince {
-				// reconnected. restart dhcp client
-				if w.dhcpClient.Process != nil {
-					w.dhcpClient.Process.Kill()
-				}
-				w.dhcpClient = nil
-			}
-			if w.dhcpClient != nil {
-				w.dhcpClientMu.Unlock()
-				continue Interface
-			}
-			w.dhcpClient = exec.Command("/gokrazy/dhcp", "-interface="+w.cfg.INTERFACE)
-			w.dhcpClient.SysProcAttr = &syscall.SysProcAttr{
-				// When the wifi process dies, make the kernel send a SIGTERM to
-				// the dhcp process, too. The bake CI test runner uses
-				// exec.CommandContext("wifi") which sends SIGKILL, so trying to
-				// clean up the dhcp process from within wifi is fruitless.
-				Pdeathsig: syscall.SIGTERM,
-			}
-			w.dhcpClient.Stdout = os.Stdout
-			w.dhcpClient.Stderr = os.Stderr
-			log.Printf("starting %v", w.dhcpClient.Args)
-			w.dhcpClient.Start()
-			go func() {
-				w.dhcpClientMu.Lock()
-				dhcpClient := w.dhcpClient
-				w.dhcpClientMu.Unlock()
-				if err := dhcpClient.Wait(); err != nil {
-					log.Printf("dhcp process failed: %v", err)
-				}
-				w.dhcpClientMu.Lock()
-				w.dhcpClient = nil
-				w.dhcpClientMu.Unlock()
-			}()
-			w.dhcpClientMu.Unlock()
-			continue Interface
-		}
-
-		// disconnected, ensure dhcp client is stopped:
-		w.dhcpClientMu.Lock()
-		if w.dhcpClient != nil && w.dhcpClient.Process != nil {
-			w.dhcpClient.Process.Kill()
-		}
-		w.dhcpClient = nil
-		w.dhcpClientMu.Unlock()
-
-		log.Println("connecting...")
-		// Interface is not associated with station, try connecting:
-		if w.cfg.PSK != "" {
-			if err := w.cl.ConnectWPAPSK(intf, w.cfg.SSID, w.cfg.PSK); err != nil {
-				// -EALREADY means already connected, but misleadingly
-				// stringifies to “operation already in progress”
-				log.Printf("could not connect: %v", err)
-			} else {
-				log.Printf("connecting to SSID %q...", w.cfg.SSID)
-			}
-		} else {
-			if err := w.cl.Connect(intf, w.cfg.SSID); err != nil {
-				// -EALREADY means already connected, but misleadingly
-				// stringifies to “operation already in progress”
-				log.Printf("could not connect: %v", err)
-			} else {
-				log.Printf("connecting to SSID %q...", w.cfg.SSID)
-			}
-		}
-	}
-	return nil
-}
-
-var release = func() string {
-	var uts unix.Utsname
-	if err := unix.Uname(&uts); err != nil {
-		fmt.Fprintf(os.Stderr, "minitrd: %v\n", err)
-		os.Exit(1)
-	}
-	return string(uts.Release[:bytes.IndexByte(uts.Release[:], 0)])
-}()
-
-func loadModule(mod string) error {
-	f, err := os.Open(filepath.Join("/lib/modules", release, mod))
+// loadModules loads brcmfmac for the built-in WiFi of the Raspberry Pi and
+// the drivers of WiFi USB dongles that are plugged in.
+func loadModules() error {
+	l, err := kmodComponent.New()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if err := unix.FinitModule(int(f.Fd()), "", 0); err != nil {
-		if err != unix.EEXIST &&
-			err != unix.EBUSY &&
-			err != unix.ENODEV &&
-			err != unix.ENOENT {
-			return fmt.Errorf("FinitModule(%v): %v", mod, err)
+	// brcmfmac-wcc only exists on newer kernels, where brcmfmac cannot
+	// request it itself without modprobe.
+	for _, mod := range []string{"brcmfmac", "brcmfmac-wcc"} {
+		if err := l.Load(mod); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
 		}
 	}
+	if _, err := l.LoadDevices("kernel/drivers/net/wireless"); err != nil {
+		log.Print(err)
+	}
 	return nil
 }
 
@@ -181,96 +65,164 @@ func logic() error {
 		psk = flag.String("psk",
 			"",
 			"if non-empty, the psk of the WiFi network to connect to. if empty, /perm/wifi.json or /etc/wifi.json will be used")
+
+		intfName = flag.String("interface",
+			"",
+			"if non-empty, the WiFi interface to use instead of the interface setting of /perm/wifi.json")
+
+		apSSID = flag.String("ap-ssid",
+			"",
+			"if non-empty, the ssid of the setup access point instead of the ap setting of /perm/wifi.json. the access point starts if there is no config file")
+
+		apPSK = flag.String("ap-psk",
+			"",
+			"the psk of the setup access point set with -ap-ssid, empty for an open access point that only starts while no network is configured")
+
+		mqttConfig = flag.String("mqtt-config",
+			"/perm/wifi/mqtt/config.json",
+			"mqttComponent config file to publish the link status to Home Assistant with, nothing is published if it does not exist")
+
+		mqttSecrets = flag.String("mqtt-secrets",
+			"/perm/wifi/mqtt/secrets.json",
+			"mqttComponent secrets file belonging to -mqtt-config")
 	)
 	flag.Parse()
-	var cfg wifiConfig
-	if *ssid != "" || *disconnect {
-		cfg.SSID = *ssid
-		cfg.PSK = *psk
-	} else {
-		b, err := ioutil.ReadFile("/perm/wifi.json")
-		if err != nil && os.IsNotExist(err) {
-			b, err = ioutil.ReadFile("/etc/wifi.json")
-		}
-		if err != nil {
-			if os.IsNotExist(err) {
-				// No config file? Nothing to do!
-				gokrazy.DontStartOnBoot()
+	configPaths := []string{"/perm/wifi.json", "/etc/wifi.json"}
+	loadConfig := func() (*wifiConfig, error) {
+		cfg := &wifiConfig{}
+		if *ssid != "" || *disconnect {
+			cfg.SSID = *ssid
+			cfg.PSK = *psk
+		} else {
+			var err error
+			cfg, err = readConfig(configPaths...)
+			if os.IsNotExist(err) && *apSSID != "" {
+				// Set up the daemon from the access point.
+				cfg, err = &wifiConfig{}, nil
+			}
+			if err != nil {
+				return nil, err
 			}
-			return err
 		}
-
-		if err := json.Unmarshal(b, &cfg); err != nil {
-			return err
+		if *apSSID != "" {
+			cfg.AP = &apConfig{SSID: *apSSID, PSK: *apPSK}
 		}
+		if *intfName != "" {
+			cfg.INTERFACE = *intfName
+		}
+		if *disconnect {
+			return cfg, nil
+		}
+		return cfg, cfg.init()
 	}
-
-	// modprobe the brcmfmac driver
-	for _, mod := range []string{
-		"kernel/drivers/net/wireless/broadcom/brcm80211/brcmutil/brcmutil.ko",
-		"kernel/drivers/net/wireless/broadcom/brcm80211/brcmfmac/brcmfmac.ko",
-		"kernel/drivers/net/wireless/broadcom/brcm80211/brcmfmac/wcc/brcmfmac-wcc.ko",
-	} {
-		if err := loadModule(mod); err != nil && !os.IsNotExist(err) {
-			return err
+	cfg, err := loadConfig()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// No config file? Nothing to do!
+			gokrazy.DontStartOnBoot()
 		}
+		return err
 	}
 
-	fmt.Println("modules loaded")
-	os.Exit(0)
-
-	cl, err := wifi.New()
-	if err != nil {
+	if err := loadModules(); err != nil {
 		return err
 	}
-	interfaces, err := cl.Interfaces()
+
+	cl, err := newNLClient()
 	if err != nil {
 		return err
 	}
-	if len(interfaces) == 0 {
-		return fmt.Errorf("no interfaces found")
-	}
+	defer cl.Close()
 
-	if *disconnect {
-		for _, intf := range interfaces {
-			if err := cl.Disconnect(intf); err != nil {
-				return err
-			}
-		}
-		return nil
-	}
+	// Drivers of USB dongles register their interface asynchronously, so
+	// wait for it to show up.
+	intf := waitForInterface(cl, cfg.INTERFACE)
 
-	w := &wifiCtx{
-		cl:         cl,
-		interfaces: interfaces,
-		cfg:        &cfg,
+	if *disconnect {
+		return cl.Disconnect(intf)
 	}
 
-	cs, err := iface.NewConfigSocket(cfg.INTERFACE)
+	cs, err := iface.NewNetlinkSocket(intf.Name)
 	if err != nil {
-		return fmt.Errorf("config socket: %v", err)
+		return fmt.Errorf("netlink socket: %v", err)
 	}
 	defer cs.Close()
 
-	b, err := ioutil.ReadFile("/sys/class/net/" + cfg.INTERFACE + "/address")
-	if err != nil {
-		return fmt.Errorf("reading /sys/class/net/"+cfg.INTERFACE+"/address: %v", err)
+	w := &wifiCtx{
+		cl:     cl,
+		intf:   intf,
+		cfg:    cfg,
+		cs:     cs,
+		failed: make(map[string]time.Time),
+
+		lastConnected: time.Now(),
+		configPaths:   configPaths,
+		loadConfig:    loadConfig,
+		saved:         make(chan struct{}, 1),
+		wake:          make(chan struct{}, 1),
+		reconnect:     make(chan struct{}, 1),
+	}
+	w.dhcp = newDHCPMachine(intf.Name, execRunner{})
+	w.dhcp.changed = w.status.changed
+	w.dhcp.leased = w.status.configured
+	if err := w.stationMode(); err != nil {
+		return err
 	}
-	log.Printf("%s MAC address is %s", cfg.INTERFACE, strings.TrimSpace(string(b)))
+	w.probeCapabilities()
+	w.publishStatus(*mqttConfig, *mqttSecrets)
+
+	log.Printf("%s MAC address is %s", intf.Name, intf.HardwareAddr)
 
 	// Ensure the interface is up so that we can send DHCP packets.
 	if err := cs.Up(); err != nil {
-		log.Printf("setting link "+cfg.INTERFACE+" up: %v", err)
+		log.Printf("setting link %s up: %v", intf.Name, err)
 	}
 
+	// Link and address changes, e.g. the interface associating or losing
+	// its connection, run the control loop right away. The timer covers
+	// what does not cause events, like a weak signal.
+	events, err := cs.Subscribe()
+	if err != nil {
+		return fmt.Errorf("subscribing to link events: %v", err)
+	}
 	const controlLoopFrequency = 15 * time.Second
+	timer := time.NewTimer(0)
 	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("link events stopped")
+			}
+			logEvent(intf.Name, ev)
+			// Handle a burst of events at once.
+			for len(events) > 0 {
+				logEvent(intf.Name, <-events)
+			}
+		case <-w.wake:
+		case <-timer.C:
+		}
 		if err := w.control1(); err != nil {
 			log.Printf("control1: %v", err)
 		}
-		time.Sleep(controlLoopFrequency)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(controlLoopFrequency)
+	}
+}
+
+func logEvent(name string, ev iface.Event) {
+	switch ev.Type {
+	case iface.LinkChanged:
+		log.Printf("%s link up: %v, carrier: %v", name, ev.Up, ev.Carrier)
+	case iface.AddressAdded:
+		log.Printf("%s address %s added", name, ev.Address)
+	case iface.AddressRemoved:
+		log.Printf("%s address %s removed", name, ev.Address)
 	}
-	return nil
 }
 
 func main() {
@@ -1,121 +1,40 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"strings"
-	"syscall"
+	"time"
 
-	"github.com/gokrazy/gokrazy"
+	"github.com/alf632/gokrazy-ha/containerComponent"
 )
 
-func podman(args ...string) error {
-	podman := exec.Command("/usr/local/bin/podman", args...)
-	podman.Env = expandPath(os.Environ())
-	podman.Env = append(podman.Env, "TMPDIR=/tmp")
-	podman.Stdin = os.Stdin
-	podman.Stdout = os.Stdout
-	podman.Stderr = os.Stderr
-	if err := podman.Run(); err != nil {
-		return fmt.Errorf("%v: %v", podman.Args, err)
-	}
-	return nil
-}
-
-func zigbee2mqtt() error {
-	// Ensure we have an up-to-date clock, which in turn also means that
-	// networking is up. This is relevant because podman takes what’s in
-	// /etc/resolv.conf (nothing at boot) and holds on to it, meaning your
-	// container will never have working networking if it starts too early.
-	gokrazy.WaitForClock()
-
-	if err := mountVar(); err != nil {
-		return err
-	}
-
-	if err := podman("kill", "zigbee2mqtt"); err != nil {
-		log.Print(err)
-	}
-
-	if err := podman("rm", "zigbee2mqtt"); err != nil {
-		log.Print(err)
-	}
-
-	// You could podman pull here.
-
-	if err := podman("run",
-		"-td",
-		"-v", "/perm/zigbee2mqtt/data:/app/data",
-		"-v", "/dev/ttyUSB0:/dev/ttyUSB0",
-		"-e", "TZ=Europe/Berlin",
-		"--network", "host",
-		"--privileged",
-		"--name", "zigbee2mqtt",
-		"koenkk/zigbee2mqtt"); err != nil {
-		return err
-	}
-
-	return nil
+var spec = containerComponent.Spec{
+	Name:  "zigbee2mqtt",
+	Image: "koenkk/zigbee2mqtt",
+	// The frontend has to be enabled in configuration.yaml, on its
+	// default port.
+	Health: &containerComponent.Probe{HTTP: "http://localhost:8080/"},
+	Volumes: []string{
+		"/perm/zigbee2mqtt/data:/app/data",
+	},
+	// The coordinator is found by its USB IDs (Silicon Labs CP210x, as on
+	// the Sonoff dongles) rather than by enumeration order. Other sticks can
+	// be selected with serial_devices in /perm/zigbee2mqtt/container.json.
+	SerialDevices: []containerComponent.SerialDevice{
+		{VendorID: "10c4", ProductID: "ea60", Target: "/dev/ttyUSB0"},
+	},
+	Env: []string{
+		"TZ=Europe/Berlin",
+	},
+	DependsOn: []containerComponent.Dependency{
+		{TCP: "localhost:1883", Timeout: 5 * time.Minute},
+	},
+	Network:    "host",
+	Privileged: true,
+	Logs: containerComponent.Logs{
+		Warn:  `^\[[^]]*\] warning:|Zigbee2MQTT:warn`,
+		Error: `^\[[^]]*\] error:|Zigbee2MQTT:error`,
+	},
 }
 
 func main() {
-	if err := zigbee2mqtt(); err != nil {
-		log.Fatal(err)
-	}
+	containerComponent.Main(spec)
 }
-
-// mountVar bind-mounts /perm/container-storage to /var if needed.
-// This could be handled by an fstab(5) feature in gokrazy in the future.
-func mountVar() error {
-	b, err := os.ReadFile("/proc/self/mountinfo")
-	if err != nil {
-		log.Printf("Cannot Check mountpoint!")
-		return err
-	}
-	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
-		parts := strings.Fields(line)
-		if len(parts) < 5 {
-			continue
-		}
-		mountpoint := parts[4]
-		log.Printf("Found mountpoint %q", parts[4])
-		if mountpoint == "/var" {
-			log.Printf("/var file system already mounted, nothing to do")
-			return nil
-		}
-	}
-
-	if err := syscall.Mount("/perm/container-storage", "/var", "", syscall.MS_BIND, ""); err != nil {
-		return fmt.Errorf("mounting /perm/container-storage to /var: %v", err)
-	}
-
-	return nil
-}
-
-// expandPath returns env, but with PATH= modified or added
-// such that both /user and /usr/local/bin are included, which podman needs.
-func expandPath(env []string) []string {
-	extra := "/user:/usr/local/bin"
-	found := false
-	for idx, val := range env {
-		parts := strings.Split(val, "=")
-		if len(parts) < 2 {
-			continue // malformed entry
-		}
-		key := parts[0]
-		if key != "PATH" {
-			continue
-		}
-		val := strings.Join(parts[1:], "=")
-		env[idx] = fmt.Sprintf("%s=%s:%s", key, extra, val)
-		found = true
-	}
-	if !found {
-		const busyboxDefaultPATH = "/usr/local/sbin:/sbin:/usr/sbin:/usr/local/bin:/bin:/usr/bin"
-		env = append(env, fmt.Sprintf("PATH=%s:%s", extra, busyboxDefaultPATH))
-	}
-	return env
-}
-